@@ -1,5 +1,11 @@
 package bencode
 
+import (
+	"reflect"
+	"sort"
+	"strings"
+)
+
 const (
 	I     = byte('i')
 	E     = byte('e')
@@ -7,3 +13,62 @@ const (
 	D     = byte('d')
 	COLON = byte(':')
 )
+
+type structField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+type sortedFields []structField
+
+func (sf sortedFields) Len() int           { return len(sf) }
+func (sf sortedFields) Less(i, j int) bool { return sf[i].name < sf[j].name }
+func (sf sortedFields) Swap(i, j int)      { sf[i], sf[j] = sf[j], sf[i] }
+
+// structFields returns the exported fields of a struct type sorted by their
+// keys. The key is the name in the bencode tag or the name of the field.
+// The fields of embedded structs are promoted. The "omitempty" tag option
+// skips empty values, and the "-" tag skips the field.
+func structFields(t reflect.Type) []structField {
+	fields := make([]structField, 0, t.NumField())
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+
+		tag := f.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+
+		name, opts := tag, ""
+		if comma := strings.Index(tag, ","); comma >= 0 {
+			name, opts = tag[:comma], tag[comma+1:]
+		}
+
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for _, inner := range structFields(f.Type) {
+				inner.index = append([]int{i}, inner.index...)
+				fields = append(fields, inner)
+			}
+			continue
+		}
+
+		if f.PkgPath != "" {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+
+		fields = append(fields, structField{name, []int{i}, opts == "omitempty"})
+	}
+
+	sort.Sort(sortedFields(fields))
+
+	return fields
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"sort"
 )
 
 func Marshal(v interface{}) (data []byte, err error) {
@@ -30,6 +31,7 @@ func Marshal(v interface{}) (data []byte, err error) {
 	m.marshallers[reflect.Uint64] = m.marshalUint
 	m.marshallers[reflect.Array] = m.marshalArray
 	m.marshallers[reflect.Map] = m.marshalMap
+	m.marshallers[reflect.Interface] = m.marshalPtr
 	m.marshallers[reflect.Ptr] = m.marshalPtr
 	m.marshallers[reflect.Slice] = m.marshalArray
 	m.marshallers[reflect.String] = m.marshalString
@@ -70,7 +72,10 @@ func (m *marshaller) marshalMap(v reflect.Value) error {
 
 	m.buffer.WriteString("d")
 
-	for _, k := range v.MapKeys() {
+	keys := v.MapKeys()
+	sort.Sort(sortedKeys(keys))
+
+	for _, k := range keys {
 		if err := m.marshalString(k); err != nil {
 			return err
 		}
@@ -84,13 +89,23 @@ func (m *marshaller) marshalMap(v reflect.Value) error {
 	return nil
 }
 
+type sortedKeys []reflect.Value
+
+func (sk sortedKeys) Len() int           { return len(sk) }
+func (sk sortedKeys) Less(i, j int) bool { return sk[i].String() < sk[j].String() }
+func (sk sortedKeys) Swap(i, j int)      { sk[i], sk[j] = sk[j], sk[i] }
+
 func (m *marshaller) marshalStruct(v reflect.Value) error {
 	m.buffer.WriteString("d")
 
-	for i := 0; i < v.NumField(); i++ {
-		field := v.Type().Field(i)
-		m.marshalString(reflect.ValueOf(field.Name))
-		if err := m.marshal(v.Field(i)); err != nil {
+	for _, f := range structFields(v.Type()) {
+		fv := v.FieldByIndex(f.index)
+		if f.omitEmpty && isEmpty(fv) {
+			continue
+		}
+
+		m.marshalString(reflect.ValueOf(f.name))
+		if err := m.marshal(fv); err != nil {
 			return err
 		}
 	}
@@ -100,16 +115,44 @@ func (m *marshaller) marshalStruct(v reflect.Value) error {
 	return nil
 }
 
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+
+	return false
+}
+
 func (m *marshaller) marshalString(v reflect.Value) error {
 	str := v.String()
-	if len(str) > 0 {
-		m.buffer.WriteString(fmt.Sprintf("%d:%s", len(str), str))
-	}
+	m.buffer.WriteString(fmt.Sprintf("%d:%s", len(str), str))
+
+	return nil
+}
+
+func (m *marshaller) marshalBytes(v reflect.Value) error {
+	b := make([]byte, v.Len())
+	reflect.Copy(reflect.ValueOf(b), v)
+	m.buffer.WriteString(fmt.Sprintf("%d:", len(b)))
+	m.buffer.Write(b)
 
 	return nil
 }
 
 func (m *marshaller) marshalArray(v reflect.Value) error {
+	if v.Type().Elem().Kind() == reflect.Uint8 {
+		return m.marshalBytes(v)
+	}
+
 	m.buffer.WriteString("l")
 
 	for i := 0; i < v.Len(); i++ {
@@ -133,3 +133,60 @@ func TestStringMarshal(t *testing.T) {
 		t.Errorf("invalid data from marshalling; got %s, expected %s", string(m), string(b))
 	}
 }
+
+func TestEmptyStringMarshal(t *testing.T) {
+	i := []string{"", "a"}
+	b := []byte("l0:1:ae")
+
+	m, err := Marshal(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Compare(m, b) != 0 {
+		t.Errorf("invalid data from marshalling; got %s, expected %s", string(m), string(b))
+	}
+}
+
+func TestByteSliceMarshal(t *testing.T) {
+	i := []byte{'a', 0, 'b'}
+	b := []byte("3:a\x00b")
+
+	m, err := Marshal(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Compare(m, b) != 0 {
+		t.Errorf("invalid data from marshalling; got %s, expected %s", string(m), string(b))
+	}
+}
+
+type testTaggedBase struct {
+	Interval uint64 `bencode:"interval"`
+}
+
+type testTaggedStruct struct {
+	testTaggedBase
+	FailureReason string `bencode:"failure reason,omitempty"`
+	Peers         []byte `bencode:"peers"`
+	Complete      uint32 `bencode:"complete"`
+	Skipped       int    `bencode:"-"`
+	hidden        int
+}
+
+func TestTaggedStructMarshal(t *testing.T) {
+	s := testTaggedStruct{Peers: []byte("ab"), Complete: 3, Skipped: 1, hidden: 2}
+	s.Interval = 10
+
+	b := []byte("d8:completei3e8:intervali10e5:peers2:abe")
+
+	m, err := Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Compare(b, m) != 0 {
+		t.Errorf("invalid data from marshalling; got %s, expected %s", string(m), string(b))
+	}
+}
@@ -32,6 +32,23 @@ func UnmarshalWithRaw(data []byte, v interface{}, rawproperty string) (err error
 	return s.unmarshal(v)
 }
 
+// UnmarshalPrefix decodes the value at the beginning of data, and returns
+// the number of bytes it takes. The data after the value is ignored.
+func UnmarshalPrefix(data []byte, v interface{}) (n int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New("panic: " + fmt.Sprint(r))
+		}
+	}()
+	s := newScanner(data)
+
+	if err := s.unmarshal(v); err != nil {
+		return 0, err
+	}
+
+	return int(s.position), nil
+}
+
 func newScanner(data []byte) *scanner {
 	s := new(scanner)
 	s.data = data
@@ -69,6 +86,10 @@ func (s *scanner) unmarshalValue(indirect reflect.Value) error {
 		indirect = reflect.Indirect(indirect)
 	}
 
+	if indirect.Kind() == reflect.Interface && indirect.NumMethod() == 0 {
+		return s.unmarshalInterface(indirect)
+	}
+
 	var unmarshaller func(reflect.Value) error
 	mark := s.data[s.position]
 	if _, ok := s.unmarshallers[mark]; ok {
@@ -80,6 +101,29 @@ func (s *scanner) unmarshalValue(indirect reflect.Value) error {
 	return unmarshaller(indirect)
 }
 
+// unmarshalInterface stores an integer as int64, a string as string, a list
+// as []interface{} and a dictionary as map[string]interface{}.
+func (s *scanner) unmarshalInterface(indirect reflect.Value) error {
+	var v reflect.Value
+	switch s.data[s.position] {
+	case I:
+		v = reflect.New(reflect.TypeOf(int64(0))).Elem()
+	case L:
+		v = reflect.New(reflect.TypeOf([]interface{}{})).Elem()
+	case D:
+		v = reflect.New(reflect.TypeOf(map[string]interface{}{})).Elem()
+	default:
+		v = reflect.New(reflect.TypeOf("")).Elem()
+	}
+
+	if err := s.unmarshalValue(v); err != nil {
+		return err
+	}
+	indirect.Set(v)
+
+	return nil
+}
+
 func (s *scanner) unmarshalObject(indirect reflect.Value) error {
 	switch indirect.Kind() {
 	case reflect.Struct:
@@ -131,18 +175,30 @@ func (s *scanner) unmarshalStruct(indirect reflect.Value) error {
 
 	indirect.Set(reflect.New(indirect.Type()).Elem())
 
+	fields := structFields(indirect.Type())
+
 	for s.data[s.position] != E {
 		key := reflect.New(reflect.TypeOf("")).Elem()
 		if err := s.unmarshalString(key); err != nil {
 			return err
 		}
 
-		field := indirect.FieldByNameFunc(func(f string) bool {
-			k := key.String()
-			k = strings.Replace(k, " ", "", -1)
-			k = strings.Replace(k, "-", "", -1)
-			return strings.ToLower(f) == strings.ToLower(k)
-		})
+		var field reflect.Value
+		for _, f := range fields {
+			if f.name == key.String() {
+				field = indirect.FieldByIndex(f.index)
+				break
+			}
+		}
+
+		if !field.IsValid() {
+			field = indirect.FieldByNameFunc(func(f string) bool {
+				k := key.String()
+				k = strings.Replace(k, " ", "", -1)
+				k = strings.Replace(k, "-", "", -1)
+				return strings.ToLower(f) == strings.ToLower(k)
+			})
+		}
 
 		if !field.IsValid() {
 			return errors.New("invalid struct key: " + key.String())
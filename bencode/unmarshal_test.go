@@ -73,7 +73,7 @@ func TestArrayUnmarshal(t *testing.T) {
 
 	for i := 0; i < 3; i++ {
 		if vals[i] != uint64(i+1) {
-			t.Errorf("invalid array value, got %u, expected %u", vals[i], i+1)
+			t.Errorf("invalid array value, got %d, expected %d", vals[i], i+1)
 		}
 	}
 }
@@ -160,7 +160,7 @@ func TestComplexStructUnmarshal(t *testing.T) {
 
 	for i := 0; i < 3; i++ {
 		if s.C[i] != uint(i+1) {
-			t.Errorf("invalid array value, got %u, expected %u", s.C[i], i+1)
+			t.Errorf("invalid array value, got %d, expected %d", s.C[i], i+1)
 		}
 	}
 
@@ -230,3 +230,70 @@ func TestRawPropertyUnmarshal(t *testing.T) {
 		t.Errorf("invalid raw value in struct, got %s, expected %s", s.Raw, string(b))
 	}
 }
+
+func TestTaggedStructUnmarshal(t *testing.T) {
+	b := []byte("d8:completei3e14:failure reason3:bad8:intervali10e5:peers2:abe")
+	var s testTaggedStruct
+
+	err := Unmarshal(b, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Interval != 10 || s.Complete != 3 || s.FailureReason != "bad" || string(s.Peers) != "ab" {
+		t.Errorf("invalid values in struct: %+v", s)
+	}
+}
+
+func TestInterfaceUnmarshal(t *testing.T) {
+	b := []byte("d1:ai-1e1:bl1:ci2ee1:dd1:e0:ee")
+	var v interface{}
+
+	err := Unmarshal(b, &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, ok := v.(map[string]interface{})
+	if !ok {
+		t.Fatalf("got %T, expected a map", v)
+	}
+
+	if a, ok := d["a"].(int64); !ok || a != -1 {
+		t.Errorf("got %v, expected -1", d["a"])
+	}
+
+	l, ok := d["b"].([]interface{})
+	if !ok || len(l) != 2 || l[0] != "c" || l[1] != int64(2) {
+		t.Errorf("got %v, expected [c 2]", d["b"])
+	}
+
+	if e, ok := d["d"].(map[string]interface{}); !ok || e["e"] != "" {
+		t.Errorf("got %v, expected map[e:]", d["d"])
+	}
+
+	m, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m) != string(b) {
+		t.Errorf("got %s, expected %s", m, b)
+	}
+}
+
+func TestUnmarshalPrefix(t *testing.T) {
+	b := []byte("d1:ai1eeabc")
+	var v map[string]int
+
+	n, err := UnmarshalPrefix(b, &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 8 {
+		t.Errorf("got %d, expected %d", n, 8)
+	}
+	if v["a"] != 1 {
+		t.Errorf("invalid value in map, got %d, expected 1", v["a"])
+	}
+}
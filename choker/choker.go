@@ -0,0 +1,202 @@
+package choker
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	RechokeInterval    = 10 * time.Second
+	OptimisticInterval = 30 * time.Second
+)
+
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (rc realClock) Now() time.Time {
+	return time.Now()
+}
+
+var RealClock Clock = realClock{}
+
+// Peer is a connection the choker decides about. peer.Conn implements it.
+type Peer interface {
+	PeerInterested() bool
+	AmChoking() bool
+	SetChoking(choking bool)
+	// Downloaded and Uploaded are the total bytes transferred from and to
+	// the peer.
+	Downloaded() uint64
+	Uploaded() uint64
+}
+
+type counters struct {
+	downloaded uint64
+	uploaded   uint64
+}
+
+type rates struct {
+	download float64
+	upload   float64
+}
+
+// Choker implements the tit-for-tat choking algorithm: the peers we get the
+// best rates from are unchoked, and one more peer is unchoked optimistically
+// to discover better partners.
+type Choker struct {
+	mtx            sync.Mutex
+	clock          Clock
+	rand           *rand.Rand
+	slots          int
+	counters       map[Peer]counters
+	rates          map[Peer]rates
+	lastRechoke    time.Time
+	lastOptimistic time.Time
+	optimistic     Peer
+}
+
+func NewChoker(slots int, clock Clock, r *rand.Rand) *Choker {
+	c := new(Choker)
+	c.clock = clock
+	c.rand = r
+	c.slots = slots
+	c.counters = make(map[Peer]counters)
+	c.rates = make(map[Peer]rates)
+	return c
+}
+
+func (c *Choker) Optimistic() Peer {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.optimistic
+}
+
+// Tick measures the rates and rechokes when RechokeInterval has passed since
+// the last time. It should be called frequently, e.g. every second.
+func (c *Choker) Tick(peers []Peer, seeding bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	now := c.clock.Now()
+	if now.Sub(c.lastRechoke) < RechokeInterval {
+		return
+	}
+
+	c.measure(peers, now.Sub(c.lastRechoke))
+	c.lastRechoke = now
+
+	if c.optimistic == nil || now.Sub(c.lastOptimistic) >= OptimisticInterval {
+		c.lastOptimistic = now
+		c.optimistic = nil
+	}
+
+	c.rechoke(peers, seeding)
+}
+
+// Rechoke applies the choking decisions immediately, e.g. when a peer
+// becomes interested, with the rates measured by the last tick.
+func (c *Choker) Rechoke(peers []Peer, seeding bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.rechoke(peers, seeding)
+}
+
+func (c *Choker) measure(peers []Peer, elapsed time.Duration) {
+	seconds := elapsed.Seconds()
+	cs := make(map[Peer]counters)
+	rs := make(map[Peer]rates)
+
+	for _, p := range peers {
+		current := counters{p.Downloaded(), p.Uploaded()}
+		cs[p] = current
+
+		if last, ok := c.counters[p]; ok && seconds > 0 {
+			rs[p] = rates{
+				float64(current.downloaded-last.downloaded) / seconds,
+				float64(current.uploaded-last.uploaded) / seconds,
+			}
+		}
+	}
+
+	c.counters = cs
+	c.rates = rs
+}
+
+type byRate struct {
+	peers   []Peer
+	rates   map[Peer]rates
+	seeding bool
+}
+
+func (br byRate) Len() int {
+	return len(br.peers)
+}
+
+func (br byRate) Less(i, j int) bool {
+	ri, rj := br.rates[br.peers[i]], br.rates[br.peers[j]]
+	if br.seeding {
+		return ri.upload > rj.upload
+	}
+
+	return ri.download > rj.download
+}
+
+func (br byRate) Swap(i, j int) {
+	br.peers[i], br.peers[j] = br.peers[j], br.peers[i]
+}
+
+func (c *Choker) rechoke(peers []Peer, seeding bool) {
+	interested := make([]Peer, 0)
+	present := false
+	for _, p := range peers {
+		if p.PeerInterested() {
+			interested = append(interested, p)
+		}
+		if p == c.optimistic {
+			present = true
+		}
+	}
+	if !present || (c.optimistic != nil && !c.optimistic.PeerInterested()) {
+		c.optimistic = nil
+	}
+
+	sort.Stable(byRate{interested, c.rates, seeding})
+
+	unchoke := make(map[Peer]bool)
+	regular := c.slots - 1
+	if regular < 0 {
+		regular = 0
+	}
+	for i := 0; i < len(interested) && i < regular; i++ {
+		unchoke[interested[i]] = true
+	}
+
+	if c.optimistic == nil || unchoke[c.optimistic] {
+		candidates := make([]Peer, 0)
+		for _, p := range interested {
+			if !unchoke[p] {
+				candidates = append(candidates, p)
+			}
+		}
+
+		c.optimistic = nil
+		if len(candidates) > 0 {
+			c.optimistic = candidates[c.rand.Intn(len(candidates))]
+		}
+	}
+
+	if c.optimistic != nil && c.slots > 0 {
+		unchoke[c.optimistic] = true
+	}
+
+	for _, p := range peers {
+		p.SetChoking(!unchoke[p])
+	}
+}
@@ -0,0 +1,164 @@
+package choker
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+type testClock struct {
+	now time.Time
+}
+
+func (tc *testClock) Now() time.Time {
+	return tc.now
+}
+
+func (tc *testClock) Advance(d time.Duration) {
+	tc.now = tc.now.Add(d)
+}
+
+type testPeer struct {
+	interested bool
+	choking    bool
+	downloaded uint64
+	uploaded   uint64
+}
+
+func (tp *testPeer) PeerInterested() bool {
+	return tp.interested
+}
+
+func (tp *testPeer) AmChoking() bool {
+	return tp.choking
+}
+
+func (tp *testPeer) SetChoking(choking bool) {
+	tp.choking = choking
+}
+
+func (tp *testPeer) Downloaded() uint64 {
+	return tp.downloaded
+}
+
+func (tp *testPeer) Uploaded() uint64 {
+	return tp.uploaded
+}
+
+func newTestPeers(n int) ([]*testPeer, []Peer) {
+	tps := make([]*testPeer, n)
+	peers := make([]Peer, n)
+	for i := range tps {
+		tps[i] = &testPeer{interested: true, choking: true}
+		peers[i] = tps[i]
+	}
+
+	return tps, peers
+}
+
+func unchoked(tps []*testPeer) []int {
+	indexes := make([]int, 0)
+	for i, tp := range tps {
+		if !tp.choking {
+			indexes = append(indexes, i)
+		}
+	}
+
+	return indexes
+}
+
+func TestTitForTat(t *testing.T) {
+	clock := &testClock{time.Unix(1000000, 0)}
+	c := NewChoker(3, clock, rand.New(rand.NewSource(1)))
+	tps, peers := newTestPeers(5)
+
+	c.Tick(peers, false)
+	if n := len(unchoked(tps)); n != 3 {
+		t.Errorf("free slots are not used before the rates are known, got %d unchoked peers", n)
+	}
+
+	for i, tp := range tps {
+		tp.downloaded = uint64(i) * 10000
+	}
+
+	clock.Advance(RechokeInterval / 2)
+	c.Tick(peers, false)
+	for i, tp := range tps {
+		tp.downloaded += uint64(i) * 10000
+	}
+	clock.Advance(RechokeInterval / 2)
+	c.Tick(peers, false)
+
+	if tps[4].choking || tps[3].choking {
+		t.Error("the fastest peers are choked")
+	}
+
+	if n := len(unchoked(tps)); n != 3 {
+		t.Errorf("invalid number of unchoked peers, got %d, expected 3", n)
+	}
+
+	if opt := c.Optimistic(); opt == peers[3] || opt == peers[4] {
+		t.Error("optimistic unchoke is one of the regular unchokes")
+	}
+}
+
+func TestSeedingUsesUploadRate(t *testing.T) {
+	clock := &testClock{time.Unix(1000000, 0)}
+	c := NewChoker(2, clock, rand.New(rand.NewSource(1)))
+	tps, peers := newTestPeers(3)
+
+	c.Tick(peers, true)
+	tps[0].downloaded = 100000
+	tps[2].uploaded = 100000
+	clock.Advance(RechokeInterval)
+	c.Tick(peers, true)
+
+	if tps[2].choking {
+		t.Error("the peer we upload to the fastest is choked while seeding")
+	}
+}
+
+func TestOptimisticRotation(t *testing.T) {
+	clock := &testClock{time.Unix(1000000, 0)}
+	c := NewChoker(1, clock, rand.New(rand.NewSource(1)))
+	tps, peers := newTestPeers(10)
+
+	c.Tick(peers, false)
+	first := c.Optimistic()
+
+	for i := 0; i < 2; i++ {
+		clock.Advance(RechokeInterval)
+		c.Tick(peers, false)
+		if c.Optimistic() != first {
+			t.Fatal("optimistic unchoke rotated before the interval")
+		}
+	}
+
+	rotated := false
+	for i := 0; i < 10 && !rotated; i++ {
+		clock.Advance(OptimisticInterval)
+		c.Tick(peers, false)
+		rotated = c.Optimistic() != first
+	}
+	if !rotated {
+		t.Error("optimistic unchoke never rotates")
+	}
+
+	if u := unchoked(tps); len(u) != 1 || peers[u[0]] != c.Optimistic() {
+		t.Errorf("invalid unchoked peers: %v", u)
+	}
+}
+
+func TestUninterestedPeersAreChoked(t *testing.T) {
+	clock := &testClock{time.Unix(1000000, 0)}
+	c := NewChoker(4, clock, rand.New(rand.NewSource(1)))
+	tps, peers := newTestPeers(2)
+	tps[0].interested = false
+	tps[0].choking = false
+
+	c.Rechoke(peers, false)
+
+	if !tps[0].choking || tps[1].choking {
+		t.Errorf("invalid choking state: %v %v", tps[0].choking, tps[1].choking)
+	}
+}
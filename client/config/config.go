@@ -1,14 +1,59 @@
 package config
 
-import "github.com/yorirou/gotorrent/util"
+import (
+	"github.com/yorirou/gotorrent/mse"
+	"github.com/yorirou/gotorrent/util"
+	"net"
+	"time"
+)
+
+// Encryption is the policy of the message stream encryption.
+type Encryption int
+
+const (
+	// EncryptionDisabled only makes and accepts plaintext connections.
+	EncryptionDisabled Encryption = iota
+	// EncryptionPrefer encrypts the connections when the peer supports it.
+	EncryptionPrefer
+	// EncryptionRequire refuses the plaintext connections.
+	EncryptionRequire
+)
+
+// Methods returns the crypto methods allowed by the policy.
+func (e Encryption) Methods() uint32 {
+	switch e {
+	case EncryptionPrefer:
+		return mse.Plaintext | mse.RC4
+	case EncryptionRequire:
+		return mse.RC4
+	}
+
+	return mse.Plaintext
+}
 
 type ClientConfig struct {
-	PeerID string
-	Port   uint64
+	PeerID             string
+	Port               uint64
+	PipelineDepth      int
+	RequestTimeout     time.Duration
+	MaxConns           int
+	MaxConnsPerTorrent int
+	UploadSlots        int
+	Encryption         Encryption
+	// Addresses sent to the trackers beside the one the announce is
+	// sent from, so the peers of both families can connect (BEP 7).
+	IPv4 net.IP
+	IPv6 net.IP
 }
 
 func NewClientConfig() *ClientConfig {
 	cc := new(ClientConfig)
 	cc.PeerID = util.GeneratePeerID()
+	cc.PipelineDepth = 5
+	cc.RequestTimeout = time.Minute
+	cc.MaxConns = 200
+	cc.MaxConnsPerTorrent = 50
+	cc.UploadSlots = 4
+	cc.Encryption = EncryptionPrefer
 	return cc
 }
@@ -0,0 +1,201 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"github.com/yorirou/gotorrent/client/config"
+	"github.com/yorirou/gotorrent/mse"
+	"github.com/yorirou/gotorrent/peer"
+	"github.com/yorirou/gotorrent/torrent"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	handshakeTimeout = 30 * time.Second
+)
+
+// Listener accepts incoming peer connections on the port of the client and
+// hands them to the torrent with the matching info hash.
+type Listener struct {
+	listener net.Listener
+	config   *config.ClientConfig
+	torrents map[string]*torrent.Torrent
+	conns    int
+	mtx      sync.Mutex
+}
+
+func NewListener(cc *config.ClientConfig) (*Listener, error) {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", cc.Port))
+	if err != nil {
+		return nil, err
+	}
+
+	l := new(Listener)
+	l.listener = ln
+	l.config = cc
+	l.torrents = make(map[string]*torrent.Torrent)
+
+	return l, nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// AddTorrent routes the incoming connections of the torrent to it. The
+// outgoing connections of the torrent count against MaxConns too.
+func (l *Listener) AddTorrent(t *torrent.Torrent) {
+	t.SetConnLimiter(l)
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.torrents[t.GetMetaInfo().Info.Hash] = t
+}
+
+func (l *Listener) RemoveTorrent(t *torrent.Torrent) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	delete(l.torrents, t.GetMetaInfo().Info.Hash)
+}
+
+// NumConns returns the number of incoming and outgoing connections.
+func (l *Listener) NumConns() int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	return l.conns
+}
+
+// AcquireConn reserves a connection, it returns false if MaxConns is
+// reached.
+func (l *Listener) AcquireConn() bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.conns >= l.config.MaxConns {
+		return false
+	}
+	l.conns++
+
+	return true
+}
+
+func (l *Listener) ReleaseConn() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.conns--
+}
+
+// Serve accepts connections until the listener is closed.
+func (l *Listener) Serve() error {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		if !l.AcquireConn() {
+			conn.Close()
+			continue
+		}
+
+		go func() {
+			if err := l.handle(conn); err != nil {
+				log.Print(conn.RemoteAddr(), ": ", err)
+			}
+
+			l.ReleaseConn()
+		}()
+	}
+}
+
+func (l *Listener) Close() error {
+	return l.listener.Close()
+}
+
+func (l *Listener) handle(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	c, skey, err := l.decrypt(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	conn = c
+
+	h, err := peer.ReadHandshake(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	// The info hash of an encrypted connection is already known.
+	if skey != "" && h.InfoHash != skey {
+		conn.Close()
+		return peer.ErrInfoHashMismatch
+	}
+
+	l.mtx.Lock()
+	t, ok := l.torrents[h.InfoHash]
+	l.mtx.Unlock()
+
+	if !ok {
+		conn.Close()
+		return errors.New("unknown info hash")
+	}
+
+	if h.PeerID == l.config.PeerID {
+		conn.Close()
+		return errors.New("connection to ourselves")
+	}
+
+	if t.NumConns() >= l.config.MaxConnsPerTorrent {
+		conn.Close()
+		return torrent.ErrTooManyConns
+	}
+
+	if err := peer.WriteHandshake(conn, t.Handshake()); err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return t.Accept(conn, h)
+}
+
+// decrypt detects the encrypted connections, and returns the info hash they
+// are routed to. The connections are refused according to the encryption
+// policy.
+func (l *Listener) decrypt(conn net.Conn) (net.Conn, string, error) {
+	conn, plaintext, err := mse.Sniff(conn)
+	if err != nil {
+		return nil, "", err
+	}
+
+	policy := l.config.Encryption
+	if plaintext {
+		if policy == config.EncryptionRequire {
+			return nil, "", errors.New("plaintext connection refused")
+		}
+		return conn, "", nil
+	}
+
+	if policy == config.EncryptionDisabled {
+		return nil, "", errors.New("encrypted connection refused")
+	}
+
+	l.mtx.Lock()
+	skeys := make([]string, 0, len(l.torrents))
+	for ih := range l.torrents {
+		skeys = append(skeys, ih)
+	}
+	l.mtx.Unlock()
+
+	return mse.Accept(conn, skeys, policy.Methods())
+}
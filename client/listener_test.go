@@ -0,0 +1,174 @@
+package client
+
+import (
+	"github.com/yorirou/gotorrent/client/config"
+	"github.com/yorirou/gotorrent/metainfo"
+	"github.com/yorirou/gotorrent/mse"
+	"github.com/yorirou/gotorrent/peer"
+	"github.com/yorirou/gotorrent/storage"
+	"github.com/yorirou/gotorrent/torrent"
+	"net"
+	"testing"
+	"time"
+)
+
+const testPeerID = "-GT0000-remote000000"
+
+func newTestTorrent(hash string, cc *config.ClientConfig) *torrent.Torrent {
+	mi := new(metainfo.Metainfo)
+	mi.Info.Hash = hash
+	mi.Info.Name = "test"
+	mi.Info.PieceLength = 4
+	mi.Info.Length = 4
+	mi.Info.Pieces = make([]byte, 20)
+
+	t := torrent.NewTorrent(mi, cc)
+	t.SetStorage(storage.NewMemoryStorage(&mi.Info))
+	return t
+}
+
+func newTestListener(t *testing.T, cc *config.ClientConfig) *Listener {
+	cc.Port = 0
+
+	l, err := NewListener(cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go l.Serve()
+
+	return l
+}
+
+func dial(t *testing.T, l *Listener, infohash string) (net.Conn, *peer.Handshake, error) {
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	h, err := peer.DoHandshake(conn, infohash, testPeerID)
+	return conn, h, err
+}
+
+func dialEncrypted(t *testing.T, l *Listener, infohash string, provide uint32) (net.Conn, *peer.Handshake, error) {
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	ec, err := mse.Initiate(conn, infohash, provide)
+	if err != nil {
+		return conn, nil, err
+	}
+
+	h, err := peer.DoHandshake(ec, infohash, testPeerID)
+	return conn, h, err
+}
+
+func TestListenerRouting(t *testing.T) {
+	cc := config.NewClientConfig()
+	l := newTestListener(t, cc)
+	defer l.Close()
+
+	hashes := []string{"11111111111111111111", "22222222222222222222"}
+	for _, hash := range hashes {
+		l.AddTorrent(newTestTorrent(hash, cc))
+	}
+
+	for _, hash := range hashes {
+		conn, h, err := dial(t, l, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.PeerID != cc.PeerID {
+			t.Errorf("invalid peer id in the handshake")
+		}
+		conn.Close()
+	}
+
+	conn, _, err := dial(t, l, "33333333333333333333")
+	if err == nil {
+		t.Error("connection with unknown info hash is accepted")
+	}
+	conn.Close()
+}
+
+func TestListenerTorrentLimit(t *testing.T) {
+	cc := config.NewClientConfig()
+	cc.MaxConnsPerTorrent = 1
+	l := newTestListener(t, cc)
+	defer l.Close()
+
+	hash := "11111111111111111111"
+	tr := newTestTorrent(hash, cc)
+	l.AddTorrent(tr)
+
+	first, _, err := dial(t, l, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	for i := 0; i < 100 && tr.NumConns() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	second, _, err := dial(t, l, hash)
+	if err == nil {
+		t.Error("connection over the limit is accepted")
+	}
+	second.Close()
+}
+
+func TestListenerEncryption(t *testing.T) {
+	hashes := []string{"11111111111111111111", "22222222222222222222"}
+
+	for _, test := range []struct {
+		policy    config.Encryption
+		plaintext bool
+		encrypted bool
+	}{
+		{config.EncryptionDisabled, true, false},
+		{config.EncryptionPrefer, true, true},
+		{config.EncryptionRequire, false, true},
+	} {
+		cc := config.NewClientConfig()
+		cc.Encryption = test.policy
+		l := newTestListener(t, cc)
+		for _, hash := range hashes {
+			l.AddTorrent(newTestTorrent(hash, cc))
+		}
+
+		conn, _, err := dial(t, l, hashes[1])
+		if (err == nil) != test.plaintext {
+			t.Errorf("policy %d: got error %v for a plaintext connection", test.policy, err)
+		}
+		conn.Close()
+
+		// Encrypted connections are routed by the hash of the info hash.
+		conn, h, err := dialEncrypted(t, l, hashes[1], mse.RC4)
+		if (err == nil) != test.encrypted {
+			t.Errorf("policy %d: got error %v for an encrypted connection", test.policy, err)
+		}
+		if err == nil && (h.InfoHash != hashes[1] || h.PeerID != cc.PeerID) {
+			t.Errorf("policy %d: invalid handshake after encryption", test.policy)
+		}
+		conn.Close()
+
+		l.Close()
+	}
+}
+
+func TestListenerEncryptedUnknownHash(t *testing.T) {
+	cc := config.NewClientConfig()
+	l := newTestListener(t, cc)
+	defer l.Close()
+	l.AddTorrent(newTestTorrent("11111111111111111111", cc))
+
+	conn, _, err := dialEncrypted(t, l, "33333333333333333333", mse.Plaintext|mse.RC4)
+	if err == nil {
+		t.Error("encrypted connection with unknown info hash is accepted")
+	}
+	conn.Close()
+}
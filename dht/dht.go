@@ -0,0 +1,618 @@
+package dht
+
+import (
+	"errors"
+	"github.com/yorirou/gotorrent/bencode"
+	"github.com/yorirou/gotorrent/tracker"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultBootstrapNodes are well known nodes of the mainline DHT.
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"router.utorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+}
+
+const (
+	// alpha is the number of parallel queries in a lookup.
+	alpha = 3
+	// maxLookupQueries stops the lookups which never converge.
+	maxLookupQueries = 200
+	maxPacketSize    = 4096
+)
+
+var (
+	queryTimeout        = 5 * time.Second
+	maintenanceInterval = time.Minute
+)
+
+var (
+	ErrTimeout = errors.New("dht query timed out")
+	ErrClosed  = errors.New("dht is closed")
+	ErrNoNodes = errors.New("no dht nodes are reachable")
+)
+
+// DHT is a node of the mainline DHT (BEP 5).
+type DHT struct {
+	// BootstrapNodes are the "host:port" addresses used to join the DHT.
+	BootstrapNodes []string
+
+	id        string
+	conn      *net.UDPConn
+	table     *table
+	tokens    *tokens
+	store     *store
+	pending   map[string]*transaction
+	tid       uint16
+	stop      chan struct{}
+	closeOnce sync.Once
+	mtx       sync.Mutex
+}
+
+type transaction struct {
+	addr     string
+	response chan *message
+}
+
+// NewDHT creates a node listening on the given UDP address. It does not
+// answer or send queries until Start is called.
+func NewDHT(laddr string) (*DHT, error) {
+	addr, err := net.ResolveUDPAddr("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	d := new(DHT)
+	d.BootstrapNodes = DefaultBootstrapNodes
+	d.id = RandomID()
+	d.conn = conn
+	d.table = newTable(d.id)
+	d.tokens = newTokens()
+	d.store = newStore()
+	d.pending = make(map[string]*transaction)
+	d.stop = make(chan struct{})
+	return d, nil
+}
+
+func (d *DHT) ID() string {
+	return d.id
+}
+
+func (d *DHT) Addr() *net.UDPAddr {
+	return d.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Nodes returns the nodes of the routing table.
+func (d *DHT) Nodes() []*Node {
+	return d.table.nodes()
+}
+
+// Start answers the queries of other nodes and keeps the routing table
+// fresh in the background.
+func (d *DHT) Start() {
+	go d.serve()
+	go d.maintain()
+}
+
+func (d *DHT) Close() {
+	d.closeOnce.Do(func() {
+		close(d.stop)
+		d.conn.Close()
+	})
+}
+
+// Bootstrap joins the DHT by looking up our own id through the bootstrap
+// nodes and the nodes already in the routing table.
+func (d *DHT) Bootstrap() error {
+	seeds := make([]*net.UDPAddr, 0, len(d.BootstrapNodes))
+	for _, node := range d.BootstrapNodes {
+		addr, err := net.ResolveUDPAddr("udp", node)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		seeds = append(seeds, addr)
+	}
+
+	d.lookup(d.id, false, seeds)
+
+	if d.table.len() == 0 {
+		return ErrNoNodes
+	}
+
+	return nil
+}
+
+func (d *DHT) Ping(addr *net.UDPAddr) error {
+	_, err := d.query(addr, "ping", map[string]interface{}{})
+	return err
+}
+
+// FindNode returns the K nodes closest to the target.
+func (d *DHT) FindNode(target string) ([]*Node, error) {
+	if d.table.len() == 0 {
+		return nil, ErrNoNodes
+	}
+
+	return d.lookup(target, false, nil).nodes, nil
+}
+
+// GetPeers returns the peers announced for the info hash.
+func (d *DHT) GetPeers(infohash string) ([]*tracker.Peer, error) {
+	if d.table.len() == 0 {
+		return nil, ErrNoNodes
+	}
+
+	return d.lookup(infohash, true, nil).peers, nil
+}
+
+// Announce tells the nodes closest to the info hash that we have the
+// torrent on the given port. The peers found during the lookup are returned.
+func (d *DHT) Announce(infohash string, port int) ([]*tracker.Peer, error) {
+	if d.table.len() == 0 {
+		return nil, ErrNoNodes
+	}
+
+	res := d.lookup(infohash, true, nil)
+
+	accepted := make(chan bool, len(res.nodes))
+	for _, n := range res.nodes {
+		go func(n *Node) {
+			args := map[string]interface{}{
+				"info_hash": infohash,
+				"port":      port,
+				"token":     res.tokens[n.Addr.String()],
+			}
+			_, err := d.query(n.Addr, "announce_peer", args)
+			accepted <- err == nil
+		}(n)
+	}
+
+	ok := false
+	for range res.nodes {
+		if <-accepted {
+			ok = true
+		}
+	}
+
+	if !ok {
+		return res.peers, errors.New("no node accepted the announce")
+	}
+
+	return res.peers, nil
+}
+
+// tableFile is the routing table saved between runs, the nodes are stored
+// in the compact node info format.
+type tableFile struct {
+	ID     string
+	Nodes  string
+	Nodes6 string
+}
+
+func (d *DHT) SaveTable(path string) error {
+	nodes := make([]*Node, 0)
+	for _, n := range d.table.nodes() {
+		if n.failures < maxFailures {
+			nodes = append(nodes, n)
+		}
+	}
+
+	tf := new(tableFile)
+	tf.ID = d.id
+	tf.Nodes = string(encodeNodes(nodes, net.IPv4len))
+	tf.Nodes6 = string(encodeNodes(nodes, net.IPv6len))
+
+	b, err := bencode.Marshal(tf)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// LoadTable restores the id and the routing table saved by SaveTable. It
+// has to be called before Start.
+func (d *DHT) LoadTable(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	tf := new(tableFile)
+	if err := bencode.Unmarshal(b, tf); err != nil {
+		return err
+	}
+
+	if len(tf.ID) != IDLength {
+		return errors.New("invalid node id in the table file")
+	}
+
+	d.id = tf.ID
+	d.table = newTable(d.id)
+	nodes := append(decodeNodes([]byte(tf.Nodes), net.IPv4len), decodeNodes([]byte(tf.Nodes6), net.IPv6len)...)
+	for _, n := range nodes {
+		d.table.insert(n)
+	}
+
+	return nil
+}
+
+func (d *DHT) maintain() {
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case now := <-ticker.C:
+			d.store.expire(now)
+
+			if d.table.len() == 0 {
+				if err := d.Bootstrap(); err != nil {
+					log.Print("dht bootstrap failed: ", err)
+				}
+				continue
+			}
+
+			for _, target := range d.table.refreshTargets(now) {
+				d.lookup(target, false, nil)
+			}
+		}
+	}
+}
+
+func (d *DHT) serve() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+
+		m, err := parseMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		switch m.Y {
+		case "q":
+			d.handleQuery(m, addr)
+		case "r", "e":
+			d.handleResponse(m, addr)
+		}
+	}
+}
+
+func (d *DHT) send(m *message, addr *net.UDPAddr) error {
+	b, err := m.encode()
+	if err != nil {
+		return err
+	}
+
+	_, err = d.conn.WriteToUDP(b, addr)
+	return err
+}
+
+func (d *DHT) handleResponse(m *message, addr *net.UDPAddr) {
+	d.mtx.Lock()
+	tx, ok := d.pending[m.T]
+	if !ok || tx.addr != addr.String() {
+		d.mtx.Unlock()
+		return
+	}
+	delete(d.pending, m.T)
+	d.mtx.Unlock()
+
+	tx.response <- m
+}
+
+func (d *DHT) handleQuery(m *message, addr *net.UDPAddr) {
+	id, _ := m.A["id"].(string)
+	if len(id) != IDLength {
+		d.send(newError(m.T, ErrorProtocol, "invalid id"), addr)
+		return
+	}
+
+	var r map[string]interface{}
+
+	switch m.Q {
+	case "ping":
+		r = map[string]interface{}{"id": d.id}
+	case "find_node":
+		target, _ := m.A["target"].(string)
+		if len(target) != IDLength {
+			d.send(newError(m.T, ErrorProtocol, "invalid target"), addr)
+			return
+		}
+		r = d.nodesResponse(target)
+	case "get_peers":
+		infohash, _ := m.A["info_hash"].(string)
+		if len(infohash) != IDLength {
+			d.send(newError(m.T, ErrorProtocol, "invalid info_hash"), addr)
+			return
+		}
+		r = d.nodesResponse(infohash)
+		r["token"] = d.tokens.token(addr.IP)
+		if peers := d.store.get(infohash); len(peers) > 0 {
+			r["values"] = peers
+		}
+	case "announce_peer":
+		infohash, _ := m.A["info_hash"].(string)
+		token, _ := m.A["token"].(string)
+		if len(infohash) != IDLength {
+			d.send(newError(m.T, ErrorProtocol, "invalid info_hash"), addr)
+			return
+		}
+		if !d.tokens.valid(token, addr.IP) {
+			d.send(newError(m.T, ErrorProtocol, "invalid token"), addr)
+			return
+		}
+
+		port := addr.Port
+		if implied, _ := m.A["implied_port"].(int64); implied == 0 {
+			p, _ := m.A["port"].(int64)
+			if p <= 0 || p > 65535 {
+				d.send(newError(m.T, ErrorProtocol, "invalid port"), addr)
+				return
+			}
+			port = int(p)
+		}
+
+		d.store.add(infohash, encodePeer(addr.IP, port))
+		r = map[string]interface{}{"id": d.id}
+	default:
+		d.send(newError(m.T, ErrorMethodUnknown, "method unknown"), addr)
+		return
+	}
+
+	d.table.insert(&Node{ID: id, Addr: addr, LastSeen: time.Now()})
+	d.send(newResponse(m.T, r), addr)
+}
+
+func (d *DHT) nodesResponse(target string) map[string]interface{} {
+	closest := d.table.closest(target, K)
+
+	r := map[string]interface{}{
+		"id":    d.id,
+		"nodes": string(encodeNodes(closest, net.IPv4len)),
+	}
+	if nodes6 := encodeNodes(closest, net.IPv6len); len(nodes6) > 0 {
+		r["nodes6"] = string(nodes6)
+	}
+
+	return r
+}
+
+// query sends a query and waits for the response. The responding node is
+// added to the routing table.
+func (d *DHT) query(addr *net.UDPAddr, method string, args map[string]interface{}) (map[string]interface{}, error) {
+	args["id"] = d.id
+
+	d.mtx.Lock()
+	d.tid++
+	t := string([]byte{byte(d.tid >> 8), byte(d.tid)})
+	tx := &transaction{addr.String(), make(chan *message, 1)}
+	d.pending[t] = tx
+	d.mtx.Unlock()
+
+	defer func() {
+		d.mtx.Lock()
+		delete(d.pending, t)
+		d.mtx.Unlock()
+	}()
+
+	if err := d.send(newQuery(t, method, args), addr); err != nil {
+		d.table.failed(tx.addr)
+		return nil, err
+	}
+
+	select {
+	case m := <-tx.response:
+		if m.E != nil {
+			return nil, m.E
+		}
+
+		id, _ := m.R["id"].(string)
+		if len(id) != IDLength {
+			return nil, errors.New("invalid id in the response")
+		}
+
+		d.table.insert(&Node{ID: id, Addr: addr, LastSeen: time.Now()})
+		return m.R, nil
+	case <-time.After(queryTimeout):
+		d.table.failed(tx.addr)
+		return nil, ErrTimeout
+	case <-d.stop:
+		return nil, ErrClosed
+	}
+}
+
+type lookupResult struct {
+	// nodes are the K closest nodes which responded.
+	nodes []*Node
+	// tokens are the get_peers tokens by node address.
+	tokens map[string]string
+	peers  []*tracker.Peer
+}
+
+type lookupReply struct {
+	addr *net.UDPAddr
+	r    map[string]interface{}
+	err  error
+}
+
+// lookup runs an iterative find_node or get_peers lookup. The seeds are
+// queried first, their ids don't have to be known.
+func (d *DHT) lookup(target string, getPeers bool, seeds []*net.UDPAddr) *lookupResult {
+	res := new(lookupResult)
+	res.tokens = make(map[string]string)
+
+	method, key := "find_node", "target"
+	if getPeers {
+		method, key = "get_peers", "info_hash"
+	}
+
+	const (
+		queried = iota + 1
+		responded
+		failed
+	)
+
+	state := make(map[string]int)
+	candidates := make([]*Node, 0)
+	peers := make(map[string]bool)
+
+	// We may be one of the closest nodes ourselves.
+	addPeer := func(s string) {
+		if p := decodePeer(s); p != nil && !peers[p.Addr()] {
+			peers[p.Addr()] = true
+			res.peers = append(res.peers, p)
+		}
+	}
+	if getPeers {
+		for _, s := range d.store.get(target) {
+			addPeer(s)
+		}
+	}
+
+	add := func(n *Node) {
+		a := n.Addr.String()
+		if _, ok := state[a]; ok || n.ID == d.id {
+			return
+		}
+		state[a] = 0
+		candidates = append(candidates, n)
+	}
+	for _, n := range d.table.closest(target, K) {
+		add(n)
+	}
+
+	batch := make([]*net.UDPAddr, 0)
+	for _, addr := range seeds {
+		if _, ok := state[addr.String()]; !ok {
+			state[addr.String()] = queried
+			batch = append(batch, addr)
+		}
+	}
+
+	for queries := 0; queries < maxLookupQueries; {
+		if len(batch) == 0 {
+			sort.Sort(byDistance{candidates, target})
+			window := 0
+			for _, n := range candidates {
+				if window == K || len(batch) == alpha {
+					break
+				}
+
+				a := n.Addr.String()
+				switch state[a] {
+				case failed:
+					continue
+				case 0:
+					state[a] = queried
+					batch = append(batch, n.Addr)
+				}
+				window++
+			}
+		}
+
+		if len(batch) == 0 {
+			break
+		}
+		queries += len(batch)
+
+		replies := make(chan lookupReply, len(batch))
+		for _, addr := range batch {
+			go func(addr *net.UDPAddr) {
+				r, err := d.query(addr, method, map[string]interface{}{key: target})
+				replies <- lookupReply{addr, r, err}
+			}(addr)
+		}
+
+		for range batch {
+			reply := <-replies
+			a := reply.addr.String()
+			if reply.err != nil {
+				state[a] = failed
+				continue
+			}
+			state[a] = responded
+
+			id, _ := reply.r["id"].(string)
+			responder := &Node{ID: id, Addr: reply.addr, LastSeen: time.Now()}
+			if !containsNode(candidates, a) {
+				candidates = append(candidates, responder)
+			}
+
+			if nodes, ok := reply.r["nodes"].(string); ok {
+				for _, n := range decodeNodes([]byte(nodes), net.IPv4len) {
+					add(n)
+				}
+			}
+			if nodes, ok := reply.r["nodes6"].(string); ok {
+				for _, n := range decodeNodes([]byte(nodes), net.IPv6len) {
+					add(n)
+				}
+			}
+
+			if !getPeers {
+				continue
+			}
+			if token, ok := reply.r["token"].(string); ok {
+				res.tokens[a] = token
+			}
+			if values, ok := reply.r["values"].([]interface{}); ok {
+				for _, v := range values {
+					s, _ := v.(string)
+					addPeer(s)
+				}
+			}
+		}
+
+		batch = batch[:0]
+	}
+
+	sort.Sort(byDistance{candidates, target})
+	for _, n := range candidates {
+		if len(res.nodes) == K {
+			break
+		}
+		if state[n.Addr.String()] == responded {
+			res.nodes = append(res.nodes, n)
+		}
+	}
+
+	return res
+}
+
+func containsNode(nodes []*Node, addr string) bool {
+	for _, n := range nodes {
+		if n.Addr.String() == addr {
+			return true
+		}
+	}
+
+	return false
+}
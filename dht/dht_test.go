@@ -0,0 +1,163 @@
+package dht
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMessage(t *testing.T) {
+	m := newQuery("aa", "ping", map[string]interface{}{"id": "abcdefghij0123456789"})
+	b, err := m.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe"
+	if string(b) != expected {
+		t.Errorf("got %q, expected %q", b, expected)
+	}
+
+	b, err = newError("aa", ErrorGeneric, "A Generic Error Occurred").encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err = parseMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Y != "e" || m.E.Code != ErrorGeneric || m.E.Message != "A Generic Error Occurred" {
+		t.Errorf("invalid error message: %+v", m.E)
+	}
+
+	if _, err := parseMessage([]byte("d1:t2:aa1:y1:qe")); err == nil {
+		t.Error("expected an error for a query without arguments")
+	}
+}
+
+// startNodes starts n nodes on localhost, all of them bootstrap from the
+// first one.
+func startNodes(t *testing.T, n int) []*DHT {
+	nodes := make([]*DHT, n)
+	for i := range nodes {
+		d, err := NewDHT("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.Start()
+		nodes[i] = d
+	}
+
+	for _, d := range nodes[1:] {
+		d.BootstrapNodes = []string{nodes[0].Addr().String()}
+		if err := d.Bootstrap(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return nodes
+}
+
+func closeNodes(nodes []*DHT) {
+	for _, d := range nodes {
+		d.Close()
+	}
+}
+
+func TestDHT(t *testing.T) {
+	defer func(d time.Duration) { queryTimeout = d }(queryTimeout)
+	queryTimeout = time.Second
+
+	nodes := startNodes(t, 8)
+	defer closeNodes(nodes)
+
+	// The later nodes learn about the earlier ones while bootstrapping, the
+	// earlier ones from the queries of the later ones.
+	for i, d := range nodes {
+		if n := len(d.Nodes()); n < 2 {
+			t.Errorf("node %d knows %d nodes, expected at least 2", i, n)
+		}
+	}
+
+	found, err := nodes[1].FindNode(nodes[6].ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) == 0 || found[0].ID != nodes[6].ID() {
+		t.Errorf("the lookup did not find node 6: %v", found)
+	}
+
+	infohash := "01234567890123456789"
+	if _, err := nodes[3].Announce(infohash, 6881); err != nil {
+		t.Fatal(err)
+	}
+
+	peers, err := nodes[5].GetPeers(infohash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].Addr() != "127.0.0.1:6881" {
+		t.Errorf("got peers %v, expected 127.0.0.1:6881", peers)
+	}
+
+	if err := nodes[2].Ping(nodes[7].Addr()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAnnounceInvalidToken(t *testing.T) {
+	nodes := startNodes(t, 2)
+	defer closeNodes(nodes)
+
+	args := map[string]interface{}{"info_hash": "01234567890123456789", "port": 6881, "token": "invalid"}
+	_, err := nodes[1].query(nodes[0].Addr(), "announce_peer", args)
+	if e, ok := err.(*Error); !ok || e.Code != ErrorProtocol {
+		t.Errorf("got error %v, expected a protocol error", err)
+	}
+}
+
+func TestTablePersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotorrent-dht")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	nodes := startNodes(t, 4)
+	defer closeNodes(nodes)
+
+	path := filepath.Join(dir, "dht.table")
+	if err := nodes[1].SaveTable(path); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := NewDHT("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if err := d.LoadTable(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.ID() != nodes[1].ID() {
+		t.Error("the node id is not restored")
+	}
+	if len(d.Nodes()) != len(nodes[1].Nodes()) {
+		t.Errorf("got %d nodes, expected %d", len(d.Nodes()), len(nodes[1].Nodes()))
+	}
+
+	// The restored table is enough to join again without bootstrap nodes.
+	d.BootstrapNodes = nil
+	d.Start()
+	if err := d.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Ping(nodes[0].Addr()); err != nil {
+		t.Error(err)
+	}
+}
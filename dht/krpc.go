@@ -0,0 +1,110 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"github.com/yorirou/gotorrent/bencode"
+)
+
+// KRPC error codes.
+const (
+	ErrorGeneric       = 201
+	ErrorServer        = 202
+	ErrorProtocol      = 203
+	ErrorMethodUnknown = 204
+)
+
+// Error is an error message sent by a node.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("dht error %d: %s", e.Code, e.Message)
+}
+
+// message is a KRPC message: a query, a response or an error.
+type message struct {
+	T string
+	Y string
+	Q string
+	A map[string]interface{}
+	R map[string]interface{}
+	E *Error
+}
+
+// parseMessage decodes a KRPC message. The arguments and the responses are
+// left as dictionaries, as every client sends different extra keys.
+func parseMessage(b []byte) (*message, error) {
+	var v interface{}
+	if err := bencode.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+
+	d, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("the message is not a dictionary")
+	}
+
+	m := new(message)
+	m.T, _ = d["t"].(string)
+	m.Y, _ = d["y"].(string)
+
+	switch m.Y {
+	case "q":
+		m.Q, _ = d["q"].(string)
+		m.A, _ = d["a"].(map[string]interface{})
+		if m.Q == "" || m.A == nil {
+			return nil, errors.New("invalid query")
+		}
+	case "r":
+		m.R, _ = d["r"].(map[string]interface{})
+		if m.R == nil {
+			return nil, errors.New("invalid response")
+		}
+	case "e":
+		m.E = &Error{Code: ErrorGeneric}
+		if e, ok := d["e"].([]interface{}); ok && len(e) == 2 {
+			if code, ok := e[0].(int64); ok {
+				m.E.Code = int(code)
+			}
+			m.E.Message, _ = e[1].(string)
+		}
+	default:
+		return nil, errors.New("invalid message type")
+	}
+
+	return m, nil
+}
+
+func (m *message) encode() ([]byte, error) {
+	d := map[string]interface{}{
+		"t": m.T,
+		"y": m.Y,
+	}
+
+	switch m.Y {
+	case "q":
+		d["q"] = m.Q
+		d["a"] = m.A
+	case "r":
+		d["r"] = m.R
+	case "e":
+		d["e"] = []interface{}{m.E.Code, m.E.Message}
+	}
+
+	return bencode.Marshal(d)
+}
+
+func newQuery(t, method string, args map[string]interface{}) *message {
+	return &message{T: t, Y: "q", Q: method, A: args}
+}
+
+func newResponse(t string, r map[string]interface{}) *message {
+	return &message{T: t, Y: "r", R: r}
+}
+
+func newError(t string, code int, msg string) *message {
+	return &message{T: t, Y: "e", E: &Error{code, msg}}
+}
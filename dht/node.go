@@ -0,0 +1,138 @@
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"github.com/yorirou/gotorrent/tracker"
+	"net"
+	"time"
+)
+
+// IDLength is the length of the node ids and info hashes in bytes.
+const IDLength = 20
+
+type Node struct {
+	ID       string
+	Addr     *net.UDPAddr
+	LastSeen time.Time
+	failures int
+}
+
+func (n *Node) String() string {
+	return fmt.Sprintf("%x@%s", n.ID, n.Addr)
+}
+
+// RandomID generates a node id.
+func RandomID() string {
+	b := make([]byte, IDLength)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return string(b)
+}
+
+// commonPrefix returns the number of leading bits the two ids share.
+func commonPrefix(a, b string) int {
+	for i := 0; i < IDLength; i++ {
+		if x := a[i] ^ b[i]; x != 0 {
+			n := i * 8
+			for x&0x80 == 0 {
+				x <<= 1
+				n++
+			}
+			return n
+		}
+	}
+
+	return IDLength * 8
+}
+
+// closer tells whether a is closer to the target than b by the XOR metric.
+func closer(target, a, b string) bool {
+	for i := 0; i < IDLength; i++ {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			return da < db
+		}
+	}
+
+	return false
+}
+
+type byDistance struct {
+	nodes  []*Node
+	target string
+}
+
+func (s byDistance) Len() int           { return len(s.nodes) }
+func (s byDistance) Swap(i, j int)      { s.nodes[i], s.nodes[j] = s.nodes[j], s.nodes[i] }
+func (s byDistance) Less(i, j int) bool { return closer(s.target, s.nodes[i].ID, s.nodes[j].ID) }
+
+// encodeNodes writes the compact node info of the nodes of one address
+// family, the others are skipped.
+func encodeNodes(nodes []*Node, iplen int) []byte {
+	b := make([]byte, 0, len(nodes)*(IDLength+iplen+2))
+	for _, n := range nodes {
+		ip := n.Addr.IP.To4()
+		if iplen == net.IPv6len {
+			if ip != nil {
+				continue
+			}
+			ip = n.Addr.IP.To16()
+		}
+		if ip == nil {
+			continue
+		}
+
+		b = append(b, n.ID...)
+		b = append(b, ip...)
+		b = append(b, byte(n.Addr.Port>>8), byte(n.Addr.Port))
+	}
+
+	return b
+}
+
+func decodeNodes(data []byte, iplen int) []*Node {
+	size := IDLength + iplen + 2
+	nodes := make([]*Node, 0, len(data)/size)
+	for i := 0; i+size <= len(data); i += size {
+		ip := make(net.IP, iplen)
+		copy(ip, data[i+IDLength:])
+		port := int(binary.BigEndian.Uint16(data[i+IDLength+iplen:]))
+		if port == 0 {
+			continue
+		}
+
+		nodes = append(nodes, &Node{ID: string(data[i : i+IDLength]), Addr: &net.UDPAddr{IP: ip, Port: port}})
+	}
+
+	return nodes
+}
+
+// encodePeer writes the compact form of a peer address: 6 bytes for IPv4 and
+// 18 bytes for IPv6.
+func encodePeer(ip net.IP, port int) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	return string(append(append([]byte{}, ip...), byte(port>>8), byte(port)))
+}
+
+func decodePeer(s string) *tracker.Peer {
+	if len(s) != net.IPv4len+2 && len(s) != net.IPv6len+2 {
+		return nil
+	}
+
+	iplen := len(s) - 2
+	ip := make(net.IP, iplen)
+	copy(ip, s)
+	port := binary.BigEndian.Uint16([]byte(s[iplen:]))
+	if port == 0 {
+		return nil
+	}
+
+	return &tracker.Peer{IP: ip, Port: port}
+}
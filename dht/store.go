@@ -0,0 +1,83 @@
+package dht
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// maxValues is the number of peers returned for a get_peers query.
+	maxValues = 50
+	// maxInfoHashes and maxPeersPerHash limit the memory the announces of
+	// other nodes can take.
+	maxInfoHashes   = 10000
+	maxPeersPerHash = 1000
+)
+
+// peerExpiry is the time after which an announced peer is forgotten, unless
+// it announces again.
+var peerExpiry = 30 * time.Minute
+
+// store holds the peers announced to us, keyed by the info hash and the
+// compact peer address.
+type store struct {
+	hashes map[string]map[string]time.Time
+	mtx    sync.Mutex
+}
+
+func newStore() *store {
+	s := new(store)
+	s.hashes = make(map[string]map[string]time.Time)
+	return s
+}
+
+func (s *store) add(infohash, peer string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	peers, ok := s.hashes[infohash]
+	if !ok {
+		if len(s.hashes) >= maxInfoHashes {
+			return
+		}
+		peers = make(map[string]time.Time)
+		s.hashes[infohash] = peers
+	}
+
+	if _, ok := peers[peer]; !ok && len(peers) >= maxPeersPerHash {
+		return
+	}
+	peers[peer] = time.Now()
+}
+
+// get returns at most maxValues peers of the info hash.
+func (s *store) get(infohash string) []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	values := make([]string, 0)
+	for peer := range s.hashes[infohash] {
+		if len(values) == maxValues {
+			break
+		}
+		values = append(values, peer)
+	}
+
+	return values
+}
+
+func (s *store) expire(now time.Time) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for infohash, peers := range s.hashes {
+		for peer, t := range peers {
+			if now.Sub(t) > peerExpiry {
+				delete(peers, peer)
+			}
+		}
+		if len(peers) == 0 {
+			delete(s.hashes, infohash)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package dht
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// K is the size of the buckets, and the number of nodes returned by
+	// the lookups.
+	K = 8
+	// maxFailures is the number of unanswered queries after which a node
+	// can be replaced.
+	maxFailures = 2
+)
+
+// bucketRefresh is the time after which a bucket without changes is
+// refreshed with a lookup.
+var bucketRefresh = 15 * time.Minute
+
+type bucket struct {
+	// nodes are ordered by the time they were last seen, the least
+	// recently seen one is the first.
+	nodes   []*Node
+	changed time.Time
+}
+
+// table is the Kademlia routing table. The i-th bucket holds the nodes whose
+// ids share exactly i leading bits with our id.
+type table struct {
+	id      string
+	buckets []*bucket
+	mtx     sync.Mutex
+}
+
+func newTable(id string) *table {
+	t := new(table)
+	t.id = id
+	t.buckets = make([]*bucket, IDLength*8)
+	now := time.Now()
+	for i := range t.buckets {
+		t.buckets[i] = &bucket{changed: now}
+	}
+
+	return t
+}
+
+func (t *table) bucket(id string) *bucket {
+	i := commonPrefix(t.id, id)
+	if i == len(t.buckets) {
+		return nil
+	}
+
+	return t.buckets[i]
+}
+
+// insert adds a node which answered us or sent us a query. A full bucket
+// only takes new nodes in place of failing ones.
+func (t *table) insert(n *Node) bool {
+	if len(n.ID) != IDLength {
+		return false
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	b := t.bucket(n.ID)
+	if b == nil {
+		return false
+	}
+
+	for i, old := range b.nodes {
+		if old.ID == n.ID {
+			copy(b.nodes[i:], b.nodes[i+1:])
+			b.nodes[len(b.nodes)-1] = n
+			b.changed = time.Now()
+			return true
+		}
+	}
+
+	if len(b.nodes) >= K {
+		replaced := false
+		for i, old := range b.nodes {
+			if old.failures >= maxFailures {
+				copy(b.nodes[i:], b.nodes[i+1:])
+				b.nodes = b.nodes[:len(b.nodes)-1]
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			return false
+		}
+	}
+
+	b.nodes = append(b.nodes, n)
+	b.changed = time.Now()
+	return true
+}
+
+// failed records an unanswered query to the node at addr.
+func (t *table) failed(addr string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	for _, b := range t.buckets {
+		for _, n := range b.nodes {
+			if n.Addr.String() == addr {
+				n.failures++
+			}
+		}
+	}
+}
+
+// closest returns the n good nodes closest to the target.
+func (t *table) closest(target string, n int) []*Node {
+	nodes := make([]*Node, 0)
+	for _, node := range t.nodes() {
+		if node.failures < maxFailures {
+			nodes = append(nodes, node)
+		}
+	}
+
+	sort.Sort(byDistance{nodes, target})
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+
+	return nodes
+}
+
+func (t *table) nodes() []*Node {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	nodes := make([]*Node, 0)
+	for _, b := range t.buckets {
+		for _, n := range b.nodes {
+			c := *n
+			nodes = append(nodes, &c)
+		}
+	}
+
+	return nodes
+}
+
+func (t *table) len() int {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	n := 0
+	for _, b := range t.buckets {
+		n += len(b.nodes)
+	}
+
+	return n
+}
+
+// refreshTargets returns a random id in every bucket which has not changed
+// for a while. Buckets deeper than the deepest non-empty one are skipped, no
+// nodes are expected to be found there.
+func (t *table) refreshTargets(now time.Time) []string {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	deepest := -1
+	for i, b := range t.buckets {
+		if len(b.nodes) > 0 {
+			deepest = i
+		}
+	}
+
+	targets := make([]string, 0)
+	for i := 0; i <= deepest; i++ {
+		b := t.buckets[i]
+		if now.Sub(b.changed) >= bucketRefresh {
+			targets = append(targets, t.randomID(i))
+			b.changed = now
+		}
+	}
+
+	return targets
+}
+
+// randomID generates an id which falls into the i-th bucket.
+func (t *table) randomID(i int) string {
+	id := []byte(RandomID())
+	for bit := 0; bit <= i; bit++ {
+		mask := byte(0x80 >> uint(bit%8))
+		own := t.id[bit/8] & mask
+		if bit == i {
+			own ^= mask
+		}
+		id[bit/8] = id[bit/8]&^mask | own
+	}
+
+	return string(id)
+}
@@ -0,0 +1,134 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// testID returns an id which differs from the zero id in the given bit.
+func testID(bit int, last byte) string {
+	id := make([]byte, IDLength)
+	id[bit/8] |= 0x80 >> uint(bit%8)
+	id[IDLength-1] |= last
+	return string(id)
+}
+
+func testNode(id string, port int) *Node {
+	return &Node{ID: id, Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}}
+}
+
+func TestCommonPrefix(t *testing.T) {
+	zero := string(make([]byte, IDLength))
+
+	for _, bit := range []int{0, 7, 8, 100, 159} {
+		if n := commonPrefix(zero, testID(bit, 0)); n != bit {
+			t.Errorf("got common prefix %d, expected %d", n, bit)
+		}
+	}
+
+	if n := commonPrefix(zero, zero); n != IDLength*8 {
+		t.Errorf("got common prefix %d, expected %d", n, IDLength*8)
+	}
+}
+
+func TestTableInsert(t *testing.T) {
+	tb := newTable(string(make([]byte, IDLength)))
+
+	// The ids differing in the first bit fall into the same bucket.
+	for i := 0; i < K; i++ {
+		if !tb.insert(testNode(testID(0, byte(i)), 1000+i)) {
+			t.Fatalf("node %d is not inserted", i)
+		}
+	}
+
+	if tb.insert(testNode(testID(0, 0xff), 2000)) {
+		t.Error("a full bucket took a new node")
+	}
+
+	// A failing node is replaced.
+	tb.failed(testNode("", 1003).Addr.String())
+	tb.failed(testNode("", 1003).Addr.String())
+	if !tb.insert(testNode(testID(0, 0xff), 2000)) {
+		t.Error("the failing node is not replaced")
+	}
+
+	if tb.len() != K {
+		t.Errorf("got %d nodes, expected %d", tb.len(), K)
+	}
+
+	// Our own id is never inserted.
+	if tb.insert(testNode(tb.id, 3000)) {
+		t.Error("our own id is inserted")
+	}
+}
+
+func TestTableClosest(t *testing.T) {
+	tb := newTable(string(make([]byte, IDLength)))
+	for bit := 0; bit < 20; bit++ {
+		tb.insert(testNode(testID(bit, 0), 1000+bit))
+	}
+
+	target := testID(5, 1)
+	closest := tb.closest(target, 3)
+	if len(closest) != 3 {
+		t.Fatalf("got %d nodes, expected %d", len(closest), 3)
+	}
+
+	if closest[0].ID != testID(5, 0) {
+		t.Errorf("got %x as the closest node, expected %x", closest[0].ID, testID(5, 0))
+	}
+	for i := 1; i < len(closest); i++ {
+		if closer(target, closest[i].ID, closest[i-1].ID) {
+			t.Error("the nodes are not ordered by distance")
+		}
+	}
+}
+
+func TestRefreshTargets(t *testing.T) {
+	tb := newTable(RandomID())
+	tb.insert(testNode(tb.randomID(3), 1000))
+
+	if targets := tb.refreshTargets(time.Now()); len(targets) != 0 {
+		t.Errorf("got %d targets for fresh buckets, expected 0", len(targets))
+	}
+
+	targets := tb.refreshTargets(time.Now().Add(bucketRefresh))
+	if len(targets) != 4 {
+		t.Fatalf("got %d targets, expected %d", len(targets), 4)
+	}
+	for i, target := range targets {
+		if n := commonPrefix(tb.id, target); n != i {
+			t.Errorf("the refresh target of bucket %d is in bucket %d", i, n)
+		}
+	}
+}
+
+func TestTokens(t *testing.T) {
+	defer func(d time.Duration) { tokenRotation = d }(tokenRotation)
+
+	tm := newTokens()
+	ip := net.IPv4(10, 0, 0, 1)
+	token := tm.token(ip)
+
+	if !tm.valid(token, ip) {
+		t.Error("a fresh token is invalid")
+	}
+	if tm.valid(token, net.IPv4(10, 0, 0, 2)) {
+		t.Error("the token is valid from another ip")
+	}
+
+	tokenRotation = 0
+	tm.rotate(time.Now())
+	tokenRotation = time.Hour
+	if !tm.valid(token, ip) {
+		t.Error("the token is invalid after one rotation")
+	}
+
+	tokenRotation = 0
+	tm.rotate(time.Now())
+	tokenRotation = time.Hour
+	if tm.valid(token, ip) {
+		t.Error("the token is valid after two rotations")
+	}
+}
@@ -0,0 +1,72 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"sync"
+	"time"
+)
+
+// tokenRotation is the lifetime of a secret. Tokens made with the previous
+// secret are still accepted, so a token is valid for 5 to 10 minutes.
+var tokenRotation = 5 * time.Minute
+
+// tokens hands out the get_peers tokens, which have to be presented in the
+// announce_peer queries from the same ip.
+type tokens struct {
+	secret   []byte
+	previous []byte
+	rotated  time.Time
+	mtx      sync.Mutex
+}
+
+func newTokens() *tokens {
+	tm := new(tokens)
+	tm.secret = newSecret()
+	tm.previous = tm.secret
+	tm.rotated = time.Now()
+	return tm
+}
+
+func newSecret() []byte {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return b
+}
+
+func (tm *tokens) rotate(now time.Time) {
+	if now.Sub(tm.rotated) < tokenRotation {
+		return
+	}
+
+	tm.previous = tm.secret
+	tm.secret = newSecret()
+	tm.rotated = now
+}
+
+func makeToken(secret []byte, ip net.IP) string {
+	h := sha1.New()
+	h.Write(secret)
+	h.Write(ip)
+	return string(h.Sum(nil))
+}
+
+func (tm *tokens) token(ip net.IP) string {
+	tm.mtx.Lock()
+	defer tm.mtx.Unlock()
+
+	tm.rotate(time.Now())
+	return makeToken(tm.secret, ip)
+}
+
+func (tm *tokens) valid(token string, ip net.IP) bool {
+	tm.mtx.Lock()
+	defer tm.mtx.Unlock()
+
+	tm.rotate(time.Now())
+	return token == makeToken(tm.secret, ip) || token == makeToken(tm.previous, ip)
+}
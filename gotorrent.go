@@ -3,18 +3,37 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/yorirou/gotorrent/client"
 	"github.com/yorirou/gotorrent/client/config"
+	"github.com/yorirou/gotorrent/dht"
+	"github.com/yorirou/gotorrent/lsd"
+	"github.com/yorirou/gotorrent/magnet"
+	"github.com/yorirou/gotorrent/metadata"
 	"github.com/yorirou/gotorrent/metainfo"
+	"github.com/yorirou/gotorrent/storage"
 	"github.com/yorirou/gotorrent/torrent"
 	"github.com/yorirou/gotorrent/tracker"
+	"github.com/yorirou/gotorrent/tracker/server"
 	"github.com/yorirou/gotorrent/util"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strings"
 )
 
-var action = flag.String("action", "", "info, announce, download")
+var action = flag.String("action", "", "info, announce, scrape, download, verify, track")
+var output = flag.String("output", ".", "directory where the downloaded files are stored")
+var port = flag.Uint64("port", 7000, "port to listen on for incoming peer connections, or for announces with -action track")
+var seed = flag.Bool("seed", false, "keep seeding after the download is complete")
+var useDHT = flag.Bool("dht", true, "find peers through the DHT, private torrents never use it")
+var usePEX = flag.Bool("pex", true, "exchange peers with the connected peers, private torrents never use it")
+var useLSD = flag.Bool("lsd", true, "find peers on the local network, private torrents never use it")
+var encryption = flag.String("encryption", "prefer", "encryption of the peer connections: disabled, prefer or require")
+var resume = flag.String("resume", "", "resume file, defaults to <info hash>.resume in the output directory")
 
 func main() {
 	flag.Parse()
@@ -25,62 +44,409 @@ func main() {
 	// Configure the scheduler
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	actions := map[string]func([]byte){
+	actions := map[string]func(*metainfo.Metainfo){
 		"info":     info,
 		"announce": announce,
 		"download": download,
+		"verify":   verify,
+	}
+
+	// These actions take any number of torrents.
+	multiActions := map[string]func([]*metainfo.Metainfo){
+		"scrape": scrape,
+		"track":  track,
 	}
 
 	args := flag.Args()
 
+	if callback, ok := multiActions[*action]; ok {
+		if len(args) == 0 && *action == "scrape" {
+			log.Fatal("at least 1 .torrent file is required")
+		}
+
+		mis := make([]*metainfo.Metainfo, len(args))
+		for i, arg := range args {
+			mis[i] = loadMetainfo(arg)
+		}
+		callback(mis)
+		return
+	}
+
 	if len(args) != 1 {
-		log.Fatal("1 argument is allowed, which is the .torrent file")
+		log.Fatal("1 argument is allowed, which is the .torrent file or a magnet link")
+	}
+
+	callback, ok := actions[*action]
+	if !ok {
+		log.Fatal("action must be info, announce, scrape, download, verify or track")
+	}
+	callback(loadMetainfo(args[0]))
+}
+
+// loadMetainfo reads a .torrent file, or fetches the metadata of a magnet
+// link from the peers.
+func loadMetainfo(arg string) *metainfo.Metainfo {
+	if strings.HasPrefix(arg, "magnet:") {
+		return fetchMetainfo(arg)
+	}
+
+	mi, err := metainfo.NewMetainfo(readFile(arg))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return mi
+}
+
+func fetchMetainfo(uri string) *metainfo.Metainfo {
+	m, err := magnet.Parse(uri)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if m.InfoHash == "" {
+		log.Fatal("only magnet links with a v1 info hash are supported")
+	}
+
+	peerID := util.GeneratePeerID()
+	peers := make([]*tracker.Peer, 0, len(m.Peers))
+	for _, addr := range m.Peers {
+		p, err := tracker.ParsePeer(addr)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		peers = append(peers, p)
+	}
+
+	if len(m.Trackers) > 0 {
+		cfg := config.NewClientConfig()
+		cfg.PeerID = peerID
+		cfg.Port = *port
+
+		// The size is not known yet, but the trackers should not take us for
+		// a seeder.
+		r, err := tracker.NewTrackerClientCollection(m.Metainfo(), cfg).Announce(tracker.EventNone, 0, 0, 1)
+		if err != nil {
+			log.Print(err)
+		} else {
+			peers = append(peers, r.Peers...)
+		}
+	}
+
+	if len(peers) == 0 && *useDHT {
+		d := startDHT()
+		found, err := d.GetPeers(m.InfoHash)
+		stopDHT(d)
+		if err != nil {
+			log.Fatal(err)
+		}
+		peers = append(peers, found...)
+	}
+
+	info, err := metadata.Fetch(m.InfoHash, peerID, peers)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mi, err := metainfo.NewMetainfoFromInfo(info)
+	if err != nil {
+		log.Fatal(err)
+	}
+	partial := m.Metainfo()
+	mi.Announce = partial.Announce
+	mi.AnnounceList = partial.AnnounceList
+
+	return mi
+}
+
+// startDHT joins the DHT with the routing table saved in the output
+// directory.
+func startDHT() *dht.DHT {
+	d, err := dht.NewDHT(fmt.Sprintf(":%d", *port))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	table := filepath.Join(*output, "dht.table")
+	if err := d.LoadTable(table); err != nil && !os.IsNotExist(err) {
+		log.Print(err)
+	}
+
+	d.Start()
+	if err := d.Bootstrap(); err != nil {
+		log.Print("dht bootstrap failed: ", err)
+	}
+
+	return d
+}
+
+func stopDHT(d *dht.DHT) {
+	if err := d.SaveTable(filepath.Join(*output, "dht.table")); err != nil {
+		log.Print(err)
 	}
+	d.Close()
+}
 
-	file, ferr := os.Open(args[0])
+func readFile(name string) []byte {
+	file, ferr := os.Open(name)
 	if ferr != nil {
 		log.Fatal(ferr)
 	}
+	defer file.Close()
 
 	fc, ioerr := ioutil.ReadAll(file)
 	if ioerr != nil {
 		log.Fatal(ioerr)
 	}
 
-	callback, ok := actions[*action]
-	if !ok {
-		log.Fatal("action must be info or announce or download")
-	}
-	callback(fc)
+	return fc
 }
 
-func announce(torrentfile []byte) {
-	mi, err := metainfo.NewMetainfo(torrentfile)
+func announce(mi *metainfo.Metainfo) {
+	cfg := config.NewClientConfig()
+	cfg.PeerID = util.GeneratePeerID()
+	cfg.Port = *port
+
+	t := torrent.NewTorrent(mi, cfg)
+
+	tcc := tracker.NewTrackerClientCollection(mi, cfg)
+	r, err := tcc.Announce(tracker.EventNone, t.Downloaded(), t.Uploaded(), t.Left())
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if r.WarningMessage != "" {
+		fmt.Printf("Warning: %s\n", r.WarningMessage)
+	}
+	fmt.Printf("Seeders: %d\nLeechers: %d\nInterval: %d\nPeers: %v\n", r.Seeders(), r.Leechers(), r.Interval, r.Peers)
+}
+
+// scrape asks every tracker of the torrents for the swarm statistics. The
+// torrents sharing a tracker are scraped in one request.
+func scrape(mis []*metainfo.Metainfo) {
+	names := make(map[string]string)
+	hashes := make(map[string][]string)
+	urls := make([]string, 0)
+
+	for _, mi := range mis {
+		names[mi.Info.Hash] = mi.Info.Name
+
+		announces := []string{mi.Announce}
+		for _, tier := range mi.AnnounceList {
+			announces = append(announces, tier...)
+		}
+
+		for _, ann := range announces {
+			if ann == "" || contains(hashes[ann], mi.Info.Hash) {
+				continue
+			}
+			if _, ok := hashes[ann]; !ok {
+				urls = append(urls, ann)
+			}
+			hashes[ann] = append(hashes[ann], mi.Info.Hash)
+		}
+	}
+
+	for _, ann := range urls {
+		files, err := tracker.Scrape(ann, hashes[ann])
+		if err != nil {
+			fmt.Printf("%s: %s\n", ann, err)
+			continue
+		}
+
+		for _, ih := range hashes[ann] {
+			f, ok := files[ih]
+			if !ok {
+				fmt.Printf("%s: %s: not tracked\n", ann, names[ih])
+				continue
+			}
+			fmt.Printf("%s: %s: %d seeders, %d leechers, %d downloaded\n", ann, names[ih], f.Complete, f.Incomplete, f.Downloaded)
+		}
+	}
+}
+
+// track runs a tracker on the port. When .torrent files are given, only
+// those torrents are tracked.
+func track(mis []*metainfo.Metainfo) {
+	s := server.NewServer()
+
+	for _, mi := range mis {
+		s.Allow(mi.Info.Hash)
+	}
+
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), s))
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func info(mi *metainfo.Metainfo) {
+	fmt.Print(mi)
+	fmt.Println("Magnet:", magnet.FromMetainfo(mi))
+}
+
+func download(mi *metainfo.Metainfo) {
 	cfg := config.NewClientConfig()
 	cfg.PeerID = util.GeneratePeerID()
-	cfg.Port = 7000
+	cfg.Port = *port
+	cfg.IPv4, cfg.IPv6 = util.PublicAddrs()
+
+	policies := map[string]config.Encryption{
+		"disabled": config.EncryptionDisabled,
+		"prefer":   config.EncryptionPrefer,
+		"require":  config.EncryptionRequire,
+	}
+	policy, ok := policies[*encryption]
+	if !ok {
+		log.Fatal("encryption must be disabled, prefer or require")
+	}
+	cfg.Encryption = policy
+
+	s, err := storage.NewFileStorage(&mi.Info, *output)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer s.Close()
 
 	t := torrent.NewTorrent(mi, cfg)
+	t.SetStorage(s)
 
-	tcc := tracker.NewTrackerClientCollection(mi, cfg)
-	seeders, leechers, peers := tcc.RequestPeers(t.Downloaded(), t.Uploaded(), t.Left())
+	if *useDHT && !t.Private() {
+		d := startDHT()
+		defer stopDHT(d)
+		if err := t.EnableDHT(d); err != nil {
+			log.Print(err)
+		}
+	}
+	if *usePEX && !t.Private() {
+		if err := t.EnablePEX(); err != nil {
+			log.Print(err)
+		}
+	}
+	if *useLSD && !t.Private() {
+		if ld, err := lsd.NewLSD(int(*port)); err != nil {
+			log.Print("lsd is not available: ", err)
+		} else {
+			ld.Start()
+			defer ld.Close()
+			if err := t.EnableLSD(ld); err != nil {
+				log.Print(err)
+			}
+		}
+	}
 
-	fmt.Printf("Seeders: %d\nLeechers: %d\nPeers: %v\n", seeders, leechers, peers)
-}
+	resumefile := *resume
+	if resumefile == "" {
+		resumefile = filepath.Join(*output, fmt.Sprintf("%x.resume", mi.Info.Hash))
+	}
+	if err := t.LoadResume(resumefile); err != nil {
+		if !os.IsNotExist(err) {
+			log.Print(err)
+		}
+
+		// Without progress information the data might already be on the
+		// disk, e.g. copied from another machine.
+		if _, err := t.Verify(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	t.SetResumeFile(resumefile)
 
-func info(torrentfile []byte) {
-	mi, err := metainfo.NewMetainfo(torrentfile)
+	l, err := client.NewListener(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer l.Close()
+	l.AddTorrent(t)
+	go l.Serve()
 
-	fmt.Print(mi)
+	t.SetPieceFailedHandler(func(index uint32, peers []string) {
+		// Only ban when the culprit is certain.
+		if len(peers) == 1 {
+			t.Ban(peers[0])
+		}
+	})
+	// Download waits for peers until the download is done, an interrupt
+	// stops it.
+	stop := make(chan struct{})
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		close(stop)
+	}()
+
+	downloading := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+			t.Stop()
+		case <-downloading:
+		}
+	}()
+
+	err = t.Download()
+	close(downloading)
+	if err != nil {
+		if st := t.TrackerStatus(); st.Err != nil {
+			log.Print("last announce: ", st.Err)
+		}
+		t.Stop()
+		s.Close()
+		log.Fatal(err)
+	}
+
+	fmt.Printf("Downloaded %d bytes into %s\n", t.Downloaded(), *output)
+
+	if !*seed {
+		if err := t.Stop(); err != nil {
+			log.Print(err)
+		}
+		return
+	}
+
+	if err := t.Seed(stop); err != nil {
+		log.Print(err)
+	}
 }
 
-func download(torrentfile []byte) {
+func verify(mi *metainfo.Metainfo) {
+	s, err := storage.NewFileStorage(&mi.Info, *output)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer s.Close()
+
+	t := torrent.NewTorrent(mi, config.NewClientConfig())
+	t.SetStorage(s)
 
+	vr, err := t.Verify()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, f := range vr.Files {
+		fmt.Printf("%s: %s\n", f.Path, f.Status)
+	}
+	fmt.Printf("Pieces: %d complete, %d missing, %d corrupt\nLeft: %d\n",
+		vr.Count(torrent.Complete), vr.Count(torrent.Missing), vr.Count(torrent.Corrupt), t.Left())
+	if ranges := vr.Ranges(torrent.Missing); ranges != "" {
+		fmt.Println("Missing pieces:", ranges)
+	}
+	if ranges := vr.Ranges(torrent.Corrupt); ranges != "" {
+		fmt.Println("Corrupt pieces:", ranges)
+	}
+
+	if t.Left() > 0 {
+		s.Close()
+		os.Exit(1)
+	}
 }
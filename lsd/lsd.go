@@ -0,0 +1,353 @@
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/yorirou/gotorrent/tracker"
+	"log"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Local service discovery, BEP 14.
+
+// The multicast groups of the announcements.
+const (
+	Group4 = "239.192.152.143:6771"
+	Group6 = "[ff15::efc0:988f]:6771"
+)
+
+const (
+	// maxInfoHashes keeps an announcement in one unfragmented packet.
+	maxInfoHashes = 20
+	maxPacketSize = 1500
+)
+
+var (
+	announceInterval = 5 * time.Minute
+	// minAnnounceInterval prevents multicast storms when many torrents are
+	// added at once.
+	minAnnounceInterval = time.Minute
+)
+
+var ErrInvalidAnnouncement = errors.New("invalid lsd announcement")
+
+// Transport sends and receives the announcements of one multicast group.
+type Transport interface {
+	// Host is the address of the group, sent in the Host header.
+	Host() string
+	Send(b []byte) error
+	Receive(b []byte) (int, net.Addr, error)
+	Close() error
+}
+
+type multicastTransport struct {
+	host string
+	in   *net.UDPConn
+	out  *net.UDPConn
+}
+
+// NewMulticastTransport joins the multicast group. The announcements are
+// sent through a separate socket, so they are looped back to the other
+// clients of the machine.
+func NewMulticastTransport(group string) (Transport, error) {
+	addr, err := net.ResolveUDPAddr("udp", group)
+	if err != nil {
+		return nil, err
+	}
+
+	network := "udp4"
+	if addr.IP.To4() == nil {
+		network = "udp6"
+	}
+
+	in, err := net.ListenMulticastUDP(network, nil, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := net.DialUDP(network, nil, addr)
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+
+	return &multicastTransport{group, in, out}, nil
+}
+
+func (t *multicastTransport) Host() string {
+	return t.host
+}
+
+func (t *multicastTransport) Send(b []byte) error {
+	_, err := t.out.Write(b)
+	return err
+}
+
+func (t *multicastTransport) Receive(b []byte) (int, net.Addr, error) {
+	return t.in.ReadFrom(b)
+}
+
+func (t *multicastTransport) Close() error {
+	t.out.Close()
+	return t.in.Close()
+}
+
+type torrent struct {
+	peers *tracker.PeerPool
+	found chan<- struct{}
+}
+
+// LSD announces the torrents on the local network, and adds the peers
+// announcing them to their pools.
+type LSD struct {
+	port       int
+	cookie     string
+	transports []Transport
+	added      chan struct{}
+	stop       chan struct{}
+	closeOnce  sync.Once
+
+	mtx      sync.Mutex
+	torrents map[string]*torrent
+}
+
+// NewLSD joins the IPv4 and the IPv6 groups. It fails only if neither of
+// them can be joined. Port is where we accept the peer connections.
+func NewLSD(port int) (*LSD, error) {
+	transports := make([]Transport, 0, 2)
+	var err error
+	for _, group := range []string{Group4, Group6} {
+		t, terr := NewMulticastTransport(group)
+		if terr != nil {
+			err = terr
+			continue
+		}
+		transports = append(transports, t)
+	}
+
+	if len(transports) == 0 {
+		return nil, err
+	}
+
+	return NewLSDWithTransports(port, transports...), nil
+}
+
+// NewLSDWithTransports announces and listens on the given transports.
+func NewLSDWithTransports(port int, transports ...Transport) *LSD {
+	cookie := make([]byte, 8)
+	if _, err := rand.Read(cookie); err != nil {
+		log.Print(err)
+	}
+
+	l := new(LSD)
+	l.port = port
+	l.cookie = hex.EncodeToString(cookie)
+	l.transports = transports
+	l.added = make(chan struct{}, 1)
+	l.stop = make(chan struct{})
+	l.torrents = make(map[string]*torrent)
+	return l
+}
+
+// Start listens for the announcements of others, and announces our
+// torrents periodically in the background.
+func (l *LSD) Start() {
+	for _, t := range l.transports {
+		go l.serve(t)
+	}
+	go l.run(announceInterval, minAnnounceInterval)
+}
+
+func (l *LSD) Close() {
+	l.closeOnce.Do(func() {
+		close(l.stop)
+		for _, t := range l.transports {
+			t.Close()
+		}
+	})
+}
+
+// Add announces the info hash on the local network. The peers announcing it
+// are added to the pool, and found is signalled without blocking.
+func (l *LSD) Add(infohash string, peers *tracker.PeerPool, found chan<- struct{}) {
+	l.mtx.Lock()
+	l.torrents[infohash] = &torrent{peers, found}
+	l.mtx.Unlock()
+
+	select {
+	case l.added <- struct{}{}:
+	default:
+	}
+}
+
+func (l *LSD) Remove(infohash string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	delete(l.torrents, infohash)
+}
+
+func (l *LSD) infohashes() []string {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	infohashes := make([]string, 0, len(l.torrents))
+	for ih := range l.torrents {
+		infohashes = append(infohashes, ih)
+	}
+
+	return infohashes
+}
+
+func (l *LSD) run(interval, minInterval time.Duration) {
+	var last time.Time
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-l.added:
+			// New torrents are announced soon, but not sooner than the
+			// minimum interval after the last announce.
+			timer.Reset(minInterval - time.Since(last))
+			continue
+		case <-timer.C:
+		}
+
+		l.announce()
+		last = time.Now()
+		timer.Reset(interval)
+	}
+}
+
+func (l *LSD) announce() {
+	infohashes := l.infohashes()
+	for i := 0; i < len(infohashes); i += maxInfoHashes {
+		end := i + maxInfoHashes
+		if end > len(infohashes) {
+			end = len(infohashes)
+		}
+
+		for _, t := range l.transports {
+			b := encodeAnnouncement(t.Host(), l.port, infohashes[i:end], l.cookie)
+			if err := t.Send(b); err != nil {
+				log.Print("lsd announce failed: ", err)
+			}
+		}
+	}
+}
+
+func (l *LSD) serve(t Transport) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := t.Receive(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+
+		a, err := parseAnnouncement(buf[:n])
+		if err != nil || a.cookie == l.cookie {
+			continue
+		}
+
+		l.handle(a, addr)
+	}
+}
+
+func (l *LSD) handle(a *announcement, addr net.Addr) {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.IPAddr:
+		ip = addr.IP
+	default:
+		return
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	for _, ih := range a.infohashes {
+		t, ok := l.torrents[ih]
+		if !ok {
+			continue
+		}
+
+		t.peers.Add(&tracker.Peer{IP: ip, Port: a.port})
+		select {
+		case t.found <- struct{}{}:
+		default:
+		}
+	}
+}
+
+type announcement struct {
+	port       uint16
+	infohashes []string
+	cookie     string
+}
+
+func encodeAnnouncement(host string, port int, infohashes []string, cookie string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "BT-SEARCH * HTTP/1.1\r\nHost: %s\r\nPort: %d\r\n", host, port)
+	for _, ih := range infohashes {
+		fmt.Fprintf(&b, "Infohash: %x\r\n", ih)
+	}
+	if cookie != "" {
+		fmt.Fprintf(&b, "cookie: %s\r\n", cookie)
+	}
+	b.WriteString("\r\n\r\n")
+
+	return b.Bytes()
+}
+
+// parseAnnouncement decodes a BT-SEARCH message. The info hashes are
+// returned in raw form, the invalid ones are skipped.
+func parseAnnouncement(b []byte) (*announcement, error) {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(b)))
+
+	line, err := r.ReadLine()
+	if err != nil || !strings.HasPrefix(line, "BT-SEARCH * HTTP/") {
+		return nil, ErrInvalidAnnouncement
+	}
+
+	header, err := r.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return nil, ErrInvalidAnnouncement
+	}
+
+	port, err := strconv.ParseUint(header.Get("Port"), 10, 16)
+	if err != nil || port == 0 {
+		return nil, ErrInvalidAnnouncement
+	}
+
+	a := &announcement{port: uint16(port), cookie: header.Get("Cookie")}
+	for _, v := range header["Infohash"] {
+		ih, err := hex.DecodeString(strings.TrimSpace(v))
+		if err != nil || len(ih) != 20 {
+			continue
+		}
+		a.infohashes = append(a.infohashes, string(ih))
+	}
+
+	if len(a.infohashes) == 0 {
+		return nil, ErrInvalidAnnouncement
+	}
+
+	return a, nil
+}
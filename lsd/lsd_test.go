@@ -0,0 +1,167 @@
+package lsd
+
+import (
+	"errors"
+	"github.com/yorirou/gotorrent/tracker"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type packet struct {
+	data []byte
+	from net.Addr
+}
+
+// hub is a multicast group in memory, every packet is delivered to every
+// member, the sender included.
+type hub struct {
+	mtx     sync.Mutex
+	members []*hubTransport
+}
+
+type hubTransport struct {
+	hub     *hub
+	addr    *net.UDPAddr
+	packets chan packet
+	closed  chan struct{}
+}
+
+func (h *hub) join(ip string) *hubTransport {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	t := &hubTransport{h, &net.UDPAddr{IP: net.ParseIP(ip), Port: 6771}, make(chan packet, 16), make(chan struct{})}
+	h.members = append(h.members, t)
+	return t
+}
+
+func (t *hubTransport) Host() string {
+	return Group4
+}
+
+func (t *hubTransport) Send(b []byte) error {
+	t.hub.mtx.Lock()
+	defer t.hub.mtx.Unlock()
+
+	for _, m := range t.hub.members {
+		select {
+		case m.packets <- packet{append([]byte{}, b...), t.addr}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+func (t *hubTransport) Receive(b []byte) (int, net.Addr, error) {
+	select {
+	case <-t.closed:
+		return 0, nil, errors.New("closed")
+	case p := <-t.packets:
+		return copy(b, p.data), p.from, nil
+	}
+}
+
+func (t *hubTransport) Close() error {
+	close(t.closed)
+	return nil
+}
+
+func TestAnnouncement(t *testing.T) {
+	ihs := []string{"aaaaaaaaaaaaaaaaaaaa", "bbbbbbbbbbbbbbbbbbbb"}
+	b := encodeAnnouncement(Group4, 6881, ihs, "abcd")
+
+	a, err := parseAnnouncement(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.port != 6881 || a.cookie != "abcd" {
+		t.Errorf("got port %d and cookie %q, expected 6881 and abcd", a.port, a.cookie)
+	}
+	if len(a.infohashes) != 2 || a.infohashes[0] != ihs[0] || a.infohashes[1] != ihs[1] {
+		t.Errorf("got info hashes %q, expected %q", a.infohashes, ihs)
+	}
+
+	// Other clients may send lowercase headers without a cookie.
+	a, err = parseAnnouncement([]byte("BT-SEARCH * HTTP/1.1\r\nhost: 239.192.152.143:6771\r\nport: 7000\r\ninfohash: 6161616161616161616161616161616161616161\r\n\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.port != 7000 || a.cookie != "" || len(a.infohashes) != 1 {
+		t.Errorf("invalid announcement: %+v", a)
+	}
+
+	invalid := []string{
+		"",
+		"M-SEARCH * HTTP/1.1\r\nPort: 7000\r\nInfohash: 6161616161616161616161616161616161616161\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nInfohash: 6161616161616161616161616161616161616161\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 70000\r\nInfohash: 6161616161616161616161616161616161616161\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 7000\r\nInfohash: 6161\r\n\r\n",
+	}
+	for _, s := range invalid {
+		if _, err := parseAnnouncement([]byte(s)); err != ErrInvalidAnnouncement {
+			t.Errorf("got error %v for %q, expected %v", err, s, ErrInvalidAnnouncement)
+		}
+	}
+}
+
+func waitForPeer(pp *tracker.PeerPool, addr string) bool {
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, p := range pp.GetPeers() {
+			if p.Addr() == addr {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func TestLSD(t *testing.T) {
+	defer func(d time.Duration) { minAnnounceInterval = d }(minAnnounceInterval)
+	minAnnounceInterval = 0
+
+	h := new(hub)
+	l0 := NewLSDWithTransports(6881, h.join("10.0.0.1"))
+	l0.Start()
+	defer l0.Close()
+	l1 := NewLSDWithTransports(6882, h.join("10.0.0.2"))
+	l1.Start()
+	defer l1.Close()
+
+	ih := "aaaaaaaaaaaaaaaaaaaa"
+	pp0, found0 := tracker.NewPeerPool(), make(chan struct{}, 1)
+	pp1, found1 := tracker.NewPeerPool(), make(chan struct{}, 1)
+	l0.Add(ih, pp0, found0)
+	l1.Add(ih, pp1, found1)
+
+	if !waitForPeer(pp0, "10.0.0.2:6882") {
+		t.Errorf("the announcement of the other client is not received, got peers %v", pp0.GetPeers())
+	}
+	if !waitForPeer(pp1, "10.0.0.1:6881") {
+		t.Errorf("the announcement of the other client is not received, got peers %v", pp1.GetPeers())
+	}
+
+	select {
+	case <-found0:
+	default:
+		t.Error("found is not signalled")
+	}
+
+	// Our own announcements come back too, they are ignored.
+	for _, p := range pp0.GetPeers() {
+		if p.Port == 6881 {
+			t.Errorf("our own announcement is added: %v", p)
+		}
+	}
+
+	// Info hashes we do not share are ignored.
+	l1.Remove(ih)
+	l1.Add("bbbbbbbbbbbbbbbbbbbb", tracker.NewPeerPool(), make(chan struct{}, 1))
+	time.Sleep(50 * time.Millisecond)
+	if n := len(pp0.GetPeers()); n != 1 {
+		t.Errorf("got %d peers, expected 1", n)
+	}
+}
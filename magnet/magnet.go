@@ -1,15 +1,42 @@
 package magnet
 
-import "net/url"
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"github.com/yorirou/gotorrent/metainfo"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
 
 const (
+	Scheme = "magnet"
 	Prefix = "urn:btih:"
+	// PrefixV2 is the prefix of the BitTorrent v2 multihashes (BEP 52).
+	PrefixV2 = "urn:btmh:"
 )
 
+// maxSelectOnly limits the number of indices a select-only range expands to.
+const maxSelectOnly = 1 << 16
+
+var ErrNoInfoHash = errors.New("the magnet link has no info hash")
+
 type Magnet struct {
+	// InfoHash is the raw 20 byte SHA1 hash, as in metainfo.Info.Hash.
 	InfoHash string
-	Name     string
-	Tracker  string
+	// InfoHashV2 is the raw multihash of a v2 torrent.
+	InfoHashV2 string
+	Name       string
+	// Length is the exact length (xl) of the torrent, 0 if unknown.
+	Length   uint64
+	Trackers []string
+	WebSeeds []string
+	// Peers are the host:port addresses of the x.pe parameters.
+	Peers []string
+	// SelectOnly lists the indices of the files to download (BEP 53).
+	SelectOnly []int
 }
 
 func Parse(s string) (*Magnet, error) {
@@ -18,27 +45,215 @@ func Parse(s string) (*Magnet, error) {
 		return nil, err
 	}
 
+	if u.Scheme != Scheme {
+		return nil, errors.New("not a magnet link")
+	}
+
+	query := u.Query()
 	m := new(Magnet)
-	m.InfoHash = getSuffix(getOneParameter(u, "xt"), Prefix)
-	m.Name = getOneParameter(u, "dn")
-	m.Tracker = getOneParameter(u, "tr")
+
+	for _, xt := range query["xt"] {
+		switch {
+		case strings.HasPrefix(xt, Prefix):
+			m.InfoHash, err = decodeInfoHash(xt[len(Prefix):])
+		case strings.HasPrefix(xt, PrefixV2):
+			m.InfoHashV2, err = decodeMultihash(xt[len(PrefixV2):])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if m.InfoHash == "" && m.InfoHashV2 == "" {
+		return nil, ErrNoInfoHash
+	}
+
+	m.Name = query.Get("dn")
+	m.Trackers = query["tr"]
+	m.WebSeeds = query["ws"]
+
+	if xl := query.Get("xl"); xl != "" {
+		if m.Length, err = strconv.ParseUint(xl, 10, 64); err != nil {
+			return nil, errors.New("invalid exact length")
+		}
+	}
+
+	for _, pe := range query["x.pe"] {
+		if _, _, err := net.SplitHostPort(pe); err != nil {
+			return nil, err
+		}
+		m.Peers = append(m.Peers, pe)
+	}
+
+	if so := query.Get("so"); so != "" {
+		if m.SelectOnly, err = parseSelectOnly(so); err != nil {
+			return nil, err
+		}
+	}
 
 	return m, nil
 }
 
-func getSuffix(s, prefix string) string {
-	if len(s) >= len(prefix) && s[0:len(prefix)] == prefix {
-		return s[len(prefix):]
+// FromMetainfo builds the magnet link of a torrent.
+func FromMetainfo(mi *metainfo.Metainfo) *Magnet {
+	m := new(Magnet)
+	m.InfoHash = mi.Info.Hash
+	m.Name = mi.Info.Name
+	m.Length = mi.Info.TotalLength()
+
+	for _, tier := range mi.AnnounceList {
+		for _, tr := range tier {
+			m.addTracker(tr)
+		}
+	}
+	if mi.Announce != "" {
+		m.addTracker(mi.Announce)
+	}
+
+	return m
+}
+
+func (m *Magnet) addTracker(tr string) {
+	for _, t := range m.Trackers {
+		if t == tr {
+			return
+		}
+	}
+
+	m.Trackers = append(m.Trackers, tr)
+}
+
+// Metainfo returns a metainfo with the info hash and the trackers of the
+// magnet link. The rest of the info dictionary has to be fetched from the
+// peers.
+func (m *Magnet) Metainfo() *metainfo.Metainfo {
+	mi := new(metainfo.Metainfo)
+	mi.Info.Hash = m.InfoHash
+	mi.Info.Name = m.Name
+
+	if len(m.Trackers) > 0 {
+		mi.Announce = m.Trackers[0]
+	}
+	// Every tracker gets its own tier, so they are tried in order.
+	for _, tr := range m.Trackers {
+		mi.AnnounceList = append(mi.AnnounceList, []string{tr})
+	}
+
+	return mi
+}
+
+func (m *Magnet) String() string {
+	params := make([]string, 0)
+	add := func(key, value string) {
+		params = append(params, key+"="+url.QueryEscape(value))
+	}
+
+	if m.InfoHash != "" {
+		params = append(params, "xt="+Prefix+hex.EncodeToString([]byte(m.InfoHash)))
+	}
+	if m.InfoHashV2 != "" {
+		params = append(params, "xt="+PrefixV2+hex.EncodeToString([]byte(m.InfoHashV2)))
+	}
+	if m.Name != "" {
+		add("dn", m.Name)
+	}
+	if m.Length > 0 {
+		add("xl", strconv.FormatUint(m.Length, 10))
+	}
+	for _, tr := range m.Trackers {
+		add("tr", tr)
+	}
+	for _, ws := range m.WebSeeds {
+		add("ws", ws)
+	}
+	for _, pe := range m.Peers {
+		add("x.pe", pe)
+	}
+	if len(m.SelectOnly) > 0 {
+		params = append(params, "so="+formatSelectOnly(m.SelectOnly))
 	}
 
-	return ""
+	return Scheme + ":?" + strings.Join(params, "&")
 }
 
-func getOneParameter(u *url.URL, param string) string {
-	arr, ok := u.Query()[param]
-	if ok && len(arr) > 0 {
-		return arr[0]
+// decodeInfoHash accepts the hex and the base32 form of a SHA1 info hash.
+func decodeInfoHash(s string) (string, error) {
+	var b []byte
+	var err error
+
+	switch len(s) {
+	case 40:
+		b, err = hex.DecodeString(s)
+	case 32:
+		b, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return "", errors.New("invalid info hash length")
+	}
+	if err != nil {
+		return "", errors.New("invalid info hash")
+	}
+
+	return string(b), nil
+}
+
+// decodeMultihash decodes a hex multihash and checks that its length
+// matches the digest length in its header.
+func decodeMultihash(s string) (string, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) < 2 || int(b[1]) != len(b)-2 {
+		return "", errors.New("invalid multihash")
+	}
+
+	return string(b), nil
+}
+
+// parseSelectOnly parses a list of file indices and inclusive ranges, like
+// "0,2,4-6".
+func parseSelectOnly(s string) ([]int, error) {
+	indices := make([]int, 0)
+
+	for _, item := range strings.Split(s, ",") {
+		bounds := strings.SplitN(item, "-", 2)
+
+		first, err := strconv.ParseUint(bounds[0], 10, 31)
+		if err != nil {
+			return nil, errors.New("invalid select-only index")
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.ParseUint(bounds[1], 10, 31); err != nil || last < first {
+				return nil, errors.New("invalid select-only range")
+			}
+		}
+		if uint64(len(indices))+last-first >= maxSelectOnly {
+			return nil, errors.New("too many select-only indices")
+		}
+
+		for i := first; i <= last; i++ {
+			indices = append(indices, int(i))
+		}
+	}
+
+	return indices, nil
+}
+
+// formatSelectOnly writes the consecutive indices as ranges.
+func formatSelectOnly(indices []int) string {
+	items := make([]string, 0)
+
+	for i := 0; i < len(indices); {
+		j := i
+		for j+1 < len(indices) && indices[j+1] == indices[j]+1 {
+			j++
+		}
+
+		if j > i {
+			items = append(items, strconv.Itoa(indices[i])+"-"+strconv.Itoa(indices[j]))
+		} else {
+			items = append(items, strconv.Itoa(indices[i]))
+		}
+		i = j + 1
 	}
 
-	return ""
+	return strings.Join(items, ",")
 }
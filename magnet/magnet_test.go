@@ -1,6 +1,12 @@
 package magnet
 
-import "testing"
+import (
+	"github.com/yorirou/gotorrent/metainfo"
+	"reflect"
+	"testing"
+)
+
+const testHash = "\x12\x34\x56\x78\x90\x12\x34\x56\x78\x90\x12\x34\x56\x78\x90\x12\x34\x56\x78\x90"
 
 func TestBasic(t *testing.T) {
 	m, err := Parse("magnet:?xt=urn:btih:1234567890123456789012345678901234567890&dn=foo&tr=bar.baz")
@@ -8,7 +14,7 @@ func TestBasic(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if m.InfoHash != "1234567890123456789012345678901234567890" {
+	if m.InfoHash != testHash {
 		t.Error("Failed to extract infohash")
 	}
 
@@ -16,7 +22,115 @@ func TestBasic(t *testing.T) {
 		t.Error("Failed to extract name")
 	}
 
-	if m.Tracker != "bar.baz" {
+	if len(m.Trackers) != 1 || m.Trackers[0] != "bar.baz" {
 		t.Error("Failed to extract tracker")
 	}
 }
+
+func TestBase32(t *testing.T) {
+	m, err := Parse("magnet:?xt=urn:btih:CI2FM6EQCI2FM6EQCI2FM6EQCI2FM6EQ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.InfoHash != testHash {
+		t.Errorf("invalid info hash: %x", m.InfoHash)
+	}
+
+	m, err = Parse("magnet:?xt=urn:btih:ci2fm6eqci2fm6eqci2fm6eqci2fm6eq")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.InfoHash != testHash {
+		t.Errorf("invalid info hash from lowercase base32: %x", m.InfoHash)
+	}
+}
+
+func TestAllParameters(t *testing.T) {
+	m, err := Parse("magnet:?xt=urn:btih:1234567890123456789012345678901234567890" +
+		"&xt=urn:btmh:1220" + "0000000000000000000000000000000000000000000000000000000000000001" +
+		"&dn=foo+bar&xl=12345" +
+		"&tr=udp%3A%2F%2Ftracker.example.com%3A80&tr=http%3A%2F%2Ftracker.example.org%2Fannounce" +
+		"&ws=http%3A%2F%2Fseed.example.com%2Ffoo" +
+		"&x.pe=10.0.0.1:6881&x.pe=[2001:db8::1]:6882" +
+		"&so=0,2,4-6")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.InfoHashV2) != 34 || m.InfoHashV2[0] != 0x12 || m.InfoHashV2[33] != 1 {
+		t.Errorf("invalid v2 info hash: %x", m.InfoHashV2)
+	}
+	if m.Name != "foo bar" {
+		t.Errorf("got name %q, expected %q", m.Name, "foo bar")
+	}
+	if m.Length != 12345 {
+		t.Errorf("got length %d, expected %d", m.Length, 12345)
+	}
+
+	trackers := []string{"udp://tracker.example.com:80", "http://tracker.example.org/announce"}
+	if !reflect.DeepEqual(m.Trackers, trackers) {
+		t.Errorf("got trackers %v, expected %v", m.Trackers, trackers)
+	}
+	if !reflect.DeepEqual(m.WebSeeds, []string{"http://seed.example.com/foo"}) {
+		t.Errorf("invalid web seeds: %v", m.WebSeeds)
+	}
+	if !reflect.DeepEqual(m.Peers, []string{"10.0.0.1:6881", "[2001:db8::1]:6882"}) {
+		t.Errorf("invalid peers: %v", m.Peers)
+	}
+	if !reflect.DeepEqual(m.SelectOnly, []int{0, 2, 4, 5, 6}) {
+		t.Errorf("invalid select-only indices: %v", m.SelectOnly)
+	}
+
+	// The generated link is parsed into the same magnet.
+	m2, err := Parse(m.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, m2) {
+		t.Errorf("got %+v after a round trip, expected %+v", m2, m)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	links := []string{
+		"http://example.com/",
+		"magnet:?dn=foo",
+		"magnet:?xt=urn:btih:1234",
+		"magnet:?xt=urn:btih:123456789012345678901234567890123456789x",
+		"magnet:?xt=urn:btmh:1220ab",
+		"magnet:?xt=urn:btih:1234567890123456789012345678901234567890&xl=foo",
+		"magnet:?xt=urn:btih:1234567890123456789012345678901234567890&x.pe=10.0.0.1",
+		"magnet:?xt=urn:btih:1234567890123456789012345678901234567890&so=3-1",
+		"magnet:?xt=urn:btih:1234567890123456789012345678901234567890&so=0-100000000",
+	}
+
+	for _, link := range links {
+		if _, err := Parse(link); err == nil {
+			t.Errorf("expected an error for %q", link)
+		}
+	}
+}
+
+func TestFromMetainfo(t *testing.T) {
+	mi := new(metainfo.Metainfo)
+	mi.Info.Hash = testHash
+	mi.Info.Name = "foo"
+	mi.Info.Length = 100
+	mi.Announce = "http://a.example.com/announce"
+	mi.AnnounceList = [][]string{{"http://a.example.com/announce", "http://b.example.com/announce"}, {"udp://c.example.com:80"}}
+
+	m := FromMetainfo(mi)
+
+	expected := "magnet:?xt=urn:btih:1234567890123456789012345678901234567890&dn=foo&xl=100" +
+		"&tr=http%3A%2F%2Fa.example.com%2Fannounce&tr=http%3A%2F%2Fb.example.com%2Fannounce&tr=udp%3A%2F%2Fc.example.com%3A80"
+	if m.String() != expected {
+		t.Errorf("got %s, expected %s", m, expected)
+	}
+
+	partial := m.Metainfo()
+	if partial.Info.Hash != testHash || partial.Announce != "http://a.example.com/announce" || len(partial.AnnounceList) != 3 {
+		t.Errorf("invalid metainfo from the magnet link: %+v", partial)
+	}
+}
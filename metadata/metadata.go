@@ -0,0 +1,194 @@
+package metadata
+
+import (
+	"crypto/sha1"
+	"errors"
+	"github.com/yorirou/gotorrent/peer"
+	"github.com/yorirou/gotorrent/tracker"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	MaxMetadataSize = 16 * 1024 * 1024
+	MaxParallel     = 8
+)
+
+var (
+	dialTimeout  = 10 * time.Second
+	fetchTimeout = time.Minute
+)
+
+var (
+	ErrNoPeers      = errors.New("no peers")
+	ErrHashMismatch = errors.New("the metadata does not match the info hash")
+	ErrRejected     = errors.New("the peer rejected the metadata request")
+)
+
+// Fetch downloads the info dictionary of a torrent from the peers with the
+// metadata extension (BEP 9). Several peers are tried in parallel, the first
+// dictionary which matches the info hash is returned.
+func Fetch(infohash, peerID string, peers []*tracker.Peer) ([]byte, error) {
+	if len(peers) == 0 {
+		return nil, ErrNoPeers
+	}
+
+	results := make(chan []byte, len(peers))
+	errs := make(chan error, len(peers))
+	sem := make(chan struct{}, MaxParallel)
+	done := make(chan struct{})
+	defer close(done)
+
+	for _, p := range peers {
+		go func(p *tracker.Peer) {
+			select {
+			case sem <- struct{}{}:
+			case <-done:
+				errs <- ErrNoPeers
+				return
+			}
+			defer func() { <-sem }()
+
+			info, err := FetchFrom(p.Addr(), infohash, peerID)
+			if err != nil {
+				errs <- err
+				return
+			}
+			results <- info
+		}(p)
+	}
+
+	var err error
+	for i := 0; i < len(peers); i++ {
+		select {
+		case info := <-results:
+			return info, nil
+		case err = <-errs:
+		}
+	}
+
+	return nil, err
+}
+
+// FetchFrom downloads the info dictionary from one peer.
+func FetchFrom(addr, infohash, peerID string) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(fetchTimeout))
+
+	h, err := peer.DoHandshake(conn, infohash, peerID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !h.SupportsExtensions() {
+		return nil, peer.ErrExtensionNotSupported
+	}
+
+	return fetch(conn, infohash)
+}
+
+// fetch runs the metadata exchange on a connection after the handshake.
+func fetch(rw io.ReadWriter, infohash string) ([]byte, error) {
+	eh := peer.NewExtendedHandshake()
+	delete(eh.M, peer.ExtPEX)
+	m, err := eh.Message()
+	if err != nil {
+		return nil, err
+	}
+	if err := peer.WriteMessage(rw, m); err != nil {
+		return nil, err
+	}
+
+	var metadata []byte
+	var received []bool
+	remaining := 0
+
+	for {
+		m, err := peer.ReadMessage(rw, peer.DefaultMaxMessageLength)
+		if err != nil {
+			return nil, err
+		}
+
+		if m.KeepAlive || m.ID != peer.Extended {
+			continue
+		}
+
+		switch int(m.ExtendedID) {
+		case peer.ExtendedHandshakeID:
+			if metadata != nil {
+				continue
+			}
+
+			eh, err := peer.ParseExtendedHandshake(m.Payload)
+			if err != nil {
+				return nil, err
+			}
+
+			remoteID := eh.M[peer.ExtMetadata]
+			if remoteID == 0 {
+				return nil, peer.ErrExtensionNotSupported
+			}
+			if eh.MetadataSize <= 0 || eh.MetadataSize > MaxMetadataSize {
+				return nil, errors.New("invalid metadata size")
+			}
+
+			metadata = make([]byte, eh.MetadataSize)
+			remaining = (eh.MetadataSize + peer.MetadataPieceSize - 1) / peer.MetadataPieceSize
+			received = make([]bool, remaining)
+
+			for i := 0; i < remaining; i++ {
+				b, err := peer.NewMetadataRequest(i).Encode()
+				if err != nil {
+					return nil, err
+				}
+				if err := peer.WriteMessage(rw, peer.NewExtended(uint8(remoteID), b)); err != nil {
+					return nil, err
+				}
+			}
+		case peer.LocalExtensions[peer.ExtMetadata]:
+			mm, err := peer.ParseMetadataMessage(m.Payload)
+			if err != nil {
+				return nil, err
+			}
+
+			switch mm.Type {
+			case peer.MetadataReject:
+				return nil, ErrRejected
+			case peer.MetadataData:
+				if metadata == nil || mm.Piece >= len(received) || mm.TotalSize != len(metadata) {
+					return nil, errors.New("unexpected metadata piece")
+				}
+
+				begin := mm.Piece * peer.MetadataPieceSize
+				end := begin + peer.MetadataPieceSize
+				if end > len(metadata) {
+					end = len(metadata)
+				}
+				if len(mm.Data) != end-begin {
+					return nil, errors.New("invalid metadata piece length")
+				}
+
+				if !received[mm.Piece] {
+					copy(metadata[begin:end], mm.Data)
+					received[mm.Piece] = true
+					remaining--
+				}
+
+				if remaining == 0 {
+					hash := sha1.Sum(metadata)
+					if string(hash[:]) != infohash {
+						return nil, ErrHashMismatch
+					}
+
+					return metadata, nil
+				}
+			}
+		}
+	}
+}
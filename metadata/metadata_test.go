@@ -0,0 +1,127 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"github.com/yorirou/gotorrent/peer"
+	"net"
+	"testing"
+)
+
+const remoteMetadataID = 3
+
+// servePeer answers the metadata requests on conn like a seeder would. If
+// reject is set, every request is rejected.
+func servePeer(conn net.Conn, info []byte, reject bool) {
+	defer conn.Close()
+
+	eh := peer.NewExtendedHandshake()
+	eh.M[peer.ExtMetadata] = remoteMetadataID
+	eh.MetadataSize = len(info)
+	m, err := eh.Message()
+	if err != nil {
+		return
+	}
+	if err := peer.WriteMessage(conn, m); err != nil {
+		return
+	}
+
+	for {
+		m, err := peer.ReadMessage(conn, peer.DefaultMaxMessageLength)
+		if err != nil {
+			return
+		}
+		if m.ID != peer.Extended || m.ExtendedID != remoteMetadataID {
+			continue
+		}
+
+		mm, err := peer.ParseMetadataMessage(m.Payload)
+		if err != nil {
+			return
+		}
+
+		var resp *peer.MetadataMessage
+		if reject {
+			resp = peer.NewMetadataReject(mm.Piece)
+		} else {
+			begin := mm.Piece * peer.MetadataPieceSize
+			end := begin + peer.MetadataPieceSize
+			if end > len(info) {
+				end = len(info)
+			}
+			resp = peer.NewMetadataData(mm.Piece, len(info), info[begin:end])
+		}
+
+		b, err := resp.Encode()
+		if err != nil {
+			return
+		}
+		if err := peer.WriteMessage(conn, peer.NewExtended(uint8(peer.LocalExtensions[peer.ExtMetadata]), b)); err != nil {
+			return
+		}
+	}
+}
+
+// testFetch runs the exchange over TCP, as both sides write without waiting
+// for the other one to read.
+func testFetch(t *testing.T, info []byte, infohash string, reject bool) ([]byte, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		servePeer(conn, info, reject)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	return fetch(conn, infohash)
+}
+
+func TestFetch(t *testing.T) {
+	// The metadata spans three pieces, the last one is partial.
+	info := bytes.Repeat([]byte("0123456789"), 4000)
+	hash := sha1.Sum(info)
+
+	metadata, err := testFetch(t, info, string(hash[:]), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(metadata, info) {
+		t.Error("fetched metadata differs from the served one")
+	}
+}
+
+func TestFetchHashMismatch(t *testing.T) {
+	info := []byte("d4:name4:teste")
+
+	if _, err := testFetch(t, info, "01234567890123456789", false); err != ErrHashMismatch {
+		t.Errorf("got error %v, expected %v", err, ErrHashMismatch)
+	}
+}
+
+func TestFetchRejected(t *testing.T) {
+	info := []byte("d4:name4:teste")
+	hash := sha1.Sum(info)
+
+	if _, err := testFetch(t, info, string(hash[:]), true); err != ErrRejected {
+		t.Errorf("got error %v, expected %v", err, ErrRejected)
+	}
+}
+
+func TestFetchNoPeers(t *testing.T) {
+	if _, err := Fetch("01234567890123456789", "-GT0001-123456789012", nil); err != ErrNoPeers {
+		t.Errorf("got error %v, expected %v", err, ErrNoPeers)
+	}
+}
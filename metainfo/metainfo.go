@@ -1,6 +1,8 @@
 package metainfo
 
 import (
+	"bytes"
+	"crypto/sha1"
 	"encoding/base64"
 	"fmt"
 	"github.com/yorirou/gotorrent/bencode"
@@ -12,7 +14,7 @@ import (
 type Metainfo struct {
 	Info         Info
 	Announce     string
-	AnnounceList []string
+	AnnounceList [][]string
 	CreationDate uint32
 	Comment      string
 	CreatedBy    string
@@ -25,12 +27,16 @@ type Metainfo struct {
 }
 
 type Info struct {
+	// Raw is the bencoded info dictionary, as served to other peers.
+	Raw         []byte `bencode:"-"`
 	Hash        string
 	PieceLength uint64
 	Pieces      []byte
 	Private     int8
 	Length      uint64
 	Name        string
+	MD5Sum      string
+	Files       []File
 }
 
 type File struct {
@@ -45,19 +51,80 @@ func NewMetainfo(b []byte) (*Metainfo, error) {
 		return nil, err
 	}
 
+	mi.Info.Raw = []byte(mi.Info.Hash)
 	mi.Info.Hash = util.Hash(mi.Info.Hash)
 
 	return mi, nil
 }
 
+// NewMetainfoFromInfo builds a metainfo around a bencoded info dictionary,
+// e.g. one fetched from peers. The trackers are not set.
+func NewMetainfoFromInfo(info []byte) (*Metainfo, error) {
+	b := make([]byte, 0, len(info)+8)
+	b = append(b, "d4:info"...)
+	b = append(b, info...)
+	b = append(b, 'e')
+
+	return NewMetainfo(b)
+}
+
+func (i *Info) TotalLength() uint64 {
+	if len(i.Files) == 0 {
+		return i.Length
+	}
+
+	var length uint64
+	for _, f := range i.Files {
+		length += f.Length
+	}
+
+	return length
+}
+
+func (i *Info) NumPieces() uint32 {
+	return uint32(len(i.Pieces) / 20)
+}
+
+func (i *Info) PieceSize(index uint32) uint64 {
+	if index == i.NumPieces()-1 {
+		if rem := i.TotalLength() % i.PieceLength; rem != 0 {
+			return rem
+		}
+	}
+
+	return i.PieceLength
+}
+
+func (i *Info) PieceHash(index uint32) []byte {
+	return i.Pieces[index*20 : index*20+20]
+}
+
+func (i *Info) PieceHashes() [][]byte {
+	hashes := make([][]byte, i.NumPieces())
+	for index := range hashes {
+		hashes[index] = i.PieceHash(uint32(index))
+	}
+
+	return hashes
+}
+
+func (i *Info) VerifyPiece(index uint32, data []byte) bool {
+	if index >= i.NumPieces() || uint64(len(data)) != i.PieceSize(index) {
+		return false
+	}
+
+	hash := sha1.Sum(data)
+	return bytes.Equal(hash[:], i.PieceHash(index))
+}
+
 func (mi *Metainfo) String() string {
 	output := ""
 
 	output += "Info:\n\t" + strings.Replace(mi.Info.String(), "\n", "\n\t", -1) + "\n"
 	output += "Announce: " + mi.Announce + "\n"
 	output += "AnnounceList: \n"
-	for _, ali := range mi.AnnounceList {
-		output += "\t" + ali + "\n"
+	for _, tier := range mi.AnnounceList {
+		output += "\t" + strings.Join(tier, ", ") + "\n"
 	}
 	output += "CreationDate: " + time.Unix(int64(mi.CreationDate), 0).Format(time.RFC3339) + "\n"
 	output += "Comment: " + mi.Comment + "\n"
@@ -85,6 +152,12 @@ func (i *Info) String() string {
 	output += fmt.Sprintf("Private: %d\n", i.Private)
 	output += fmt.Sprintf("Length: %d\n", i.Length)
 	output += "Name: " + i.Name + "\n"
+	output += "MD5Sum: " + i.MD5Sum + "\n"
+	output += "Files: \n\t"
+	for _, f := range i.Files {
+		output += strings.Replace(f.String(), "\n", "\n\t", -1) + "\n\t"
+	}
+	output += "\n"
 
 	return output
 }
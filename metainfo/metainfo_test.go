@@ -1 +1,76 @@
 package metainfo
+
+import (
+	"crypto/sha1"
+	"testing"
+)
+
+func testInfo(pieces ...[]byte) *Info {
+	i := new(Info)
+	i.PieceLength = 4
+	for _, p := range pieces {
+		hash := sha1.Sum(p)
+		i.Pieces = append(i.Pieces, hash[:]...)
+		i.Length += uint64(len(p))
+	}
+
+	return i
+}
+
+func TestVerifyPiece(t *testing.T) {
+	i := testInfo([]byte("abcd"), []byte("ef"))
+
+	if i.NumPieces() != 2 {
+		t.Fatalf("invalid number of pieces, got %d, expected 2", i.NumPieces())
+	}
+
+	if i.PieceSize(1) != 2 {
+		t.Errorf("invalid last piece size, got %d, expected 2", i.PieceSize(1))
+	}
+
+	if !i.VerifyPiece(0, []byte("abcd")) || !i.VerifyPiece(1, []byte("ef")) {
+		t.Error("valid piece is rejected")
+	}
+
+	if i.VerifyPiece(0, []byte("abce")) || i.VerifyPiece(1, []byte("ef\\x00\\x00")) || i.VerifyPiece(2, nil) {
+		t.Error("invalid piece is accepted")
+	}
+}
+
+func TestAnnounceList(t *testing.T) {
+	data := "d8:announce5:a.com13:announce-listll5:a.com5:b.comel5:c.comee4:infod6:lengthi1e4:name1:a12:piece lengthi1e6:pieces20:aaaaaaaaaaaaaaaaaaaaee"
+
+	mi, err := NewMetainfo([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mi.AnnounceList) != 2 {
+		t.Fatalf("got %d tiers, expected %d", len(mi.AnnounceList), 2)
+	}
+	if len(mi.AnnounceList[0]) != 2 || mi.AnnounceList[0][1] != "b.com" || mi.AnnounceList[1][0] != "c.com" {
+		t.Errorf("invalid announce list: %v", mi.AnnounceList)
+	}
+}
+
+func TestNewMetainfoFromInfo(t *testing.T) {
+	info := []byte("d6:lengthi8e4:name4:test12:piece lengthi4e6:pieces0:e")
+
+	mi, err := NewMetainfoFromInfo(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(mi.Info.Raw) != string(info) {
+		t.Errorf("invalid raw info, got %q, expected %q", mi.Info.Raw, info)
+	}
+
+	hash := sha1.Sum(info)
+	if mi.Info.Hash != string(hash[:]) {
+		t.Errorf("invalid info hash, got %x, expected %x", mi.Info.Hash, hash)
+	}
+
+	if mi.Info.Name != "test" || mi.Info.Length != 8 || mi.Info.PieceLength != 4 {
+		t.Errorf("invalid info: %+v", mi.Info)
+	}
+}
@@ -0,0 +1,349 @@
+package mse
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+)
+
+// Message stream encryption, also known as protocol encryption.
+
+// The crypto methods of crypto_provide and crypto_select.
+const (
+	Plaintext uint32 = 0x01
+	RC4       uint32 = 0x02
+)
+
+const (
+	keyLength    = 96
+	maxPadLength = 512
+	// handshakeHeader starts the plaintext BitTorrent handshake.
+	handshakeHeader = "\x13BitTorrent protocol"
+)
+
+var (
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+	// privateKeyLimit keeps the private keys 160 bits long.
+	privateKeyLimit = new(big.Int).Lsh(big.NewInt(1), 160)
+	// vc is the verification constant.
+	vc = make([]byte, 8)
+)
+
+var (
+	ErrInvalidHandshake = errors.New("invalid encrypted handshake")
+	ErrUnknownSKey      = errors.New("unknown info hash in the encrypted handshake")
+	ErrNoCommonMethod   = errors.New("no common crypto method")
+)
+
+// conn encrypts and decrypts the stream of the underlying connection. The
+// prefix is read before the stream, it is already decrypted.
+type conn struct {
+	net.Conn
+	prefix []byte
+	enc    *rc4.Cipher
+	dec    *rc4.Cipher
+	mtx    sync.Mutex
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+
+	n, err := c.Conn.Read(b)
+	if c.dec != nil {
+		c.dec.XORKeyStream(b[:n], b[:n])
+	}
+
+	return n, err
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+
+	// The key stream has to be used in the order of the writes.
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	buf := make([]byte, len(b))
+	c.enc.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
+
+// Sniff reads the start of an incoming connection, and tells whether it is
+// a plaintext BitTorrent handshake. The returned connection reads the
+// sniffed bytes again.
+func Sniff(c net.Conn) (net.Conn, bool, error) {
+	b := make([]byte, len(handshakeHeader))
+	if _, err := io.ReadFull(c, b); err != nil {
+		return nil, false, err
+	}
+
+	return &conn{Conn: c, prefix: b}, string(b) == handshakeHeader, nil
+}
+
+// Initiate performs the outgoing side of the handshake. The skey is the info
+// hash of the torrent, provide are the crypto methods we accept. The
+// returned connection carries the peer wire protocol.
+func Initiate(c net.Conn, skey string, provide uint32) (net.Conn, error) {
+	x, y, err := newKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	pad, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.Write(append(y, pad...)); err != nil {
+		return nil, err
+	}
+
+	yb := make([]byte, keyLength)
+	if _, err := io.ReadFull(c, yb); err != nil {
+		return nil, err
+	}
+	s := secret(x, yb)
+	enc := newCipher(hash([]byte("keyA"), s, []byte(skey)))
+	dec := newCipher(hash([]byte("keyB"), s, []byte(skey)))
+
+	// HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S), then the
+	// encrypted VC, crypto_provide, an empty PadC and an empty IA.
+	req := hash([]byte("req1"), s)
+	req = append(req, xor(hash([]byte("req2"), []byte(skey)), hash([]byte("req3"), s))...)
+	msg := make([]byte, 16)
+	binary.BigEndian.PutUint32(msg[8:12], provide)
+	enc.XORKeyStream(msg, msg)
+	if _, err := c.Write(append(req, msg...)); err != nil {
+		return nil, err
+	}
+
+	// The answer starts after PadB, with the encrypted VC.
+	evc := make([]byte, len(vc))
+	dec.XORKeyStream(evc, vc)
+	if err := synchronize(c, evc); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(c, header); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(header, header)
+	selected := binary.BigEndian.Uint32(header[:4])
+	padLength := int(binary.BigEndian.Uint16(header[4:]))
+	if padLength > maxPadLength {
+		return nil, ErrInvalidHandshake
+	}
+
+	pad = make([]byte, padLength)
+	if _, err := io.ReadFull(c, pad); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(pad, pad)
+
+	switch {
+	case selected&provide == 0:
+		return nil, ErrNoCommonMethod
+	case selected == Plaintext:
+		return c, nil
+	case selected == RC4:
+		return &conn{Conn: c, enc: enc, dec: dec}, nil
+	}
+
+	return nil, ErrInvalidHandshake
+}
+
+// Accept performs the incoming side of the handshake. The torrent is chosen
+// from the skeys by the hash the peer sent, and returned. The crypto method
+// is RC4 if both sides allow it, plaintext otherwise.
+func Accept(c net.Conn, skeys []string, allowed uint32) (net.Conn, string, error) {
+	ya := make([]byte, keyLength)
+	if _, err := io.ReadFull(c, ya); err != nil {
+		return nil, "", err
+	}
+
+	x, y, err := newKeys()
+	if err != nil {
+		return nil, "", err
+	}
+
+	pad, err := randomPad()
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := c.Write(append(y, pad...)); err != nil {
+		return nil, "", err
+	}
+
+	// HASH('req1', S) comes after PadA.
+	s := secret(x, ya)
+	if err := synchronize(c, hash([]byte("req1"), s)); err != nil {
+		return nil, "", err
+	}
+
+	req := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(c, req); err != nil {
+		return nil, "", err
+	}
+	req = xor(req, hash([]byte("req3"), s))
+
+	skey := ""
+	for _, k := range skeys {
+		if bytes.Equal(req, hash([]byte("req2"), []byte(k))) {
+			skey = k
+			break
+		}
+	}
+	if skey == "" {
+		return nil, "", ErrUnknownSKey
+	}
+
+	dec := newCipher(hash([]byte("keyA"), s, []byte(skey)))
+	enc := newCipher(hash([]byte("keyB"), s, []byte(skey)))
+
+	header := make([]byte, 14)
+	if _, err := io.ReadFull(c, header); err != nil {
+		return nil, "", err
+	}
+	dec.XORKeyStream(header, header)
+	if !bytes.Equal(header[:8], vc) {
+		return nil, "", ErrInvalidHandshake
+	}
+	provide := binary.BigEndian.Uint32(header[8:12])
+	padLength := int(binary.BigEndian.Uint16(header[12:]))
+	if padLength > maxPadLength {
+		return nil, "", ErrInvalidHandshake
+	}
+
+	// PadC and the length of IA.
+	pad = make([]byte, padLength+2)
+	if _, err := io.ReadFull(c, pad); err != nil {
+		return nil, "", err
+	}
+	dec.XORKeyStream(pad, pad)
+
+	ia := make([]byte, binary.BigEndian.Uint16(pad[padLength:]))
+	if _, err := io.ReadFull(c, ia); err != nil {
+		return nil, "", err
+	}
+	dec.XORKeyStream(ia, ia)
+
+	var selected uint32
+	switch common := provide & allowed; {
+	case common&RC4 != 0:
+		selected = RC4
+	case common&Plaintext != 0:
+		selected = Plaintext
+	default:
+		return nil, "", ErrNoCommonMethod
+	}
+
+	// VC, crypto_select and an empty PadD.
+	msg := make([]byte, 14)
+	binary.BigEndian.PutUint32(msg[8:12], selected)
+	enc.XORKeyStream(msg, msg)
+	if _, err := c.Write(msg); err != nil {
+		return nil, "", err
+	}
+
+	if selected == Plaintext {
+		return &conn{Conn: c, prefix: ia}, skey, nil
+	}
+
+	return &conn{Conn: c, prefix: ia, enc: enc, dec: dec}, skey, nil
+}
+
+// newKeys generates a Diffie-Hellman key pair, the public key is padded to
+// keyLength bytes.
+func newKeys() (*big.Int, []byte, error) {
+	x, err := rand.Int(rand.Reader, privateKeyLimit)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return x, padKey(new(big.Int).Exp(generator, x, prime).Bytes()), nil
+}
+
+func secret(x *big.Int, y []byte) []byte {
+	return padKey(new(big.Int).Exp(new(big.Int).SetBytes(y), x, prime).Bytes())
+}
+
+func padKey(b []byte) []byte {
+	return append(make([]byte, keyLength-len(b)), b...)
+}
+
+func randomPad() ([]byte, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(maxPadLength+1))
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, n.Int64())
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+
+	return h.Sum(nil)
+}
+
+func xor(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+
+	return out
+}
+
+// newCipher returns an RC4 cipher with the first 1024 bytes of the key
+// stream discarded.
+func newCipher(key []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(key)
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+// synchronize reads the stream until the pattern, which comes after at most
+// maxPadLength bytes of padding.
+func synchronize(r io.Reader, pattern []byte) error {
+	window := make([]byte, len(pattern))
+	if _, err := io.ReadFull(r, window); err != nil {
+		return err
+	}
+
+	for i := 0; !bytes.Equal(window, pattern); i++ {
+		if i == maxPadLength {
+			return ErrInvalidHandshake
+		}
+
+		copy(window, window[1:])
+		if _, err := io.ReadFull(r, window[len(window)-1:]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
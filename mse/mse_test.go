@@ -0,0 +1,208 @@
+package mse
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// buffer is one direction of a pipe, writes do not wait for the reader.
+type buffer struct {
+	data   []byte
+	closed bool
+	mtx    sync.Mutex
+	cond   *sync.Cond
+}
+
+func newBuffer() *buffer {
+	b := new(buffer)
+	b.cond = sync.NewCond(&b.mtx)
+	return b
+}
+
+func (b *buffer) write(p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+	b.data = append(b.data, p...)
+	b.cond.Broadcast()
+	return len(p), nil
+}
+
+func (b *buffer) read(p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for len(b.data) == 0 && !b.closed {
+		b.cond.Wait()
+	}
+	if len(b.data) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, b.data)
+	b.data = b.data[n:]
+	return n, nil
+}
+
+func (b *buffer) close() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.closed = true
+	b.cond.Broadcast()
+}
+
+// pipeConn is an end of a buffered in-memory connection. The written bytes
+// are recorded.
+type pipeConn struct {
+	net.Conn
+	r, w    *buffer
+	written bytes.Buffer
+}
+
+func (c *pipeConn) Read(p []byte) (int, error) {
+	return c.r.read(p)
+}
+
+func (c *pipeConn) Write(p []byte) (int, error) {
+	c.written.Write(p)
+	return c.w.write(p)
+}
+
+func (c *pipeConn) Close() error {
+	c.r.close()
+	c.w.close()
+	return nil
+}
+
+func pipe() (*pipeConn, *pipeConn) {
+	c0, c1 := net.Pipe()
+	b0, b1 := newBuffer(), newBuffer()
+	return &pipeConn{Conn: c0, r: b0, w: b1}, &pipeConn{Conn: c1, r: b1, w: b0}
+}
+
+type accepted struct {
+	conn net.Conn
+	skey string
+	err  error
+}
+
+// handshake runs both sides of the handshake, and closes the pipe when one
+// of them fails.
+func handshake(skey string, provide uint32, skeys []string, allowed uint32) (net.Conn, *accepted, *pipeConn, error) {
+	c0, c1 := pipe()
+
+	done := make(chan *accepted, 1)
+	go func() {
+		conn, skey, err := Accept(c1, skeys, allowed)
+		if err != nil {
+			c1.Close()
+		}
+		done <- &accepted{conn, skey, err}
+	}()
+
+	conn, err := Initiate(c0, skey, provide)
+	if err != nil {
+		c0.Close()
+	}
+
+	return conn, <-done, c0, err
+}
+
+func exchange(t *testing.T, c0, c1 net.Conn) {
+	msg := []byte("\x13BitTorrent protocol and the rest of the handshake")
+	for _, pair := range [][]net.Conn{{c0, c1}, {c1, c0}} {
+		if _, err := pair[0].Write(msg); err != nil {
+			t.Fatal(err)
+		}
+
+		b := make([]byte, len(msg))
+		if _, err := io.ReadFull(pair[1], b); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, msg) {
+			t.Errorf("got %q, expected %q", b, msg)
+		}
+	}
+}
+
+func TestEncrypted(t *testing.T) {
+	ih := "aaaaaaaaaaaaaaaaaaaa"
+	conn, a, raw, err := handshake(ih, Plaintext|RC4, []string{"bbbbbbbbbbbbbbbbbbbb", ih}, Plaintext|RC4)
+	if err != nil || a.err != nil {
+		t.Fatal(err, a.err)
+	}
+	if a.skey != ih {
+		t.Errorf("got skey %x, expected %x", a.skey, ih)
+	}
+
+	exchange(t, conn, a.conn)
+
+	if bytes.Contains(raw.written.Bytes(), []byte("BitTorrent protocol")) {
+		t.Error("the stream is sent in plaintext")
+	}
+}
+
+func TestPlaintext(t *testing.T) {
+	ih := "aaaaaaaaaaaaaaaaaaaa"
+	conn, a, raw, err := handshake(ih, Plaintext|RC4, []string{ih}, Plaintext)
+	if err != nil || a.err != nil {
+		t.Fatal(err, a.err)
+	}
+
+	exchange(t, conn, a.conn)
+
+	if !bytes.Contains(raw.written.Bytes(), []byte("BitTorrent protocol")) {
+		t.Error("the stream is encrypted, expected plaintext")
+	}
+}
+
+func TestHandshakeFailures(t *testing.T) {
+	ih := "aaaaaaaaaaaaaaaaaaaa"
+
+	_, a, _, err := handshake(ih, RC4, []string{ih}, Plaintext)
+	if a.err != ErrNoCommonMethod || err == nil {
+		t.Errorf("got errors %v and %v, expected %v", err, a.err, ErrNoCommonMethod)
+	}
+
+	_, a, _, err = handshake(ih, RC4, []string{"bbbbbbbbbbbbbbbbbbbb"}, RC4)
+	if a.err != ErrUnknownSKey || err == nil {
+		t.Errorf("got errors %v and %v, expected %v", err, a.err, ErrUnknownSKey)
+	}
+}
+
+func TestSniff(t *testing.T) {
+	msg := []byte("\x13BitTorrent protocol\x00\x00\x00\x00\x00\x00\x00\x00")
+	for _, test := range []struct {
+		data      []byte
+		plaintext bool
+	}{
+		{msg, true},
+		{bytes.Repeat([]byte{0x13}, 30), false},
+	} {
+		c0, c1 := pipe()
+		c0.Write(test.data)
+
+		conn, plaintext, err := Sniff(c1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plaintext != test.plaintext {
+			t.Errorf("got plaintext %v, expected %v", plaintext, test.plaintext)
+		}
+
+		b := make([]byte, len(test.data))
+		if _, err := io.ReadFull(conn, b); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, test.data) {
+			t.Errorf("got %q after sniffing, expected %q", b, test.data)
+		}
+	}
+}
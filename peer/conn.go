@@ -0,0 +1,586 @@
+package peer
+
+import (
+	"errors"
+	"github.com/yorirou/gotorrent/util"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxRequestLength is the largest block a peer may request, larger
+	// requests close the connection.
+	MaxRequestLength = 128 * 1024
+	// MaxIncomingRequests is the length of the queue of the requests from the
+	// peer, more requests close the connection. It is sent as reqq.
+	MaxIncomingRequests   = 250
+	DefaultPipeline       = 5
+	DefaultRequestTimeout = time.Minute
+	keepAliveInterval     = 2 * time.Minute
+	idleTimeout           = 3 * time.Minute
+	writeTimeout          = time.Minute
+	tickInterval          = time.Second
+)
+
+type Block struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+}
+
+// Handler receives the events of a Conn. The methods are called from the
+// goroutines of the connection, never while the connection is locked.
+type Handler interface {
+	// PeerHave and PeerBitfield report only the pieces the peer did not
+	// have before. The added bitfield holds the new pieces of a bitfield
+	// message.
+	PeerHave(c *Conn, index uint32)
+	PeerBitfield(c *Conn, added *util.Bitfield)
+	PeerInterestChanged(c *Conn)
+	// Blocks asks for at most n blocks to request from the peer.
+	Blocks(c *Conn, n int) []Block
+	BlockReceived(c *Conn, b Block, data []byte)
+	BlockSent(c *Conn, b Block)
+	// ReadBlock returns the data requested by the peer.
+	ReadBlock(c *Conn, b Block) ([]byte, error)
+	// RequestsDropped returns requests which won't be served by the peer,
+	// because they timed out, the peer choked us or the connection closed.
+	RequestsDropped(c *Conn, blocks []Block)
+	Closed(c *Conn)
+}
+
+// ExtensionHandler is implemented by the handlers which take part in the
+// extension protocol. Extended is called for every extension message,
+// including the extended handshake.
+type ExtensionHandler interface {
+	Extended(c *Conn, id uint8, payload []byte)
+}
+
+// PortHandler is implemented by the handlers which take the DHT port of the
+// peers from the port messages.
+type PortHandler interface {
+	PeerPort(c *Conn, port uint16)
+}
+
+type request struct {
+	block Block
+	sent  time.Time
+}
+
+type Conn struct {
+	conn       net.Conn
+	handler    Handler
+	peerID     string
+	numPieces  uint32
+	pipeline   int
+	timeout    time.Duration
+	downloaded *util.Counter
+	uploaded   *util.Counter
+
+	mtx            sync.Mutex
+	fillMtx        sync.Mutex
+	amChoking      bool
+	amInterested   bool
+	peerChoking    bool
+	peerInterested bool
+	bitfield       *util.Bitfield
+	pending        []*request
+	incoming       []Block
+	lastSent       time.Time
+	extensions     *ExtendedHandshake
+
+	outgoing  chan *Message
+	serve     chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewConn(conn net.Conn, peerID string, numPieces uint32, handler Handler) *Conn {
+	c := new(Conn)
+	c.conn = conn
+	c.handler = handler
+	c.peerID = peerID
+	c.numPieces = numPieces
+	c.pipeline = DefaultPipeline
+	c.timeout = DefaultRequestTimeout
+	c.downloaded = util.NewCounter()
+	c.uploaded = util.NewCounter()
+	c.amChoking = true
+	c.peerChoking = true
+	c.bitfield = util.NewBitfield(numPieces)
+	c.lastSent = time.Now()
+	c.outgoing = make(chan *Message, 256)
+	c.serve = make(chan struct{}, 1)
+	c.closed = make(chan struct{})
+	return c
+}
+
+func (c *Conn) SetPipeline(n int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if n > 0 {
+		c.pipeline = n
+	}
+}
+
+func (c *Conn) SetRequestTimeout(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if d > 0 {
+		c.timeout = d
+	}
+}
+
+func (c *Conn) PeerID() string {
+	return c.peerID
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) Downloaded() uint64 {
+	return c.downloaded.Value()
+}
+
+func (c *Conn) Uploaded() uint64 {
+	return c.uploaded.Value()
+}
+
+func (c *Conn) Has(index uint32) bool {
+	return c.bitfield.Has(index)
+}
+
+func (c *Conn) Bitfield() *util.Bitfield {
+	return c.bitfield
+}
+
+func (c *Conn) AmChoking() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.amChoking
+}
+
+func (c *Conn) AmInterested() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.amInterested
+}
+
+func (c *Conn) PeerChoking() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.peerChoking
+}
+
+func (c *Conn) PeerInterested() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.peerInterested
+}
+
+func (c *Conn) SetChoking(choking bool) {
+	c.mtx.Lock()
+	changed := c.amChoking != choking
+	c.amChoking = choking
+	if choking {
+		// Choking discards every request of the peer.
+		c.incoming = nil
+	}
+	c.mtx.Unlock()
+
+	if !changed {
+		return
+	}
+
+	if choking {
+		c.Send(NewMessage(Choke))
+	} else {
+		c.Send(NewMessage(Unchoke))
+	}
+}
+
+func (c *Conn) SetInterested(interested bool) {
+	c.mtx.Lock()
+	changed := c.amInterested != interested
+	c.amInterested = interested
+	c.mtx.Unlock()
+
+	if !changed {
+		return
+	}
+
+	if interested {
+		c.Send(NewMessage(Interested))
+		c.fill()
+	} else {
+		c.Send(NewMessage(NotInterested))
+	}
+}
+
+func (c *Conn) Send(m *Message) {
+	select {
+	case c.outgoing <- m:
+	case <-c.closed:
+	}
+}
+
+// ExtendedHandshake returns the extended handshake of the peer, or nil if
+// it has not been received.
+func (c *Conn) ExtendedHandshake() *ExtendedHandshake {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.extensions
+}
+
+// SendExtended sends an extension message with the id the peer assigned to
+// the extension.
+func (c *Conn) SendExtended(name string, payload []byte) error {
+	eh := c.ExtendedHandshake()
+	if eh == nil || eh.M[name] == 0 {
+		return ErrExtensionNotSupported
+	}
+
+	c.Send(NewExtended(uint8(eh.M[name]), payload))
+
+	return nil
+}
+
+// Cancel withdraws a pending request, e.g. because the block arrived from
+// another peer.
+func (c *Conn) Cancel(b Block) {
+	c.mtx.Lock()
+	removed := c.removePending(b)
+	c.mtx.Unlock()
+
+	if removed {
+		c.Send(NewCancel(b.Index, b.Begin, b.Length))
+	}
+}
+
+func (c *Conn) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+// Run serves the connection until it is closed.
+func (c *Conn) Run() error {
+	go c.writeLoop()
+	go c.tickLoop()
+	go c.serveLoop()
+
+	err := c.readLoop()
+	c.Close()
+
+	c.mtx.Lock()
+	dropped := c.takePending()
+	c.mtx.Unlock()
+
+	if len(dropped) > 0 {
+		c.handler.RequestsDropped(c, dropped)
+	}
+	c.handler.Closed(c)
+
+	return err
+}
+
+func (c *Conn) readLoop() error {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		m, err := ReadMessage(c.conn, DefaultMaxMessageLength)
+		if err != nil {
+			return err
+		}
+
+		if err := c.handle(m); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Conn) handle(m *Message) error {
+	if m.KeepAlive {
+		return nil
+	}
+
+	switch m.ID {
+	case Choke:
+		c.mtx.Lock()
+		c.peerChoking = true
+		dropped := c.takePending()
+		c.mtx.Unlock()
+
+		if len(dropped) > 0 {
+			c.handler.RequestsDropped(c, dropped)
+		}
+	case Unchoke:
+		c.mtx.Lock()
+		c.peerChoking = false
+		c.mtx.Unlock()
+
+		c.fill()
+	case Interested, NotInterested:
+		c.mtx.Lock()
+		changed := c.peerInterested != (m.ID == Interested)
+		c.peerInterested = m.ID == Interested
+		c.mtx.Unlock()
+
+		if changed {
+			c.handler.PeerInterestChanged(c)
+		}
+	case Have:
+		if m.Index >= c.numPieces {
+			return errors.New("have message with invalid index")
+		}
+
+		if c.bitfield.Has(m.Index) {
+			return nil
+		}
+
+		c.bitfield.Set(m.Index)
+		c.handler.PeerHave(c, m.Index)
+		c.fill()
+	case Bitfield:
+		bf, err := util.NewBitfieldFromBytes(m.Bitfield, c.numPieces)
+		if err != nil {
+			return err
+		}
+
+		// The pieces announced by HAVE messages before are kept.
+		added := util.NewBitfield(c.numPieces)
+		for i := uint32(0); i < c.numPieces; i++ {
+			if bf.Has(i) && !c.bitfield.Has(i) {
+				c.bitfield.Set(i)
+				added.Set(i)
+			}
+		}
+
+		c.handler.PeerBitfield(c, added)
+		c.fill()
+	case Piece:
+		b := Block{m.Index, m.Begin, uint32(len(m.Block))}
+
+		c.mtx.Lock()
+		c.removePending(b)
+		c.mtx.Unlock()
+
+		c.downloaded.Add(uint64(len(m.Block)))
+		c.handler.BlockReceived(c, b, m.Block)
+		c.fill()
+	case Request:
+		if m.Length > MaxRequestLength {
+			return errors.New("requested block is too large")
+		}
+
+		c.mtx.Lock()
+		full := len(c.incoming) >= MaxIncomingRequests
+		if !c.amChoking && !full {
+			c.incoming = append(c.incoming, Block{m.Index, m.Begin, m.Length})
+		}
+		c.mtx.Unlock()
+
+		if full {
+			return errors.New("too many requests")
+		}
+
+		select {
+		case c.serve <- struct{}{}:
+		default:
+		}
+	case Cancel:
+		b := Block{m.Index, m.Begin, m.Length}
+
+		c.mtx.Lock()
+		for i, r := range c.incoming {
+			if r == b {
+				c.incoming = append(c.incoming[:i], c.incoming[i+1:]...)
+				break
+			}
+		}
+		c.mtx.Unlock()
+	case Extended:
+		if m.ExtendedID == ExtendedHandshakeID {
+			eh, err := ParseExtendedHandshake(m.Payload)
+			if err != nil {
+				return err
+			}
+
+			c.mtx.Lock()
+			c.extensions = eh
+			c.mtx.Unlock()
+		}
+
+		if eh, ok := c.handler.(ExtensionHandler); ok {
+			eh.Extended(c, m.ExtendedID, m.Payload)
+		}
+	case Port:
+		if ph, ok := c.handler.(PortHandler); ok {
+			ph.PeerPort(c, m.Port)
+		}
+	}
+
+	return nil
+}
+
+// fill tops up the request pipeline with blocks from the handler.
+func (c *Conn) fill() {
+	c.fillMtx.Lock()
+	defer c.fillMtx.Unlock()
+
+	c.mtx.Lock()
+	n := c.pipeline - len(c.pending)
+	if c.peerChoking || !c.amInterested {
+		n = 0
+	}
+	c.mtx.Unlock()
+
+	if n <= 0 {
+		return
+	}
+
+	blocks := c.handler.Blocks(c, n)
+
+	now := time.Now()
+	c.mtx.Lock()
+	for _, b := range blocks {
+		c.pending = append(c.pending, &request{b, now})
+	}
+	c.mtx.Unlock()
+
+	for _, b := range blocks {
+		c.Send(NewRequest(b.Index, b.Begin, b.Length))
+	}
+}
+
+func (c *Conn) removePending(b Block) bool {
+	for i, r := range c.pending {
+		if r.block == b {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Conn) takePending() []Block {
+	blocks := make([]Block, len(c.pending))
+	for i, r := range c.pending {
+		blocks[i] = r.block
+	}
+	c.pending = nil
+
+	return blocks
+}
+
+func (c *Conn) expirePending() []Block {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	expired := make([]Block, 0)
+	pending := c.pending[:0]
+	for _, r := range c.pending {
+		if time.Since(r.sent) > c.timeout {
+			expired = append(expired, r.block)
+		} else {
+			pending = append(pending, r)
+		}
+	}
+	c.pending = pending
+
+	return expired
+}
+
+func (c *Conn) tickLoop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+			expired := c.expirePending()
+			for _, b := range expired {
+				c.Send(NewCancel(b.Index, b.Begin, b.Length))
+			}
+			if len(expired) > 0 {
+				c.handler.RequestsDropped(c, expired)
+			}
+
+			c.fill()
+
+			c.mtx.Lock()
+			idle := time.Since(c.lastSent) > keepAliveInterval
+			c.mtx.Unlock()
+			if idle {
+				c.Send(NewKeepAlive())
+			}
+		}
+	}
+}
+
+// serveLoop answers the requests of the peer one by one, so cancels can
+// still remove the requests which are not served yet.
+func (c *Conn) serveLoop() {
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-c.serve:
+		}
+
+		for {
+			c.mtx.Lock()
+			if len(c.incoming) == 0 || c.amChoking {
+				c.mtx.Unlock()
+				break
+			}
+			b := c.incoming[0]
+			c.incoming = c.incoming[1:]
+			c.mtx.Unlock()
+
+			data, err := c.handler.ReadBlock(c, b)
+			if err != nil {
+				c.Close()
+				return
+			}
+
+			c.Send(NewPiece(b.Index, b.Begin, data))
+		}
+	}
+}
+
+func (c *Conn) writeLoop() {
+	for {
+		select {
+		case <-c.closed:
+			return
+		case m := <-c.outgoing:
+			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := WriteMessage(c.conn, m); err != nil {
+				c.Close()
+				return
+			}
+
+			c.mtx.Lock()
+			c.lastSent = time.Now()
+			c.mtx.Unlock()
+
+			if m.ID == Piece && !m.KeepAlive {
+				c.uploaded.Add(uint64(len(m.Block)))
+				c.handler.BlockSent(c, Block{m.Index, m.Begin, uint32(len(m.Block))})
+			}
+		}
+	}
+}
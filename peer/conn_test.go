@@ -0,0 +1,248 @@
+package peer
+
+import (
+	"errors"
+	"github.com/yorirou/gotorrent/util"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testHandler struct {
+	mtx      sync.Mutex
+	pool     []Block
+	received chan Block
+	dropped  chan Block
+}
+
+func newTestHandler(blocks []Block) *testHandler {
+	h := new(testHandler)
+	h.pool = blocks
+	h.received = make(chan Block, len(blocks))
+	h.dropped = make(chan Block, len(blocks))
+	return h
+}
+
+func (h *testHandler) PeerHave(c *Conn, index uint32) {
+	c.SetInterested(true)
+}
+
+func (h *testHandler) PeerBitfield(c *Conn, added *util.Bitfield) {
+	c.SetInterested(true)
+}
+
+func (h *testHandler) Blocks(c *Conn, n int) []Block {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if n > len(h.pool) {
+		n = len(h.pool)
+	}
+	blocks := h.pool[:n]
+	h.pool = h.pool[n:]
+
+	return blocks
+}
+
+func (h *testHandler) BlockReceived(c *Conn, b Block, data []byte) {
+	h.received <- b
+}
+
+func (h *testHandler) PeerInterestChanged(c *Conn) {
+	c.SetChoking(!c.PeerInterested())
+}
+
+func (h *testHandler) BlockSent(c *Conn, b Block) {
+}
+
+func (h *testHandler) ReadBlock(c *Conn, b Block) ([]byte, error) {
+	return make([]byte, b.Length), nil
+}
+
+func (h *testHandler) RequestsDropped(c *Conn, blocks []Block) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	for _, b := range blocks {
+		h.pool = append(h.pool, b)
+		h.dropped <- b
+	}
+}
+
+func (h *testHandler) Closed(c *Conn) {
+}
+
+func testBlocks(n int) []Block {
+	blocks := make([]Block, n)
+	for i := range blocks {
+		blocks[i] = Block{0, uint32(i * 16384), 16384}
+	}
+
+	return blocks
+}
+
+func readUntil(t *testing.T, conn net.Conn, id MessageID) *Message {
+	for {
+		m, err := ReadMessage(conn, DefaultMaxMessageLength)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !m.KeepAlive && m.ID == id {
+			return m
+		}
+	}
+}
+
+func TestConnPipelining(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	num, depth := 10, 3
+	h := newTestHandler(testBlocks(num))
+	c := NewConn(local, testPeerID1, 1, h)
+	c.SetPipeline(depth)
+	go c.Run()
+	defer c.Close()
+
+	go func() {
+		WriteMessage(remote, NewBitfield([]byte{0x80}))
+		WriteMessage(remote, NewMessage(Unchoke))
+	}()
+
+	outstanding := make([]*Message, 0)
+	for served := 0; served < num; {
+		m := readUntil(t, remote, Request)
+		outstanding = append(outstanding, m)
+		if len(outstanding) > depth {
+			t.Fatalf("%d requests are outstanding, pipeline depth is %d", len(outstanding), depth)
+		}
+
+		if len(outstanding) == depth || served+len(outstanding) == num {
+			reqs := outstanding
+			outstanding = make([]*Message, 0)
+			served += len(reqs)
+			go func() {
+				for _, r := range reqs {
+					WriteMessage(remote, NewPiece(r.Index, r.Begin, make([]byte, r.Length)))
+				}
+			}()
+		}
+	}
+
+	for i := 0; i < num; i++ {
+		select {
+		case <-h.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d blocks are received", i)
+		}
+	}
+
+	if c.Downloaded() != uint64(num*16384) {
+		t.Errorf("invalid downloaded value, got %d, expected %d", c.Downloaded(), num*16384)
+	}
+}
+
+func TestConnRequestTimeout(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	h := newTestHandler(testBlocks(1))
+	c := NewConn(local, testPeerID1, 1, h)
+	c.SetRequestTimeout(100 * time.Millisecond)
+	go c.Run()
+	defer c.Close()
+
+	go func() {
+		WriteMessage(remote, NewHave(0))
+		WriteMessage(remote, NewMessage(Unchoke))
+	}()
+
+	first := readUntil(t, remote, Request)
+	cancel := readUntil(t, remote, Cancel)
+	if cancel.Index != first.Index || cancel.Begin != first.Begin || cancel.Length != first.Length {
+		t.Errorf("invalid cancel, got %s, expected cancel for %s", cancel, first)
+	}
+
+	select {
+	case <-h.dropped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out request is not dropped")
+	}
+
+	second := readUntil(t, remote, Request)
+	if second.Begin != first.Begin {
+		t.Errorf("invalid re-issued request, got %s, expected %s", second, first)
+	}
+}
+
+func TestConnServeRequests(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	c := NewConn(local, testPeerID1, 1, newTestHandler(nil))
+	go c.Run()
+	defer c.Close()
+
+	go WriteMessage(remote, NewMessage(Interested))
+	readUntil(t, remote, Unchoke)
+
+	go WriteMessage(remote, NewRequest(0, 0, 16384))
+	m := readUntil(t, remote, Piece)
+	if m.Index != 0 || m.Begin != 0 || len(m.Block) != 16384 {
+		t.Errorf("invalid piece message: %s", m)
+	}
+
+	go WriteMessage(remote, NewRequest(0, 0, MaxRequestLength+1))
+	for {
+		if _, err := ReadMessage(remote, DefaultMaxMessageLength); err != nil {
+			break
+		}
+	}
+}
+
+// blockingHandler does not answer the requests until it is released.
+type blockingHandler struct {
+	*testHandler
+	release chan struct{}
+}
+
+func (h *blockingHandler) ReadBlock(c *Conn, b Block) ([]byte, error) {
+	<-h.release
+	return nil, errors.New("released")
+}
+
+func TestConnRequestQueueLimit(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	h := &blockingHandler{newTestHandler(nil), make(chan struct{})}
+	defer close(h.release)
+	c := NewConn(local, testPeerID1, 1, h)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Run()
+	}()
+	defer c.Close()
+
+	go WriteMessage(remote, NewMessage(Interested))
+	readUntil(t, remote, Unchoke)
+
+	// The first request is being served, the rest stay in the queue.
+	go func() {
+		for i := 0; i < MaxIncomingRequests+2; i++ {
+			if err := WriteMessage(remote, NewRequest(0, 0, 16384)); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("the connection is closed without an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the connection is kept open with too many requests")
+	}
+}
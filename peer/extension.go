@@ -0,0 +1,87 @@
+package peer
+
+import (
+	"errors"
+	"github.com/yorirou/gotorrent/bencode"
+)
+
+// Extension protocol, BEP 10.
+
+const (
+	ExtendedHandshakeID = 0
+
+	ExtMetadata = "ut_metadata"
+	ExtPEX      = "ut_pex"
+)
+
+// LocalExtensions are the ids of the extension messages we accept.
+var LocalExtensions = map[string]int{
+	ExtMetadata: 1,
+	ExtPEX:      2,
+}
+
+var ErrExtensionNotSupported = errors.New("the peer does not support the extension")
+
+type ExtendedHandshake struct {
+	M            map[string]int `bencode:"m"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+	Port         uint16         `bencode:"p,omitempty"`
+	Version      string         `bencode:"v,omitempty"`
+	Reqq         int            `bencode:"reqq,omitempty"`
+}
+
+func NewExtendedHandshake() *ExtendedHandshake {
+	eh := new(ExtendedHandshake)
+	eh.M = make(map[string]int)
+	for name, id := range LocalExtensions {
+		eh.M[name] = id
+	}
+	eh.Version = "GoTorrent"
+	eh.Reqq = MaxIncomingRequests
+	return eh
+}
+
+// ParseExtendedHandshake decodes an extended handshake. Unknown keys are
+// ignored, as every client sends a different set of them.
+func ParseExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+	var v interface{}
+	if err := bencode.Unmarshal(payload, &v); err != nil {
+		return nil, err
+	}
+
+	d, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("the extended handshake is not a dictionary")
+	}
+
+	eh := new(ExtendedHandshake)
+	eh.M = make(map[string]int)
+	if m, ok := d["m"].(map[string]interface{}); ok {
+		for name, id := range m {
+			if n, ok := id.(int64); ok && n > 0 && n < 256 {
+				eh.M[name] = int(n)
+			}
+		}
+	}
+	if n, ok := d["metadata_size"].(int64); ok && n > 0 {
+		eh.MetadataSize = int(n)
+	}
+	if n, ok := d["p"].(int64); ok && n > 0 && n < 65536 {
+		eh.Port = uint16(n)
+	}
+	if n, ok := d["reqq"].(int64); ok && n > 0 {
+		eh.Reqq = int(n)
+	}
+	eh.Version, _ = d["v"].(string)
+
+	return eh, nil
+}
+
+func (eh *ExtendedHandshake) Message() (*Message, error) {
+	b, err := bencode.Marshal(eh)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewExtended(ExtendedHandshakeID, b), nil
+}
@@ -0,0 +1,86 @@
+package peer
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseExtendedHandshake(t *testing.T) {
+	payload := []byte("d1:md11:ut_metadatai3e6:ut_pexi1ee13:metadata_sizei31235e1:pi6881e4:reqqi250e1:v9:Foo 1.2.36:yourip4:\x7f\x00\x00\x01e")
+
+	eh, err := ParseExtendedHandshake(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if eh.M[ExtMetadata] != 3 || eh.M["ut_pex"] != 1 {
+		t.Errorf("invalid extensions: %v", eh.M)
+	}
+	if eh.MetadataSize != 31235 {
+		t.Errorf("got metadata size %d, expected %d", eh.MetadataSize, 31235)
+	}
+	if eh.Port != 6881 {
+		t.Errorf("got port %d, expected %d", eh.Port, 6881)
+	}
+	if eh.Reqq != 250 || eh.Version != "Foo 1.2.3" {
+		t.Errorf("invalid handshake: %+v", eh)
+	}
+
+	if _, err := ParseExtendedHandshake([]byte("li1ee")); err == nil {
+		t.Error("expected an error for a list")
+	}
+}
+
+func TestExtendedHandshakeRoundTrip(t *testing.T) {
+	eh := NewExtendedHandshake()
+	eh.MetadataSize = 1234
+	eh.Port = 7000
+
+	m, err := eh.Message()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != Extended || m.ExtendedID != ExtendedHandshakeID {
+		t.Fatalf("invalid message %s", m)
+	}
+
+	decoded, err := ParseExtendedHandshake(m.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.M[ExtMetadata] != LocalExtensions[ExtMetadata] || decoded.MetadataSize != 1234 || decoded.Port != 7000 {
+		t.Errorf("invalid handshake after round trip: %+v", decoded)
+	}
+}
+
+func TestMetadataMessage(t *testing.T) {
+	b, err := NewMetadataData(1, 20000, []byte("data")).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "d8:msg_typei1e5:piecei1e10:total_sizei20000eedata"
+	if string(b) != expected {
+		t.Errorf("got %q, expected %q", b, expected)
+	}
+
+	mm, err := ParseMetadataMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mm.Type != MetadataData || mm.Piece != 1 || mm.TotalSize != 20000 || !bytes.Equal(mm.Data, []byte("data")) {
+		t.Errorf("invalid message after round trip: %+v", mm)
+	}
+
+	b, err = NewMetadataRequest(2).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "d8:msg_typei0e5:piecei2ee" {
+		t.Errorf("got %q, expected a request for piece 2", b)
+	}
+
+	if _, err := ParseMetadataMessage([]byte("d5:piecei1ee")); err == nil {
+		t.Error("expected an error without a message type")
+	}
+}
@@ -0,0 +1,112 @@
+package peer
+
+import (
+	"errors"
+	"io"
+)
+
+const (
+	Protocol = "BitTorrent protocol"
+)
+
+var ErrInfoHashMismatch = errors.New("info hash mismatch")
+
+type Handshake struct {
+	Reserved [8]byte
+	InfoHash string
+	PeerID   string
+}
+
+// NewHandshake returns a handshake which advertises the extension
+// protocol.
+func NewHandshake(infohash, peerid string) *Handshake {
+	h := new(Handshake)
+	h.InfoHash = infohash
+	h.PeerID = peerid
+	h.SetExtensions()
+	return h
+}
+
+// SetExtensions sets the reserved bit of the extension protocol (BEP 10).
+func (h *Handshake) SetExtensions() {
+	h.Reserved[5] |= 0x10
+}
+
+func (h *Handshake) SupportsExtensions() bool {
+	return h.Reserved[5]&0x10 != 0
+}
+
+// SetDHT sets the reserved bit of the DHT (BEP 5), the peer can expect a
+// port message after the handshake.
+func (h *Handshake) SetDHT() {
+	h.Reserved[7] |= 0x01
+}
+
+func (h *Handshake) SupportsDHT() bool {
+	return h.Reserved[7]&0x01 != 0
+}
+
+func WriteHandshake(w io.Writer, h *Handshake) error {
+	if len(h.InfoHash) != 20 || len(h.PeerID) != 20 {
+		return errors.New("info hash and peer id must be 20 bytes long")
+	}
+
+	buf := make([]byte, 0, 49+len(Protocol))
+	buf = append(buf, byte(len(Protocol)))
+	buf = append(buf, Protocol...)
+	buf = append(buf, h.Reserved[:]...)
+	buf = append(buf, h.InfoHash...)
+	buf = append(buf, h.PeerID...)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+func ReadHandshake(r io.Reader) (*Handshake, error) {
+	pstrlen := make([]byte, 1)
+	if _, err := io.ReadFull(r, pstrlen); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, int(pstrlen[0])+48)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	if string(buf[:pstrlen[0]]) != Protocol {
+		return nil, errors.New("unknown protocol: " + string(buf[:pstrlen[0]]))
+	}
+	buf = buf[pstrlen[0]:]
+
+	h := new(Handshake)
+	copy(h.Reserved[:], buf[0:8])
+	h.InfoHash = string(buf[8:28])
+	h.PeerID = string(buf[28:48])
+
+	return h, nil
+}
+
+// DoHandshake performs the outgoing side of the handshake and returns the
+// handshake of the remote peer.
+func DoHandshake(rw io.ReadWriter, infohash, peerid string) (*Handshake, error) {
+	return DoHandshakeWith(rw, NewHandshake(infohash, peerid))
+}
+
+// DoHandshakeWith is DoHandshake with our own handshake, so the reserved
+// bits can be set.
+func DoHandshakeWith(rw io.ReadWriter, ours *Handshake) (*Handshake, error) {
+	if err := WriteHandshake(rw, ours); err != nil {
+		return nil, err
+	}
+
+	h, err := ReadHandshake(rw)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.InfoHash != ours.InfoHash {
+		return nil, ErrInfoHashMismatch
+	}
+
+	return h, nil
+}
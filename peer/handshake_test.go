@@ -0,0 +1,86 @@
+package peer
+
+import (
+	"net"
+	"testing"
+)
+
+const (
+	testInfoHash = "12345678901234567890"
+	testPeerID0  = "-GT0000-000000000000"
+	testPeerID1  = "-GT0000-111111111111"
+)
+
+func TestHandshake(t *testing.T) {
+	c0, c1 := net.Pipe()
+	defer c0.Close()
+	defer c1.Close()
+
+	go func() {
+		h, err := ReadHandshake(c1)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if h.PeerID != testPeerID0 {
+			t.Errorf("invalid peer id, got %s, expected %s", h.PeerID, testPeerID0)
+		}
+		WriteHandshake(c1, NewHandshake(h.InfoHash, testPeerID1))
+	}()
+
+	h, err := DoHandshake(c0, testInfoHash, testPeerID0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.PeerID != testPeerID1 {
+		t.Errorf("invalid peer id, got %s, expected %s", h.PeerID, testPeerID1)
+	}
+}
+
+func TestHandshakeInfoHashMismatch(t *testing.T) {
+	c0, c1 := net.Pipe()
+	defer c0.Close()
+	defer c1.Close()
+
+	go func() {
+		if _, err := ReadHandshake(c1); err != nil {
+			t.Error(err)
+			return
+		}
+		WriteHandshake(c1, NewHandshake("09876543210987654321", testPeerID1))
+	}()
+
+	if _, err := DoHandshake(c0, testInfoHash, testPeerID0); err != ErrInfoHashMismatch {
+		t.Errorf("expected info hash mismatch, got %v", err)
+	}
+}
+
+func TestHandshakeReservedBits(t *testing.T) {
+	c0, c1 := net.Pipe()
+	defer c0.Close()
+	defer c1.Close()
+
+	go func() {
+		h, err := ReadHandshake(c1)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if !h.SupportsDHT() || !h.SupportsExtensions() {
+			t.Errorf("invalid reserved bits: %x", h.Reserved)
+		}
+		WriteHandshake(c1, NewHandshake(h.InfoHash, testPeerID1))
+	}()
+
+	ours := NewHandshake(testInfoHash, testPeerID0)
+	ours.SetDHT()
+	h, err := DoHandshakeWith(c0, ours)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.SupportsDHT() {
+		t.Error("the remote handshake advertises the DHT")
+	}
+}
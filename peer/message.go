@@ -0,0 +1,271 @@
+package peer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type MessageID uint8
+
+const (
+	Choke MessageID = iota
+	Unchoke
+	Interested
+	NotInterested
+	Have
+	Bitfield
+	Request
+	Piece
+	Cancel
+	Port
+	Extended MessageID = 20
+)
+
+const (
+	DefaultMaxMessageLength = 256 * 1024
+)
+
+var ErrMessageTooLong = errors.New("message exceeds the maximum length")
+
+func (id MessageID) String() string {
+	if id == Extended {
+		return "extended"
+	}
+
+	names := []string{"choke", "unchoke", "interested", "not interested", "have", "bitfield", "request", "piece", "cancel", "port"}
+	if int(id) < len(names) {
+		return names[id]
+	}
+
+	return fmt.Sprintf("unknown(%d)", uint8(id))
+}
+
+type Message struct {
+	KeepAlive bool
+	ID        MessageID
+	Index     uint32
+	Begin     uint32
+	Length    uint32
+	Bitfield  []byte
+	Block     []byte
+	Port      uint16
+	// ExtendedID is the id of an extension message, 0 is the extended
+	// handshake.
+	ExtendedID uint8
+	// Payload holds the raw payload of extension messages and of messages
+	// which are not part of the core protocol.
+	Payload []byte
+}
+
+func NewKeepAlive() *Message {
+	m := new(Message)
+	m.KeepAlive = true
+	return m
+}
+
+func NewMessage(id MessageID) *Message {
+	m := new(Message)
+	m.ID = id
+	return m
+}
+
+func NewHave(index uint32) *Message {
+	m := NewMessage(Have)
+	m.Index = index
+	return m
+}
+
+func NewBitfield(bitfield []byte) *Message {
+	m := NewMessage(Bitfield)
+	m.Bitfield = bitfield
+	return m
+}
+
+func NewRequest(index, begin, length uint32) *Message {
+	m := NewMessage(Request)
+	m.Index = index
+	m.Begin = begin
+	m.Length = length
+	return m
+}
+
+func NewPiece(index, begin uint32, block []byte) *Message {
+	m := NewMessage(Piece)
+	m.Index = index
+	m.Begin = begin
+	m.Block = block
+	return m
+}
+
+func NewCancel(index, begin, length uint32) *Message {
+	m := NewRequest(index, begin, length)
+	m.ID = Cancel
+	return m
+}
+
+func NewExtended(id uint8, payload []byte) *Message {
+	m := NewMessage(Extended)
+	m.ExtendedID = id
+	m.Payload = payload
+	return m
+}
+
+func NewPort(port uint16) *Message {
+	m := NewMessage(Port)
+	m.Port = port
+	return m
+}
+
+func (m *Message) String() string {
+	if m.KeepAlive {
+		return "keep-alive"
+	}
+
+	switch m.ID {
+	case Have:
+		return fmt.Sprintf("have %d", m.Index)
+	case Request, Cancel:
+		return fmt.Sprintf("%s %d %d %d", m.ID, m.Index, m.Begin, m.Length)
+	case Piece:
+		return fmt.Sprintf("piece %d %d (%d bytes)", m.Index, m.Begin, len(m.Block))
+	case Port:
+		return fmt.Sprintf("port %d", m.Port)
+	case Extended:
+		return fmt.Sprintf("extended %d (%d bytes)", m.ExtendedID, len(m.Payload))
+	}
+
+	return m.ID.String()
+}
+
+func (m *Message) payload() []byte {
+	switch m.ID {
+	case Choke, Unchoke, Interested, NotInterested:
+		return nil
+	case Have:
+		p := make([]byte, 4)
+		binary.BigEndian.PutUint32(p, m.Index)
+		return p
+	case Bitfield:
+		return m.Bitfield
+	case Request, Cancel:
+		p := make([]byte, 12)
+		binary.BigEndian.PutUint32(p[0:4], m.Index)
+		binary.BigEndian.PutUint32(p[4:8], m.Begin)
+		binary.BigEndian.PutUint32(p[8:12], m.Length)
+		return p
+	case Piece:
+		p := make([]byte, 8+len(m.Block))
+		binary.BigEndian.PutUint32(p[0:4], m.Index)
+		binary.BigEndian.PutUint32(p[4:8], m.Begin)
+		copy(p[8:], m.Block)
+		return p
+	case Port:
+		p := make([]byte, 2)
+		binary.BigEndian.PutUint16(p, m.Port)
+		return p
+	case Extended:
+		return append([]byte{m.ExtendedID}, m.Payload...)
+	}
+
+	return m.Payload
+}
+
+func (m *Message) decode(payload []byte) error {
+	expected := -1
+	switch m.ID {
+	case Choke, Unchoke, Interested, NotInterested:
+		expected = 0
+	case Have:
+		expected = 4
+	case Request, Cancel:
+		expected = 12
+	case Port:
+		expected = 2
+	case Piece:
+		if len(payload) < 8 {
+			return fmt.Errorf("%s message is too short: %d bytes", m.ID, len(payload))
+		}
+	case Extended:
+		if len(payload) < 1 {
+			return fmt.Errorf("%s message is too short: %d bytes", m.ID, len(payload))
+		}
+	}
+
+	if expected >= 0 && len(payload) != expected {
+		return fmt.Errorf("invalid %s message length: %d bytes", m.ID, len(payload))
+	}
+
+	switch m.ID {
+	case Have:
+		m.Index = binary.BigEndian.Uint32(payload)
+	case Bitfield:
+		m.Bitfield = payload
+	case Request, Cancel:
+		m.Index = binary.BigEndian.Uint32(payload[0:4])
+		m.Begin = binary.BigEndian.Uint32(payload[4:8])
+		m.Length = binary.BigEndian.Uint32(payload[8:12])
+	case Piece:
+		m.Index = binary.BigEndian.Uint32(payload[0:4])
+		m.Begin = binary.BigEndian.Uint32(payload[4:8])
+		m.Block = payload[8:]
+	case Port:
+		m.Port = binary.BigEndian.Uint16(payload)
+	case Extended:
+		m.ExtendedID = payload[0]
+		m.Payload = payload[1:]
+	default:
+		if expected < 0 {
+			m.Payload = payload
+		}
+	}
+
+	return nil
+}
+
+// ReadMessage reads a length-prefixed message from r. Messages longer than
+// maxLength are rejected without reading their payload.
+func ReadMessage(r io.Reader, maxLength uint32) (*Message, error) {
+	lenbuf := make([]byte, 4)
+	if _, err := io.ReadFull(r, lenbuf); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(lenbuf)
+	if length == 0 {
+		return NewKeepAlive(), nil
+	}
+
+	if length > maxLength {
+		return nil, ErrMessageTooLong
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	m := NewMessage(MessageID(buf[0]))
+	if err := m.decode(buf[1:]); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func WriteMessage(w io.Writer, m *Message) error {
+	if m.KeepAlive {
+		_, err := w.Write(make([]byte, 4))
+		return err
+	}
+
+	payload := m.payload()
+	buf := make([]byte, 5+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(1+len(payload)))
+	buf[4] = byte(m.ID)
+	copy(buf[5:], payload)
+
+	_, err := w.Write(buf)
+	return err
+}
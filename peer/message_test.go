@@ -0,0 +1,67 @@
+package peer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	messages := []*Message{
+		NewKeepAlive(),
+		NewMessage(Choke),
+		NewMessage(Unchoke),
+		NewMessage(Interested),
+		NewMessage(NotInterested),
+		NewHave(42),
+		NewBitfield([]byte{0xff, 0x80}),
+		NewRequest(1, 16384, 16384),
+		NewPiece(1, 16384, []byte("block")),
+		NewCancel(1, 16384, 16384),
+		NewPort(6881),
+		NewExtended(1, []byte("d1:ai1ee")),
+	}
+
+	c0, c1 := net.Pipe()
+	defer c0.Close()
+	defer c1.Close()
+
+	go func() {
+		for _, m := range messages {
+			if err := WriteMessage(c0, m); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for _, expected := range messages {
+		m, err := ReadMessage(c1, DefaultMaxMessageLength)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(m, expected) {
+			t.Errorf("invalid message, got %s, expected %s", m, expected)
+		}
+	}
+}
+
+func TestMessageTooLong(t *testing.T) {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, 1024)
+
+	if _, err := ReadMessage(bytes.NewReader(buf), 1023); err != ErrMessageTooLong {
+		t.Errorf("expected too long message error, got %v", err)
+	}
+}
+
+func TestInvalidMessageLength(t *testing.T) {
+	buf := []byte{0, 0, 0, 3, byte(Have), 0, 1}
+
+	if _, err := ReadMessage(bytes.NewReader(buf), DefaultMaxMessageLength); err == nil {
+		t.Error("short have message is accepted")
+	}
+}
@@ -0,0 +1,76 @@
+package peer
+
+import (
+	"errors"
+	"github.com/yorirou/gotorrent/bencode"
+)
+
+// Metadata exchange, BEP 9.
+
+const (
+	MetadataPieceSize = 16 * 1024
+
+	MetadataRequest = 0
+	MetadataData    = 1
+	MetadataReject  = 2
+)
+
+type MetadataMessage struct {
+	Type      int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+	// Data follows the dictionary in data messages.
+	Data []byte `bencode:"-"`
+}
+
+func NewMetadataRequest(piece int) *MetadataMessage {
+	return &MetadataMessage{Type: MetadataRequest, Piece: piece}
+}
+
+func NewMetadataData(piece, totalSize int, data []byte) *MetadataMessage {
+	return &MetadataMessage{Type: MetadataData, Piece: piece, TotalSize: totalSize, Data: data}
+}
+
+func NewMetadataReject(piece int) *MetadataMessage {
+	return &MetadataMessage{Type: MetadataReject, Piece: piece}
+}
+
+func ParseMetadataMessage(payload []byte) (*MetadataMessage, error) {
+	var v interface{}
+	n, err := bencode.UnmarshalPrefix(payload, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	d, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("the metadata message is not a dictionary")
+	}
+
+	msgType, ok1 := d["msg_type"].(int64)
+	piece, ok2 := d["piece"].(int64)
+	if !ok1 || !ok2 || piece < 0 {
+		return nil, errors.New("invalid metadata message")
+	}
+
+	mm := new(MetadataMessage)
+	mm.Type = int(msgType)
+	mm.Piece = int(piece)
+	if size, ok := d["total_size"].(int64); ok {
+		mm.TotalSize = int(size)
+	}
+	if mm.Type == MetadataData {
+		mm.Data = payload[n:]
+	}
+
+	return mm, nil
+}
+
+func (mm *MetadataMessage) Encode() ([]byte, error) {
+	b, err := bencode.Marshal(mm)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(b, mm.Data...), nil
+}
@@ -0,0 +1,128 @@
+package peer
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/yorirou/gotorrent/bencode"
+	"net"
+	"strconv"
+)
+
+// Peer exchange, BEP 11.
+
+// Flags of the added peers.
+const (
+	PEXEncryption = 0x01
+	PEXSeed       = 0x02
+	PEXUTP        = 0x04
+	PEXHolepunch  = 0x08
+	// PEXOutgoing marks the peers we connected to, so they are reachable.
+	PEXOutgoing = 0x10
+)
+
+type PEXPeer struct {
+	IP    net.IP
+	Port  uint16
+	Flags byte
+}
+
+func (p PEXPeer) Addr() string {
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
+}
+
+type PEXMessage struct {
+	Added   []PEXPeer
+	Dropped []PEXPeer
+}
+
+// ParsePEXMessage decodes a ut_pex message. The IPv4 and the IPv6 peers are
+// merged, peers without flags get 0.
+func ParsePEXMessage(payload []byte) (*PEXMessage, error) {
+	var v interface{}
+	if err := bencode.Unmarshal(payload, &v); err != nil {
+		return nil, err
+	}
+
+	d, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("the pex message is not a dictionary")
+	}
+
+	pm := new(PEXMessage)
+	for _, family := range []struct {
+		suffix string
+		iplen  int
+	}{{"", net.IPv4len}, {"6", net.IPv6len}} {
+		added, _ := d["added"+family.suffix].(string)
+		flags, _ := d["added"+family.suffix+".f"].(string)
+		dropped, _ := d["dropped"+family.suffix].(string)
+
+		pm.Added = append(pm.Added, decodePEXPeers(added, flags, family.iplen)...)
+		pm.Dropped = append(pm.Dropped, decodePEXPeers(dropped, "", family.iplen)...)
+	}
+
+	return pm, nil
+}
+
+func decodePEXPeers(data, flags string, iplen int) []PEXPeer {
+	size := iplen + 2
+	peers := make([]PEXPeer, 0, len(data)/size)
+	for i := 0; i+size <= len(data); i += size {
+		p := PEXPeer{IP: make(net.IP, iplen)}
+		copy(p.IP, data[i:])
+		p.Port = binary.BigEndian.Uint16([]byte(data[i+iplen : i+size]))
+		if n := i / size; n < len(flags) {
+			p.Flags = flags[n]
+		}
+		if p.Port == 0 {
+			continue
+		}
+
+		peers = append(peers, p)
+	}
+
+	return peers
+}
+
+func (pm *PEXMessage) Encode() ([]byte, error) {
+	d := make(map[string]interface{})
+
+	for _, family := range []struct {
+		suffix string
+		iplen  int
+	}{{"", net.IPv4len}, {"6", net.IPv6len}} {
+		added, flags := encodePEXPeers(pm.Added, family.iplen)
+		dropped, _ := encodePEXPeers(pm.Dropped, family.iplen)
+
+		d["added"+family.suffix] = added
+		d["added"+family.suffix+".f"] = flags
+		d["dropped"+family.suffix] = dropped
+	}
+
+	return bencode.Marshal(d)
+}
+
+// encodePEXPeers writes the compact addresses and the flags of the peers of
+// one address family.
+func encodePEXPeers(peers []PEXPeer, iplen int) (string, string) {
+	data := make([]byte, 0)
+	flags := make([]byte, 0)
+	for _, p := range peers {
+		ip := p.IP.To4()
+		if iplen == net.IPv6len {
+			if ip != nil {
+				continue
+			}
+			ip = p.IP.To16()
+		}
+		if ip == nil {
+			continue
+		}
+
+		data = append(data, ip...)
+		data = append(data, byte(p.Port>>8), byte(p.Port))
+		flags = append(flags, p.Flags)
+	}
+
+	return string(data), string(flags)
+}
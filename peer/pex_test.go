@@ -0,0 +1,53 @@
+package peer
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPEXMessage(t *testing.T) {
+	pm := &PEXMessage{
+		Added: []PEXPeer{
+			{net.ParseIP("10.0.0.1"), 6881, PEXSeed | PEXOutgoing},
+			{net.ParseIP("2001:db8::1"), 6882, PEXEncryption},
+		},
+		Dropped: []PEXPeer{{IP: net.ParseIP("10.0.0.2"), Port: 6883}},
+	}
+
+	b, err := pm.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := ParsePEXMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decoded.Added) != 2 || len(decoded.Dropped) != 1 {
+		t.Fatalf("got %d added and %d dropped peers, expected 2 and 1", len(decoded.Added), len(decoded.Dropped))
+	}
+	for i, p := range pm.Added {
+		if decoded.Added[i].Addr() != p.Addr() || decoded.Added[i].Flags != p.Flags {
+			t.Errorf("got %s with flags %x, expected %s with flags %x", decoded.Added[i].Addr(), decoded.Added[i].Flags, p.Addr(), p.Flags)
+		}
+	}
+	if decoded.Dropped[0].Addr() != "10.0.0.2:6883" {
+		t.Errorf("got dropped peer %s, expected 10.0.0.2:6883", decoded.Dropped[0].Addr())
+	}
+}
+
+func TestParsePEXMessageWithoutFlags(t *testing.T) {
+	decoded, err := ParsePEXMessage([]byte("d5:added6:\x0a\x00\x00\x01\x1a\xe1e"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decoded.Added) != 1 || decoded.Added[0].Addr() != "10.0.0.1:6881" || decoded.Added[0].Flags != 0 {
+		t.Errorf("invalid added peers: %v", decoded.Added)
+	}
+
+	if _, err := ParsePEXMessage([]byte("le")); err == nil {
+		t.Error("expected an error for a list")
+	}
+}
@@ -0,0 +1,339 @@
+package picker
+
+import (
+	"sort"
+	"sync"
+)
+
+const (
+	BlockSize = 16384
+)
+
+type Block struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+}
+
+// Bitfield is the set of pieces a peer has.
+type Bitfield interface {
+	Has(index uint32) bool
+}
+
+type piece struct {
+	size       uint64
+	requesters []map[string]bool
+	received   []bool
+	remaining  int
+}
+
+func newPiece(size uint64) *piece {
+	numBlocks := int((size + BlockSize - 1) / BlockSize)
+
+	p := new(piece)
+	p.size = size
+	p.requesters = make([]map[string]bool, numBlocks)
+	for i := range p.requesters {
+		p.requesters[i] = make(map[string]bool)
+	}
+	p.received = make([]bool, numBlocks)
+	p.remaining = numBlocks
+	return p
+}
+
+func (p *piece) block(index uint32, i int) Block {
+	begin := uint64(i) * BlockSize
+	length := p.size - begin
+	if length > BlockSize {
+		length = BlockSize
+	}
+
+	return Block{index, uint32(begin), uint32(length)}
+}
+
+func (p *piece) blockIndex(b Block) (int, bool) {
+	i := int(b.Begin / BlockSize)
+	if b.Begin%BlockSize != 0 || i >= len(p.received) || p.block(b.Index, i) != b {
+		return 0, false
+	}
+
+	return i, true
+}
+
+// Picker decides which blocks to request from which peer. Peers are
+// identified by an arbitrary string key.
+type Picker struct {
+	mtx          sync.Mutex
+	numPieces    uint32
+	pieceLength  uint64
+	totalLength  uint64
+	strategy     Strategy
+	availability []int
+	completed    []bool
+	numCompleted uint32
+	inProgress   map[uint32]*piece
+}
+
+func NewPicker(numPieces uint32, pieceLength, totalLength uint64, strategy Strategy) *Picker {
+	p := new(Picker)
+	p.numPieces = numPieces
+	p.pieceLength = pieceLength
+	p.totalLength = totalLength
+	p.strategy = strategy
+	p.availability = make([]int, numPieces)
+	p.completed = make([]bool, numPieces)
+	p.inProgress = make(map[uint32]*piece)
+	return p
+}
+
+func (p *Picker) pieceSize(index uint32) uint64 {
+	if index == p.numPieces-1 {
+		if rem := p.totalLength % p.pieceLength; rem != 0 {
+			return rem
+		}
+	}
+
+	return p.pieceLength
+}
+
+func (p *Picker) SetStrategy(s Strategy) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.strategy = s
+}
+
+func (p *Picker) PeerHave(index uint32) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if index < p.numPieces {
+		p.availability[index]++
+	}
+}
+
+func (p *Picker) PeerBitfield(bf Bitfield) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	for i := uint32(0); i < p.numPieces; i++ {
+		if bf.Has(i) {
+			p.availability[i]++
+		}
+	}
+}
+
+// PeerLeft removes the pieces of a disconnected peer from the availability
+// and releases its requests.
+func (p *Picker) PeerLeft(peer string, bf Bitfield) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	for i := uint32(0); i < p.numPieces; i++ {
+		if bf.Has(i) && p.availability[i] > 0 {
+			p.availability[i]--
+		}
+	}
+
+	for _, pc := range p.inProgress {
+		for _, requesters := range pc.requesters {
+			delete(requesters, peer)
+		}
+	}
+}
+
+func (p *Picker) Availability(index uint32) int {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.availability[index]
+}
+
+func (p *Picker) Completed(index uint32) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.completed[index]
+}
+
+func (p *Picker) NumCompleted() uint32 {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.numCompleted
+}
+
+// Interesting tells whether a peer has a piece which is not completed yet.
+func (p *Picker) Interesting(bf Bitfield) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	for i := uint32(0); i < p.numPieces; i++ {
+		if !p.completed[i] && bf.Has(i) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Endgame tells whether every missing piece has been started, in which case
+// the remaining blocks are requested from more than one peer.
+func (p *Picker) Endgame() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.endgame()
+}
+
+func (p *Picker) endgame() bool {
+	return p.numCompleted+uint32(len(p.inProgress)) == p.numPieces
+}
+
+func (p *Picker) sortedInProgress() []uint32 {
+	indexes := make([]int, 0, len(p.inProgress))
+	for index := range p.inProgress {
+		indexes = append(indexes, int(index))
+	}
+	sort.Ints(indexes)
+
+	sorted := make([]uint32, len(indexes))
+	for i, index := range indexes {
+		sorted[i] = uint32(index)
+	}
+
+	return sorted
+}
+
+// Pick returns at most n blocks to request from the peer.
+func (p *Picker) Pick(peer string, bf Bitfield, n int) []Block {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	blocks := make([]Block, 0, n)
+	take := func(index uint32, pc *piece, duplicate bool) {
+		for i := range pc.received {
+			if len(blocks) == n {
+				return
+			}
+			if pc.received[i] || pc.requesters[i][peer] {
+				continue
+			}
+			if len(pc.requesters[i]) == 0 || duplicate {
+				pc.requesters[i][peer] = true
+				blocks = append(blocks, pc.block(index, i))
+			}
+		}
+	}
+
+	inProgress := p.sortedInProgress()
+	for _, index := range inProgress {
+		if bf.Has(index) {
+			take(index, p.inProgress[index], false)
+		}
+	}
+
+	for len(blocks) < n {
+		candidates := make([]uint32, 0)
+		for i := uint32(0); i < p.numPieces; i++ {
+			if _, ok := p.inProgress[i]; !ok && !p.completed[i] && bf.Has(i) {
+				candidates = append(candidates, i)
+			}
+		}
+
+		if len(candidates) == 0 {
+			break
+		}
+
+		index := candidates[p.strategy.Choose(candidates, p.availability, p.numCompleted)]
+		pc := newPiece(p.pieceSize(index))
+		p.inProgress[index] = pc
+		take(index, pc, false)
+	}
+
+	if len(blocks) < n && p.endgame() {
+		for _, index := range inProgress {
+			if bf.Has(index) {
+				take(index, p.inProgress[index], true)
+			}
+		}
+	}
+
+	return blocks
+}
+
+// Received marks a block as downloaded. It returns whether the block was
+// expected, the other peers the block was requested from, which should get
+// a cancel, and whether every block of the piece has arrived.
+func (p *Picker) Received(peer string, b Block) (ok bool, cancel []string, complete bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	pc, found := p.inProgress[b.Index]
+	if !found {
+		return false, nil, false
+	}
+
+	i, valid := pc.blockIndex(b)
+	if !valid || pc.received[i] {
+		return false, nil, false
+	}
+
+	pc.received[i] = true
+	pc.remaining--
+
+	cancel = make([]string, 0)
+	for requester := range pc.requesters[i] {
+		if requester != peer {
+			cancel = append(cancel, requester)
+		}
+	}
+	pc.requesters[i] = make(map[string]bool)
+
+	return true, cancel, pc.remaining == 0
+}
+
+// Dropped releases a request which won't be served.
+func (p *Picker) Dropped(peer string, b Block) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if pc, ok := p.inProgress[b.Index]; ok {
+		if i, valid := pc.blockIndex(b); valid {
+			delete(pc.requesters[i], peer)
+		}
+	}
+}
+
+func (p *Picker) PieceVerified(index uint32) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	delete(p.inProgress, index)
+	if !p.completed[index] {
+		p.completed[index] = true
+		p.numCompleted++
+	}
+}
+
+// PieceMissing marks a previously completed piece as missing, e.g. after
+// its data turned out to be corrupt on the disk.
+func (p *Picker) PieceMissing(index uint32) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	delete(p.inProgress, index)
+	if p.completed[index] {
+		p.completed[index] = false
+		p.numCompleted--
+	}
+}
+
+// PieceFailed throws away the progress of a piece, so it is downloaded
+// again from scratch.
+func (p *Picker) PieceFailed(index uint32) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	delete(p.inProgress, index)
+}
@@ -0,0 +1,143 @@
+package picker
+
+import (
+	"math/rand"
+	"testing"
+)
+
+type testBitfield []bool
+
+func (tb testBitfield) Has(index uint32) bool {
+	return int(index) < len(tb) && tb[index]
+}
+
+func newTestPicker(numPieces uint32, strategy Strategy) *Picker {
+	return NewPicker(numPieces, 2*BlockSize, uint64(numPieces)*2*BlockSize, strategy)
+}
+
+func TestRarestFirst(t *testing.T) {
+	p := newTestPicker(4, NewRarestFirst(rand.New(rand.NewSource(1))))
+
+	p.PeerBitfield(testBitfield{true, true, true, true})
+	p.PeerBitfield(testBitfield{true, true, true, false})
+	p.PeerBitfield(testBitfield{true, true, false, false})
+	p.PeerHave(1)
+
+	expected := []uint32{3, 2, 0, 1}
+	for _, index := range expected {
+		blocks := p.Pick("a", testBitfield{true, true, true, true}, 2)
+		if len(blocks) != 2 {
+			t.Fatalf("invalid number of blocks, got %d, expected 2", len(blocks))
+		}
+
+		if blocks[0].Index != index || blocks[1].Index != index {
+			t.Errorf("invalid piece, got %d, expected %d", blocks[0].Index, index)
+		}
+	}
+}
+
+func TestRandomFirst(t *testing.T) {
+	all := testBitfield{true, true, true, true, true, true, true, true}
+	newPicker := func(seed int64) *Picker {
+		p := newTestPicker(8, NewDefaultStrategy(rand.New(rand.NewSource(seed))))
+		for i := 0; i < 4; i++ {
+			p.PeerBitfield(all)
+		}
+		p.PeerHave(7)
+		return p
+	}
+
+	// Piece 7 is the most common one, so only a random pick can start it.
+	random := false
+	for seed := int64(0); seed < 64 && !random; seed++ {
+		random = newPicker(seed).Pick("a", all, 1)[0].Index == 7
+	}
+	if !random {
+		t.Error("random first never picks the most common piece")
+	}
+
+	p := newPicker(1)
+	for i := uint32(0); i < RandomFirstPieces; i++ {
+		p.PieceVerified(i)
+	}
+
+	for i := 0; i < 3; i++ {
+		if b := p.Pick("a", all, 2); b[0].Index == 7 {
+			t.Error("rarest first picked the most common piece")
+		}
+	}
+}
+
+func TestEndgame(t *testing.T) {
+	p := newTestPicker(1, NewRarestFirst(rand.New(rand.NewSource(1))))
+	bf := testBitfield{true}
+	p.PeerBitfield(bf)
+	p.PeerBitfield(bf)
+
+	a := p.Pick("a", bf, 10)
+	if len(a) != 2 {
+		t.Fatalf("invalid number of blocks, got %d, expected 2", len(a))
+	}
+
+	if !p.Endgame() {
+		t.Error("every piece is started, but the picker is not in endgame mode")
+	}
+
+	b := p.Pick("b", bf, 10)
+	if len(b) != 2 {
+		t.Fatalf("blocks are not requested twice in endgame mode, got %d blocks", len(b))
+	}
+
+	if again := p.Pick("b", bf, 10); len(again) != 0 {
+		t.Errorf("blocks are requested twice from the same peer: %v", again)
+	}
+
+	ok, cancel, complete := p.Received("a", a[0])
+	if !ok || complete {
+		t.Fatal("invalid state after the first block")
+	}
+	if len(cancel) != 1 || cancel[0] != "b" {
+		t.Errorf("invalid cancel list, got %v, expected [b]", cancel)
+	}
+
+	if ok, _, _ := p.Received("b", a[0]); ok {
+		t.Error("duplicate block is accepted")
+	}
+
+	ok, _, complete = p.Received("b", a[1])
+	if !ok || !complete {
+		t.Error("piece is not complete after receiving every block")
+	}
+}
+
+func TestPieceFailed(t *testing.T) {
+	p := newTestPicker(1, NewRarestFirst(rand.New(rand.NewSource(1))))
+	bf := testBitfield{true}
+	p.PeerBitfield(bf)
+
+	for _, b := range p.Pick("a", bf, 2) {
+		p.Received("a", b)
+	}
+	p.PieceFailed(0)
+
+	if blocks := p.Pick("b", bf, 2); len(blocks) != 2 {
+		t.Errorf("failed piece is not picked again, got %d blocks", len(blocks))
+	}
+}
+
+func TestPeerLeft(t *testing.T) {
+	p := newTestPicker(2, NewRarestFirst(rand.New(rand.NewSource(1))))
+	bf := testBitfield{true, false}
+	p.PeerBitfield(bf)
+	p.Pick("a", bf, 1)
+	p.PeerLeft("a", bf)
+
+	if p.Availability(0) != 0 {
+		t.Errorf("invalid availability, got %d, expected 0", p.Availability(0))
+	}
+
+	blocks := p.Pick("b", bf, 1)
+	if len(blocks) != 1 || blocks[0].Begin != 0 {
+		t.Errorf("request of the disconnected peer is not released: %v", blocks)
+	}
+}
@@ -0,0 +1,77 @@
+package picker
+
+import "math/rand"
+
+const (
+	RandomFirstPieces = 4
+)
+
+// Strategy decides which piece to start downloading next.
+type Strategy interface {
+	// Choose returns the position of the chosen piece in candidates.
+	// availability is indexed by piece and must not be modified.
+	Choose(candidates []uint32, availability []int, numCompleted uint32) int
+}
+
+type RandomFirst struct {
+	rand *rand.Rand
+}
+
+func NewRandomFirst(r *rand.Rand) *RandomFirst {
+	rf := new(RandomFirst)
+	rf.rand = r
+	return rf
+}
+
+func (rf *RandomFirst) Choose(candidates []uint32, availability []int, numCompleted uint32) int {
+	return rf.rand.Intn(len(candidates))
+}
+
+type RarestFirst struct {
+	rand *rand.Rand
+}
+
+func NewRarestFirst(r *rand.Rand) *RarestFirst {
+	rf := new(RarestFirst)
+	rf.rand = r
+	return rf
+}
+
+func (rf *RarestFirst) Choose(candidates []uint32, availability []int, numCompleted uint32) int {
+	rarest := make([]int, 0)
+	min := -1
+	for i, index := range candidates {
+		a := availability[index]
+		if min < 0 || a < min {
+			min = a
+			rarest = rarest[:0]
+		}
+		if a == min {
+			rarest = append(rarest, i)
+		}
+	}
+
+	return rarest[rf.rand.Intn(len(rarest))]
+}
+
+// DefaultStrategy picks random pieces until the first few are completed, so
+// there is something to share quickly, then switches to rarest first.
+type DefaultStrategy struct {
+	randomFirst *RandomFirst
+	rarestFirst *RarestFirst
+}
+
+func NewDefaultStrategy(r *rand.Rand) *DefaultStrategy {
+	ds := new(DefaultStrategy)
+	ds.randomFirst = NewRandomFirst(r)
+	ds.rarestFirst = NewRarestFirst(r)
+	return ds
+}
+
+func (ds *DefaultStrategy) Choose(candidates []uint32, availability []int, numCompleted uint32) int {
+	if numCompleted < RandomFirstPieces {
+		return ds.randomFirst.Choose(candidates, availability, numCompleted)
+	}
+
+	return ds.rarestFirst.Choose(candidates, availability, numCompleted)
+}
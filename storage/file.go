@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"github.com/yorirou/gotorrent/metainfo"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStorage stores the torrent in files under a directory, following the
+// file layout of the metainfo.
+type FileStorage struct {
+	dir    string
+	layout *layout
+	open   map[string]*os.File
+	mtx    sync.Mutex
+}
+
+func NewFileStorage(info *metainfo.Info, dir string) (*FileStorage, error) {
+	l, err := newLayout(info)
+	if err != nil {
+		return nil, err
+	}
+
+	fs := new(FileStorage)
+	fs.dir = dir
+	fs.layout = l
+	fs.open = make(map[string]*os.File)
+
+	return fs, nil
+}
+
+func (fs *FileStorage) getFile(f *file, create bool) (*os.File, error) {
+	if of, ok := fs.open[f.path]; ok {
+		return of, nil
+	}
+
+	path := filepath.Join(fs.dir, f.path)
+	flag := os.O_RDWR
+	if create {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		flag |= os.O_CREATE
+	}
+
+	of, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fs.open[f.path] = of
+
+	return of, nil
+}
+
+// openFiles opens the files of the regions. The lock is not held during the
+// reads and writes, so the pieces can be read in parallel; an os.File can be
+// read and written concurrently at different offsets.
+func (fs *FileStorage) openFiles(regions []region, create bool) ([]*os.File, error) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	files := make([]*os.File, len(regions))
+	for i, r := range regions {
+		of, err := fs.getFile(r.file, create)
+		if err != nil {
+			return nil, err
+		}
+		files[i] = of
+	}
+
+	return files, nil
+}
+
+func (fs *FileStorage) ReadAt(p []byte, piece uint32, begin uint32) (int, error) {
+	offset, err := fs.layout.offset(piece, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	// The empty files are not read, they may not exist yet.
+	regions := make([]region, 0, 1)
+	for _, r := range fs.layout.regions(offset, len(p)) {
+		if r.start != r.end {
+			regions = append(regions, r)
+		}
+	}
+
+	files, err := fs.openFiles(regions, false)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for i, r := range regions {
+		read, err := files[i].ReadAt(p[r.start:r.end], int64(r.offset))
+		n += read
+		if err != nil {
+			return n, err
+		}
+	}
+
+	if n < len(p) {
+		return n, io.ErrUnexpectedEOF
+	}
+
+	return n, nil
+}
+
+func (fs *FileStorage) WriteAt(p []byte, piece uint32, begin uint32) (int, error) {
+	offset, err := fs.layout.offset(piece, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	regions := fs.layout.regions(offset, len(p))
+	files, err := fs.openFiles(regions, true)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for i, r := range regions {
+		written, err := files[i].WriteAt(p[r.start:r.end], int64(r.offset))
+		n += written
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+func (fs *FileStorage) Stat() []FileStat {
+	stats := make([]FileStat, len(fs.layout.files))
+	for i, f := range fs.layout.files {
+		stats[i] = FileStat{Path: f.path, Offset: f.offset, Length: f.length, Size: -1}
+
+		if fi, err := os.Stat(filepath.Join(fs.dir, f.path)); err == nil {
+			stats[i].Size = fi.Size()
+			stats[i].ModTime = fi.ModTime().UnixNano()
+		}
+	}
+
+	return stats
+}
+
+func (fs *FileStorage) Flush() error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	for _, of := range fs.open {
+		if err := of.Sync(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (fs *FileStorage) Close() error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	var firsterr error
+	for path, of := range fs.open {
+		if err := of.Close(); err != nil && firsterr == nil {
+			firsterr = err
+		}
+		delete(fs.open, path)
+	}
+
+	return firsterr
+}
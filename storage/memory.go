@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"github.com/yorirou/gotorrent/metainfo"
+	"sync"
+)
+
+// MemoryStorage keeps the whole torrent in memory. It is mainly useful for
+// tests.
+type MemoryStorage struct {
+	layout *layout
+	data   []byte
+	mtx    sync.RWMutex
+}
+
+func NewMemoryStorage(info *metainfo.Info) *MemoryStorage {
+	ms := new(MemoryStorage)
+	ms.layout = &layout{pieceLength: info.PieceLength, totalLength: info.TotalLength()}
+	ms.data = make([]byte, ms.layout.totalLength)
+	return ms
+}
+
+func (ms *MemoryStorage) ReadAt(p []byte, piece uint32, begin uint32) (int, error) {
+	offset, err := ms.layout.offset(piece, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	ms.mtx.RLock()
+	defer ms.mtx.RUnlock()
+
+	return copy(p, ms.data[offset:]), nil
+}
+
+func (ms *MemoryStorage) WriteAt(p []byte, piece uint32, begin uint32) (int, error) {
+	offset, err := ms.layout.offset(piece, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	return copy(ms.data[offset:], p), nil
+}
+
+func (ms *MemoryStorage) Flush() error {
+	return nil
+}
+
+func (ms *MemoryStorage) Close() error {
+	return nil
+}
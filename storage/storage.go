@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"errors"
+	"github.com/yorirou/gotorrent/metainfo"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrInvalidPath = errors.New("invalid path in the metainfo")
+	ErrOutOfRange  = errors.New("data is out of the range of the torrent")
+)
+
+// Storage stores the data of a torrent. Offsets are relative to the start
+// of a piece.
+type Storage interface {
+	ReadAt(p []byte, piece uint32, begin uint32) (int, error)
+	WriteAt(p []byte, piece uint32, begin uint32) (int, error)
+	Flush() error
+	Close() error
+}
+
+// FileStatter is implemented by storages which keep the data in files.
+type FileStatter interface {
+	Stat() []FileStat
+}
+
+// FileStat describes a file of the torrent. Offset and Length locate the file
+// in the torrent, Size and ModTime describe the file on the disk. Size is -1
+// when the file does not exist.
+type FileStat struct {
+	Path    string
+	Offset  uint64
+	Length  uint64
+	Size    int64
+	ModTime int64
+}
+
+type file struct {
+	path   string
+	offset uint64
+	length uint64
+}
+
+type region struct {
+	file   *file
+	offset uint64
+	start  uint64
+	end    uint64
+}
+
+type layout struct {
+	pieceLength uint64
+	totalLength uint64
+	files       []*file
+}
+
+func checkPathElement(e string) error {
+	if e == "" || e == "." || e == ".." || strings.ContainsAny(e, "/\\\x00") || filepath.IsAbs(e) || filepath.VolumeName(e) != "" {
+		return ErrInvalidPath
+	}
+
+	return nil
+}
+
+func newLayout(info *metainfo.Info) (*layout, error) {
+	if err := checkPathElement(info.Name); err != nil {
+		return nil, err
+	}
+
+	l := new(layout)
+	l.pieceLength = info.PieceLength
+	l.totalLength = info.TotalLength()
+
+	if len(info.Files) == 0 {
+		l.files = []*file{{info.Name, 0, info.Length}}
+		return l, nil
+	}
+
+	var offset uint64
+	for _, f := range info.Files {
+		if len(f.Path) == 0 {
+			return nil, ErrInvalidPath
+		}
+
+		for _, e := range f.Path {
+			if err := checkPathElement(e); err != nil {
+				return nil, err
+			}
+		}
+
+		path := filepath.Join(append([]string{info.Name}, f.Path...)...)
+		l.files = append(l.files, &file{path, offset, f.Length})
+		offset += f.Length
+	}
+
+	return l, nil
+}
+
+func (l *layout) offset(piece, begin uint32, length int) (uint64, error) {
+	offset := uint64(piece)*l.pieceLength + uint64(begin)
+	if offset+uint64(length) > l.totalLength {
+		return 0, ErrOutOfRange
+	}
+
+	return offset, nil
+}
+
+// regions splits a range of the torrent into ranges of files. start and end
+// are relative to the range itself, offset is relative to the file. The
+// empty files at the range are included with an empty region, so they are
+// created by the writes.
+func (l *layout) regions(offset uint64, length int) []region {
+	end := offset + uint64(length)
+	regions := make([]region, 0, 1)
+
+	for _, f := range l.files {
+		if f.length == 0 {
+			if f.offset >= offset && f.offset <= end {
+				regions = append(regions, region{f, 0, f.offset - offset, f.offset - offset})
+			}
+			continue
+		}
+		if f.offset+f.length <= offset || f.offset >= end {
+			continue
+		}
+
+		from := offset
+		if f.offset > from {
+			from = f.offset
+		}
+		to := end
+		if f.offset+f.length < to {
+			to = f.offset + f.length
+		}
+
+		regions = append(regions, region{f, from - f.offset, from - offset, to - offset})
+	}
+
+	return regions
+}
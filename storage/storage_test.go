@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"bytes"
+	"github.com/yorirou/gotorrent/metainfo"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func testMultiFileInfo() *metainfo.Info {
+	info := new(metainfo.Info)
+	info.Name = "test"
+	info.PieceLength = 4
+	info.Files = []metainfo.File{
+		{Length: 3, Path: []string{"a"}},
+		{Length: 0, Path: []string{"empty"}},
+		{Length: 6, Path: []string{"dir", "b"}},
+	}
+
+	return info
+}
+
+func testStorage(t *testing.T, s Storage) {
+	if _, err := s.WriteAt([]byte("abcd"), 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.WriteAt([]byte("efgh"), 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.WriteAt([]byte("i"), 2, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 3)
+	if _, err := s.ReadAt(buf, 0, 2); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "cde" {
+		t.Errorf("invalid data across file boundary, got %s, expected cde", string(buf))
+	}
+
+	if _, err := s.WriteAt([]byte("ij"), 2, 0); err != ErrOutOfRange {
+		t.Errorf("expected out of range error, got %v", err)
+	}
+
+	if err := s.Flush(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotorrent-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileStorage(testMultiFileInfo(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testStorage(t, s)
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, expected := range map[string]string{"a": "abc", "empty": "", "dir/b": "defghi"} {
+		content, err := ioutil.ReadFile(filepath.Join(dir, "test", filepath.FromSlash(path)))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !bytes.Equal(content, []byte(expected)) {
+			t.Errorf("invalid content of %s, got %s, expected %s", path, content, expected)
+		}
+	}
+}
+
+func TestFileStorageConcurrency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotorrent-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileStorage(testMultiFileInfo(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	pieces := []string{"abcd", "efgh", "i"}
+	for i, p := range pieces {
+		if _, err := s.WriteAt([]byte(p), uint32(i), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			index := i % len(pieces)
+			buf := make([]byte, len(pieces[index]))
+			for j := 0; j < 100; j++ {
+				if i%2 == 0 {
+					s.WriteAt([]byte(pieces[index]), uint32(index), 0)
+				} else if _, err := s.ReadAt(buf, uint32(index), 0); err != nil || string(buf) != pieces[index] {
+					t.Errorf("got %q and error %v, expected %q", buf, err, pieces[index])
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMemoryStorage(t *testing.T) {
+	testStorage(t, NewMemoryStorage(testMultiFileInfo()))
+}
+
+func TestPathSanitisation(t *testing.T) {
+	paths := [][]string{
+		{".."},
+		{"a", "..", "b"},
+		{"/etc"},
+		{"a/../../b"},
+		{""},
+		{},
+	}
+
+	for _, path := range paths {
+		info := testMultiFileInfo()
+		info.Files[0].Path = path
+		if _, err := NewFileStorage(info, "."); err != ErrInvalidPath {
+			t.Errorf("invalid path %q is accepted", path)
+		}
+	}
+
+	info := testMultiFileInfo()
+	info.Name = ".."
+	if _, err := NewFileStorage(info, "."); err != ErrInvalidPath {
+		t.Error("invalid name is accepted")
+	}
+}
@@ -0,0 +1,244 @@
+package torrent
+
+import (
+	"errors"
+	"github.com/yorirou/gotorrent/dht"
+	"github.com/yorirou/gotorrent/lsd"
+	"github.com/yorirou/gotorrent/peer"
+	"github.com/yorirou/gotorrent/tracker"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// dhtInterval is the time between the DHT announces of a torrent.
+var dhtInterval = 15 * time.Minute
+
+var ErrPrivate = errors.New("private torrents only take peers from their trackers")
+
+// PeerSource finds the peers of a torrent and adds them to the peer pool
+// of the torrent.
+type PeerSource interface {
+	Start()
+	Stop()
+	// Found is signalled when new peers are added to the pool.
+	Found() <-chan struct{}
+}
+
+// trackerSource gets the peers from the trackers.
+type trackerSource struct {
+	*tracker.Announcer
+}
+
+func (s trackerSource) Found() <-chan struct{} {
+	return s.Announced()
+}
+
+// Private tells whether the torrent is private (BEP 27).
+func (t *Torrent) Private() bool {
+	return t.metainfo.Info.Private == 1
+}
+
+// AddPeerSource adds a source of peers beside the trackers. It has to be
+// called before Download or Seed.
+func (t *Torrent) AddPeerSource(s PeerSource) error {
+	if t.Private() {
+		return ErrPrivate
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.sources = append(t.sources, s)
+	return nil
+}
+
+// EnableDHT finds peers through the DHT, and advertises the DHT port to the
+// peers.
+func (t *Torrent) EnableDHT(d *dht.DHT) error {
+	if err := t.AddPeerSource(newDHTSource(d, t.metainfo.Info.Hash, int(t.clientConfig.Port), t.peers)); err != nil {
+		return err
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.dht = d
+	return nil
+}
+
+// EnableLSD finds peers on the local network (BEP 14).
+func (t *Torrent) EnableLSD(l *lsd.LSD) error {
+	return t.AddPeerSource(newLSDSource(l, t.metainfo.Info.Hash, t.peers))
+}
+
+func (t *Torrent) getDHT() *dht.DHT {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return t.dht
+}
+
+// Handshake returns our handshake for the connections of the torrent.
+func (t *Torrent) Handshake() *peer.Handshake {
+	h := peer.NewHandshake(t.metainfo.Info.Hash, t.clientConfig.PeerID)
+	if t.getDHT() != nil {
+		h.SetDHT()
+	}
+
+	return h
+}
+
+// PeerPort adds the DHT node of a peer to the routing table, if it answers.
+func (t *Torrent) PeerPort(c *peer.Conn, port uint16) {
+	d := t.getDHT()
+	addr, ok := c.RemoteAddr().(*net.TCPAddr)
+	if d == nil || !ok || port == 0 {
+		return
+	}
+
+	go d.Ping(&net.UDPAddr{IP: addr.IP, Port: int(port)})
+}
+
+func (t *Torrent) sendPort(c *peer.Conn, h *peer.Handshake) {
+	if d := t.getDHT(); d != nil && h.SupportsDHT() {
+		c.Send(peer.NewPort(uint16(d.Addr().Port)))
+	}
+}
+
+// startSources starts every peer source, and forwards their signals to
+// t.found.
+func (t *Torrent) startSources() {
+	t.sourcesOnce.Do(func() {
+		t.mtx.Lock()
+		sources := append([]PeerSource{}, t.sources...)
+		t.mtx.Unlock()
+
+		for _, s := range sources {
+			s.Start()
+
+			go func(s PeerSource) {
+				for {
+					select {
+					case <-t.stopped:
+						return
+					case <-s.Found():
+						select {
+						case t.found <- struct{}{}:
+						default:
+						}
+					}
+				}
+			}(s)
+		}
+	})
+}
+
+func (t *Torrent) stopSources() {
+	t.mtx.Lock()
+	sources := append([]PeerSource{}, t.sources...)
+	t.mtx.Unlock()
+
+	for _, s := range sources {
+		s.Stop()
+	}
+}
+
+// dhtSource announces the torrent to the DHT periodically, and adds the
+// peers found by the lookups to the pool.
+type dhtSource struct {
+	dht      *dht.DHT
+	infohash string
+	port     int
+	interval time.Duration
+	peers    *tracker.PeerPool
+	found    chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newDHTSource(d *dht.DHT, infohash string, port int, peers *tracker.PeerPool) *dhtSource {
+	s := new(dhtSource)
+	s.dht = d
+	s.infohash = infohash
+	s.port = port
+	s.interval = dhtInterval
+	s.peers = peers
+	s.found = make(chan struct{}, 1)
+	s.stop = make(chan struct{})
+	return s
+}
+
+func (s *dhtSource) Start() {
+	go s.run()
+}
+
+func (s *dhtSource) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+}
+
+func (s *dhtSource) Found() <-chan struct{} {
+	return s.found
+}
+
+func (s *dhtSource) run() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-timer.C:
+		}
+
+		peers, err := s.dht.Announce(s.infohash, s.port)
+		if err != nil {
+			log.Print("dht announce failed: ", err)
+		}
+
+		for _, p := range peers {
+			s.peers.Add(p)
+		}
+		if len(peers) > 0 {
+			select {
+			case s.found <- struct{}{}:
+			default:
+			}
+		}
+
+		timer.Reset(s.interval)
+	}
+}
+
+// lsdSource announces the torrent on the local network while it is active.
+type lsdSource struct {
+	lsd      *lsd.LSD
+	infohash string
+	peers    *tracker.PeerPool
+	found    chan struct{}
+}
+
+func newLSDSource(l *lsd.LSD, infohash string, peers *tracker.PeerPool) *lsdSource {
+	s := new(lsdSource)
+	s.lsd = l
+	s.infohash = infohash
+	s.peers = peers
+	s.found = make(chan struct{}, 1)
+	return s
+}
+
+func (s *lsdSource) Start() {
+	s.lsd.Add(s.infohash, s.peers, s.found)
+}
+
+func (s *lsdSource) Stop() {
+	s.lsd.Remove(s.infohash)
+}
+
+func (s *lsdSource) Found() <-chan struct{} {
+	return s.found
+}
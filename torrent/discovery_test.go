@@ -0,0 +1,255 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"github.com/yorirou/gotorrent/client/config"
+	"github.com/yorirou/gotorrent/dht"
+	"github.com/yorirou/gotorrent/lsd"
+	"github.com/yorirou/gotorrent/peer"
+	"github.com/yorirou/gotorrent/storage"
+	"github.com/yorirou/gotorrent/tracker"
+	"net"
+	"testing"
+	"time"
+)
+
+// testSource adds its peers to the pool once it is started.
+type testSource struct {
+	peers *tracker.PeerPool
+	found chan struct{}
+	add   []*tracker.Peer
+}
+
+func (s *testSource) Start() {
+	go func() {
+		for _, p := range s.add {
+			s.peers.Add(p)
+		}
+		s.found <- struct{}{}
+	}()
+}
+
+func (s *testSource) Stop() {}
+
+func (s *testSource) Found() <-chan struct{} {
+	return s.found
+}
+
+// lsdTransport delivers the announcements of one LSD to the other, both
+// sent from the loopback address.
+type lsdTransport struct {
+	in     chan []byte
+	out    chan []byte
+	closed chan struct{}
+}
+
+func newLSDTransports() (*lsdTransport, *lsdTransport) {
+	c0, c1 := make(chan []byte, 16), make(chan []byte, 16)
+	return &lsdTransport{c0, c1, make(chan struct{})}, &lsdTransport{c1, c0, make(chan struct{})}
+}
+
+func (t *lsdTransport) Host() string {
+	return lsd.Group4
+}
+
+func (t *lsdTransport) Send(b []byte) error {
+	t.out <- append([]byte{}, b...)
+	return nil
+}
+
+func (t *lsdTransport) Receive(b []byte) (int, net.Addr, error) {
+	select {
+	case <-t.closed:
+		return 0, nil, errors.New("closed")
+	case p := <-t.in:
+		return copy(b, p), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6771}, nil
+	}
+}
+
+func (t *lsdTransport) Close() error {
+	close(t.closed)
+	return nil
+}
+
+func startTestDHT(t *testing.T, bootstrap *dht.DHT) *dht.DHT {
+	d, err := dht.NewDHT("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Start()
+
+	if bootstrap != nil {
+		d.BootstrapNodes = []string{bootstrap.Addr().String()}
+		if err := d.Bootstrap(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return d
+}
+
+func TestPrivateTorrentSources(t *testing.T) {
+	mi := testMetainfo(4, map[string][]byte{"a": []byte("aaaa")}, "a")
+	mi.Info.Private = 1
+	tr := NewTorrent(mi, config.NewClientConfig())
+
+	if err := tr.AddPeerSource(&testSource{}); err != ErrPrivate {
+		t.Errorf("got error %v, expected %v", err, ErrPrivate)
+	}
+
+	d := startTestDHT(t, nil)
+	defer d.Close()
+	if err := tr.EnableDHT(d); err != ErrPrivate {
+		t.Errorf("got error %v, expected %v", err, ErrPrivate)
+	}
+
+	if err := tr.EnableLSD(lsd.NewLSDWithTransports(6881)); err != ErrPrivate {
+		t.Errorf("got error %v, expected %v", err, ErrPrivate)
+	}
+
+	if tr.Handshake().SupportsDHT() {
+		t.Error("the handshake of a private torrent advertises the DHT")
+	}
+}
+
+func TestDownloadFromPeerSource(t *testing.T) {
+	files := map[string][]byte{"a": bytes.Repeat([]byte("abcdefgh"), 5000)}
+	mi := testMetainfo(16384, files, "a")
+
+	seeder, l := startTestSeeder(t, mi, files["a"], "127.0.0.1:0")
+	defer l.Close()
+	defer seeder.Stop()
+
+	// The leecher has no trackers, its only peer comes from the source.
+	leecher := NewTorrent(mi, config.NewClientConfig())
+	leecher.SetStorage(storage.NewMemoryStorage(&mi.Info))
+	defer leecher.Stop()
+
+	addr := l.Addr().(*net.TCPAddr)
+	s := &testSource{leecher.peers, make(chan struct{}, 1), []*tracker.Peer{{IP: addr.IP, Port: uint16(addr.Port)}}}
+	if err := leecher.AddPeerSource(s); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := leecher.Download(); err != nil {
+		t.Fatal(err)
+	}
+	if leecher.Left() != 0 {
+		t.Errorf("invalid left value, got %d, expected 0", leecher.Left())
+	}
+}
+
+func TestDownloadThroughDHT(t *testing.T) {
+	defer func(d time.Duration) { dhtInterval = d }(dhtInterval)
+	dhtInterval = 100 * time.Millisecond
+
+	files := map[string][]byte{"a": bytes.Repeat([]byte("abcdefgh"), 5000)}
+	mi := testMetainfo(16384, files, "a")
+
+	seeder, l := startTestSeeder(t, mi, files["a"], "127.0.0.1:0")
+	defer l.Close()
+
+	d0 := startTestDHT(t, nil)
+	defer d0.Close()
+	d1 := startTestDHT(t, d0)
+	defer d1.Close()
+
+	seeder.clientConfig.Port = uint64(l.Addr().(*net.TCPAddr).Port)
+	if err := seeder.EnableDHT(d0); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go seeder.Seed(stop)
+
+	leecher := NewTorrent(mi, config.NewClientConfig())
+	leecher.SetStorage(storage.NewMemoryStorage(&mi.Info))
+	leecher.clientConfig.Port = 6881
+	if err := leecher.EnableDHT(d1); err != nil {
+		t.Fatal(err)
+	}
+	defer leecher.Stop()
+
+	if err := leecher.Download(); err != nil {
+		t.Fatal(err)
+	}
+	if leecher.Left() != 0 {
+		t.Errorf("invalid left value, got %d, expected 0", leecher.Left())
+	}
+}
+
+func TestDownloadThroughLSD(t *testing.T) {
+	files := map[string][]byte{"a": bytes.Repeat([]byte("abcdefgh"), 5000)}
+	mi := testMetainfo(16384, files, "a")
+
+	seeder, l := startTestSeeder(t, mi, files["a"], "127.0.0.1:0")
+	defer l.Close()
+
+	t0, t1 := newLSDTransports()
+	l0 := lsd.NewLSDWithTransports(l.Addr().(*net.TCPAddr).Port, t0)
+	defer l0.Close()
+	l1 := lsd.NewLSDWithTransports(6881, t1)
+	defer l1.Close()
+
+	if err := seeder.EnableLSD(l0); err != nil {
+		t.Fatal(err)
+	}
+
+	leecher := NewTorrent(mi, config.NewClientConfig())
+	leecher.SetStorage(storage.NewMemoryStorage(&mi.Info))
+	if err := leecher.EnableLSD(l1); err != nil {
+		t.Fatal(err)
+	}
+	defer leecher.Stop()
+
+	// The leecher has to listen before the seeder announces.
+	leecher.startSources()
+	l1.Start()
+	l0.Start()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go seeder.Seed(stop)
+
+	if err := leecher.Download(); err != nil {
+		t.Fatal(err)
+	}
+	if leecher.Left() != 0 {
+		t.Errorf("invalid left value, got %d, expected 0", leecher.Left())
+	}
+}
+
+func TestPortMessage(t *testing.T) {
+	mi := testMetainfo(4, map[string][]byte{"a": []byte("aaaa")}, "a")
+	tr := NewTorrent(mi, config.NewClientConfig())
+	tr.SetStorage(storage.NewMemoryStorage(&mi.Info))
+
+	d := startTestDHT(t, nil)
+	defer d.Close()
+	if err := tr.EnableDHT(d); err != nil {
+		t.Fatal(err)
+	}
+
+	c0, c1 := net.Pipe()
+	defer c1.Close()
+
+	h := peer.NewHandshake(mi.Info.Hash, "-GT0000-000000000000")
+	h.SetDHT()
+	go tr.Accept(c0, h)
+	defer tr.Stop()
+
+	for {
+		m, err := peer.ReadMessage(c1, peer.DefaultMaxMessageLength)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if m.ID == peer.Port && !m.KeepAlive {
+			if int(m.Port) != d.Addr().Port {
+				t.Errorf("got port %d, expected %d", m.Port, d.Addr().Port)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"github.com/yorirou/gotorrent/client/config"
+	"github.com/yorirou/gotorrent/mse"
+	"github.com/yorirou/gotorrent/peer"
+	"github.com/yorirou/gotorrent/picker"
+	"github.com/yorirou/gotorrent/tracker"
+	"github.com/yorirou/gotorrent/util"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	dialTimeout    = 10 * time.Second
+	resumeInterval = 30 * time.Second
+)
+
+var ErrTooManyConns = errors.New("too many connections")
+
+// Download fetches every piece of the torrent from the peers found by the
+// peer sources into the storage of the torrent. It waits for peers until the
+// download is done or Stop is called. The connections are kept open after the
+// download, so the torrent can be seeded; Stop closes them.
+func (t *Torrent) Download() error {
+	if t.storage == nil {
+		return errors.New("no storage is set")
+	}
+
+	if t.bitfield.Complete() {
+		return nil
+	}
+
+	t.startChoker()
+	t.startSources()
+	t.connectPeers()
+
+	ticker := time.NewTicker(resumeInterval)
+	defer ticker.Stop()
+
+	for running := true; running; {
+		select {
+		case <-t.done:
+			running = false
+		case <-t.stopped:
+			running = false
+		case <-t.found:
+			t.connectPeers()
+		case <-ticker.C:
+			t.saveResume()
+		}
+	}
+
+	if err := t.storage.Flush(); err != nil {
+		return err
+	}
+	t.saveResume()
+
+	if completed, total := t.Completed(), t.metainfo.Info.NumPieces(); completed < total {
+		return fmt.Errorf("download incomplete: %d of %d pieces", completed, total)
+	}
+
+	return nil
+}
+
+// Stop closes every connection, stops the peer sources, which tells the
+// trackers that the torrent is stopped, and saves the progress.
+func (t *Torrent) Stop() error {
+	t.stopOnce.Do(func() {
+		close(t.stopped)
+	})
+	t.closeConns()
+	t.stopSources()
+
+	if t.storage != nil {
+		if err := t.storage.Flush(); err != nil {
+			return err
+		}
+	}
+	t.saveResume()
+
+	return nil
+}
+
+func (t *Torrent) saveResume() {
+	if path := t.ResumeFile(); path != "" {
+		if err := t.SaveResume(path); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+func (t *Torrent) Completed() uint32 {
+	return t.bitfield.Count()
+}
+
+func (t *Torrent) NumConns() int {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return len(t.conns)
+}
+
+// connectPeers connects to the peers of the pool which are not connected
+// yet.
+func (t *Torrent) connectPeers() {
+	for _, p := range t.peers.GetPeers() {
+		key := p.Hash()
+
+		t.mtx.Lock()
+		if len(t.conns)+len(t.dialing) >= t.clientConfig.MaxConnsPerTorrent {
+			t.mtx.Unlock()
+			return
+		}
+		if t.dialing[key] || t.banned[p.IP.String()] {
+			t.mtx.Unlock()
+			continue
+		}
+		limiter := t.connLimiter
+		if limiter != nil && !limiter.AcquireConn() {
+			t.mtx.Unlock()
+			return
+		}
+		t.dialing[key] = true
+		t.mtx.Unlock()
+
+		go func(p *tracker.Peer) {
+			if err := t.connect(p); err != nil {
+				log.Print(p.Addr(), ": ", err)
+			}
+			if limiter != nil {
+				limiter.ReleaseConn()
+			}
+
+			t.mtx.Lock()
+			delete(t.dialing, p.Hash())
+			t.mtx.Unlock()
+		}(p)
+	}
+}
+
+func (t *Torrent) connect(p *tracker.Peer) error {
+	conn, err := t.dial(p)
+	if err != nil {
+		return err
+	}
+
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	h, err := peer.DoHandshakeWith(conn, t.Handshake())
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	// The DHT and the other peers may return our own address.
+	if h.PeerID == t.clientConfig.PeerID {
+		conn.Close()
+		return errors.New("connection to ourselves")
+	}
+	conn.SetDeadline(time.Time{})
+
+	return t.accept(conn, h, p)
+}
+
+// dial connects to the peer with the encryption policy of the client. When
+// encryption is only preferred, the peers which do not support it are
+// connected again in plaintext.
+func (t *Torrent) dial(p *tracker.Peer) (net.Conn, error) {
+	// "tcp" dials both IPv4 and IPv6 addresses.
+	conn, err := net.DialTimeout("tcp", p.Addr(), dialTimeout)
+	if err != nil || t.clientConfig.Encryption == config.EncryptionDisabled {
+		return conn, err
+	}
+
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	ec, err := mse.Initiate(conn, t.metainfo.Info.Hash, t.clientConfig.Encryption.Methods())
+	if err == nil {
+		return ec, nil
+	}
+	conn.Close()
+
+	if t.clientConfig.Encryption == config.EncryptionRequire {
+		return nil, err
+	}
+
+	return net.DialTimeout("tcp", p.Addr(), dialTimeout)
+}
+
+// Accept serves a connection after the handshake, h is the handshake of the
+// peer. It blocks until the connection is closed.
+func (t *Torrent) Accept(conn net.Conn, h *peer.Handshake) error {
+	return t.accept(conn, h, nil)
+}
+
+// accept runs a connection after the handshake. dialed is the address we
+// connected to, nil for the incoming connections.
+func (t *Torrent) accept(conn net.Conn, h *peer.Handshake, dialed *tracker.Peer) error {
+	c := peer.NewConn(conn, h.PeerID, t.metainfo.Info.NumPieces(), t)
+	c.SetPipeline(t.clientConfig.PipelineDepth)
+	c.SetRequestTimeout(t.clientConfig.RequestTimeout)
+
+	if t.Banned(connIP(c)) {
+		conn.Close()
+		return errors.New("peer is banned")
+	}
+
+	t.mtx.Lock()
+	if len(t.conns) >= t.clientConfig.MaxConnsPerTorrent {
+		t.mtx.Unlock()
+		conn.Close()
+		return ErrTooManyConns
+	}
+	t.conns[c] = true
+	if dialed != nil {
+		t.dialed[c] = dialed
+	}
+	t.mtx.Unlock()
+
+	if h.SupportsExtensions() {
+		t.sendExtendedHandshake(c)
+	}
+	t.sendPort(c, h)
+
+	if t.bitfield.Count() > 0 {
+		c.Send(peer.NewBitfield(t.bitfield.Bytes()))
+	}
+
+	return c.Run()
+}
+
+func (t *Torrent) getConns() []*peer.Conn {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	conns := make([]*peer.Conn, 0, len(t.conns))
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+
+	return conns
+}
+
+func (t *Torrent) closeConns() {
+	for _, c := range t.getConns() {
+		c.Close()
+	}
+}
+
+func (t *Torrent) PeerHave(c *peer.Conn, index uint32) {
+	t.picker.PeerHave(index)
+	c.SetInterested(t.picker.Interesting(c))
+}
+
+func (t *Torrent) PeerBitfield(c *peer.Conn, added *util.Bitfield) {
+	t.picker.PeerBitfield(added)
+	c.SetInterested(t.picker.Interesting(c))
+}
+
+func (t *Torrent) Blocks(c *peer.Conn, n int) []peer.Block {
+	picked := t.picker.Pick(c.PeerID(), c, n)
+
+	blocks := make([]peer.Block, len(picked))
+	for i, b := range picked {
+		blocks[i] = peer.Block(b)
+	}
+
+	return blocks
+}
+
+func (t *Torrent) BlockReceived(c *peer.Conn, b peer.Block, data []byte) {
+	t.AddToDownloaded(uint64(len(data)))
+
+	// Marking the block received and copying it is one step, otherwise the
+	// last block could complete the piece before another block is copied.
+	t.mtx.Lock()
+	ok, cancel, complete := t.picker.Received(c.PeerID(), picker.Block(b))
+	if !ok {
+		t.mtx.Unlock()
+		return
+	}
+
+	buf, found := t.buffers[b.Index]
+	if !found {
+		buf = make([]byte, t.metainfo.Info.PieceSize(b.Index))
+		t.buffers[b.Index] = buf
+		t.contributors[b.Index] = make(map[string]bool)
+	}
+	copy(buf[b.Begin:], data)
+	t.contributors[b.Index][connIP(c)] = true
+	contributors := t.contributors[b.Index]
+	if complete {
+		delete(t.buffers, b.Index)
+		delete(t.contributors, b.Index)
+	}
+	t.mtx.Unlock()
+
+	if len(cancel) > 0 {
+		for _, other := range t.getConns() {
+			for _, id := range cancel {
+				if other.PeerID() == id {
+					other.Cancel(b)
+				}
+			}
+		}
+	}
+
+	if complete {
+		t.pieceDone(b.Index, buf, contributors)
+	}
+}
+
+func (t *Torrent) BlockSent(c *peer.Conn, b peer.Block) {
+	t.AddToUploaded(uint64(b.Length))
+}
+
+func (t *Torrent) RequestsDropped(c *peer.Conn, blocks []peer.Block) {
+	for _, b := range blocks {
+		t.picker.Dropped(c.PeerID(), picker.Block(b))
+	}
+}
+
+func (t *Torrent) Closed(c *peer.Conn) {
+	t.mtx.Lock()
+	delete(t.conns, c)
+	delete(t.dialed, c)
+	pex := t.pex
+	t.mtx.Unlock()
+
+	if pex != nil {
+		pex.forget(c)
+	}
+
+	t.picker.PeerLeft(c.PeerID(), c)
+	t.rechoke()
+}
@@ -0,0 +1,75 @@
+package torrent
+
+import (
+	"github.com/yorirou/gotorrent/peer"
+	"log"
+)
+
+func (t *Torrent) sendExtendedHandshake(c *peer.Conn) {
+	eh := peer.NewExtendedHandshake()
+	eh.MetadataSize = len(t.metainfo.Info.Raw)
+	eh.Port = uint16(t.clientConfig.Port)
+	if t.getPEX() == nil {
+		delete(eh.M, peer.ExtPEX)
+	}
+
+	m, err := eh.Message()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	c.Send(m)
+}
+
+func (t *Torrent) Extended(c *peer.Conn, id uint8, payload []byte) {
+	switch int(id) {
+	case peer.LocalExtensions[peer.ExtMetadata]:
+		t.metadataMessage(c, payload)
+	case peer.LocalExtensions[peer.ExtPEX]:
+		if pex := t.getPEX(); pex != nil {
+			pex.received(c, payload)
+		}
+	}
+}
+
+// metadataMessage serves the info dictionary to peers which joined from a
+// magnet link (BEP 9).
+func (t *Torrent) metadataMessage(c *peer.Conn, payload []byte) {
+	mm, err := peer.ParseMetadataMessage(payload)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	if mm.Type != peer.MetadataRequest {
+		return
+	}
+
+	raw := t.metainfo.Info.Raw
+	numPieces := (len(raw) + peer.MetadataPieceSize - 1) / peer.MetadataPieceSize
+
+	// The piece is checked before the multiplication, which overflows for
+	// huge indexes.
+	var resp *peer.MetadataMessage
+	if mm.Piece >= numPieces {
+		resp = peer.NewMetadataReject(mm.Piece)
+	} else {
+		begin := mm.Piece * peer.MetadataPieceSize
+		end := begin + peer.MetadataPieceSize
+		if end > len(raw) {
+			end = len(raw)
+		}
+		resp = peer.NewMetadataData(mm.Piece, len(raw), raw[begin:end])
+	}
+
+	b, err := resp.Encode()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	if err := c.SendExtended(peer.ExtMetadata, b); err != nil {
+		log.Print(err)
+	}
+}
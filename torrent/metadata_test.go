@@ -0,0 +1,129 @@
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/yorirou/gotorrent/client/config"
+	"github.com/yorirou/gotorrent/metadata"
+	"github.com/yorirou/gotorrent/metainfo"
+	"github.com/yorirou/gotorrent/peer"
+	"github.com/yorirou/gotorrent/storage"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServeMetadata(t *testing.T) {
+	// 1000 pieces make the info dictionary longer than one metadata piece.
+	pieces := bytes.Repeat([]byte("01234567890123456789"), 1000)
+	info := []byte(fmt.Sprintf("d6:lengthi%de4:name4:test12:piece lengthi16384e6:pieces%d:%se", 1000*16384, len(pieces), pieces))
+
+	mi, err := metainfo.NewMetainfoFromInfo(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seeder := NewTorrent(mi, config.NewClientConfig())
+	seeder.SetStorage(storage.NewMemoryStorage(&mi.Info))
+	defer seeder.Stop()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			h, err := peer.ReadHandshake(conn)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			peer.WriteHandshake(conn, peer.NewHandshake(h.InfoHash, seeder.clientConfig.PeerID))
+			go seeder.Accept(conn, h)
+		}
+	}()
+
+	fetched, err := metadata.FetchFrom(l.Addr().String(), mi.Info.Hash, config.NewClientConfig().PeerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(fetched, info) {
+		t.Error("fetched metadata differs from the info dictionary")
+	}
+}
+
+func TestServeMetadataInvalidPiece(t *testing.T) {
+	mi, err := metainfo.NewMetainfoFromInfo([]byte("d6:lengthi4e4:name4:test12:piece lengthi4e6:pieces20:01234567890123456789e"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seeder := NewTorrent(mi, config.NewClientConfig())
+	seeder.SetStorage(storage.NewMemoryStorage(&mi.Info))
+	defer seeder.Stop()
+
+	c0, c1 := net.Pipe()
+	defer c1.Close()
+	go seeder.Accept(c0, peer.NewHandshake(mi.Info.Hash, "-GT0000-000000000000"))
+
+	messages := make(chan *peer.Message, 16)
+	go func() {
+		defer close(messages)
+		for {
+			m, err := peer.ReadMessage(c1, peer.DefaultMaxMessageLength)
+			if err != nil {
+				return
+			}
+			messages <- m
+		}
+	}()
+
+	eh := peer.NewExtendedHandshake()
+	m, err := eh.Message()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.WriteMessage(c1, m); err != nil {
+		t.Fatal(err)
+	}
+
+	// The piece after the last one, and one which overflows the offset.
+	for _, piece := range []int{1, 1 << 49} {
+		b, err := peer.NewMetadataRequest(piece).Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := peer.WriteMessage(c1, peer.NewExtended(uint8(peer.LocalExtensions[peer.ExtMetadata]), b)); err != nil {
+			t.Fatal(err)
+		}
+
+		var mm *peer.MetadataMessage
+		for mm == nil {
+			select {
+			case m, ok := <-messages:
+				if !ok {
+					t.Fatal("the connection is closed")
+				}
+				if m.ID == peer.Extended && int(m.ExtendedID) == eh.M[peer.ExtMetadata] {
+					if mm, err = peer.ParseMetadataMessage(m.Payload); err != nil {
+						t.Fatal(err)
+					}
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no answer to the metadata request")
+			}
+		}
+
+		if mm.Type != peer.MetadataReject || mm.Piece != piece {
+			t.Errorf("got message type %d for piece %d, expected a reject for piece %d", mm.Type, mm.Piece, piece)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package torrent
+
+import (
+	"github.com/yorirou/gotorrent/peer"
+	"github.com/yorirou/gotorrent/tracker"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// pexMaxPeers is the number of added and dropped peers sent in a message,
+// and the number of added peers taken from a message.
+const pexMaxPeers = 50
+
+// pexInterval is the time between the pex messages sent on a connection.
+var pexInterval = time.Minute
+
+// EnablePEX exchanges peers with the connected peers which support ut_pex
+// (BEP 11).
+func (t *Torrent) EnablePEX() error {
+	s := newPEXSource(t)
+	if err := t.AddPeerSource(s); err != nil {
+		return err
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.pex = s
+	return nil
+}
+
+func (t *Torrent) getPEX() *pexSource {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return t.pex
+}
+
+// pexPeers returns the listening addresses of the connected peers, except
+// the one of the exclude connection.
+func (t *Torrent) pexPeers(exclude *peer.Conn) map[string]peer.PEXPeer {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	peers := make(map[string]peer.PEXPeer)
+	for c := range t.conns {
+		if c == exclude {
+			continue
+		}
+
+		var p peer.PEXPeer
+		if d, ok := t.dialed[c]; ok {
+			p = peer.PEXPeer{IP: d.IP, Port: d.Port, Flags: peer.PEXOutgoing}
+		} else {
+			// The port of an incoming connection is only known from the
+			// extended handshake.
+			addr, ok := c.RemoteAddr().(*net.TCPAddr)
+			eh := c.ExtendedHandshake()
+			if !ok || eh == nil || eh.Port == 0 {
+				continue
+			}
+			p = peer.PEXPeer{IP: addr.IP, Port: eh.Port}
+		}
+
+		if c.Bitfield().Complete() {
+			p.Flags |= peer.PEXSeed
+		}
+		peers[p.Addr()] = p
+	}
+
+	return peers
+}
+
+type pexConn struct {
+	sent     map[string]peer.PEXPeer
+	received time.Time
+}
+
+// pexSource sends the changes of the connected peers to every connection
+// periodically, and adds the peers received from them to the pool.
+type pexSource struct {
+	torrent  *Torrent
+	interval time.Duration
+	found    chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	mtx   sync.Mutex
+	conns map[*peer.Conn]*pexConn
+}
+
+func newPEXSource(t *Torrent) *pexSource {
+	s := new(pexSource)
+	s.torrent = t
+	s.interval = pexInterval
+	s.found = make(chan struct{}, 1)
+	s.stop = make(chan struct{})
+	s.conns = make(map[*peer.Conn]*pexConn)
+	return s
+}
+
+func (s *pexSource) Start() {
+	go s.run()
+}
+
+func (s *pexSource) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+}
+
+func (s *pexSource) Found() <-chan struct{} {
+	return s.found
+}
+
+func (s *pexSource) run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			for _, c := range s.torrent.getConns() {
+				s.send(c)
+			}
+		}
+	}
+}
+
+func (s *pexSource) conn(c *peer.Conn) *pexConn {
+	pc, ok := s.conns[c]
+	if !ok {
+		pc = &pexConn{sent: make(map[string]peer.PEXPeer)}
+		s.conns[c] = pc
+	}
+
+	return pc
+}
+
+func (s *pexSource) send(c *peer.Conn) {
+	eh := c.ExtendedHandshake()
+	if eh == nil || eh.M[peer.ExtPEX] == 0 {
+		return
+	}
+
+	pm := s.message(c)
+	if pm == nil {
+		return
+	}
+
+	b, err := pm.Encode()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	c.SendExtended(peer.ExtPEX, b)
+}
+
+// message returns the peers connected and disconnected since the last
+// message on the connection, or nil if nothing changed.
+func (s *pexSource) message(c *peer.Conn) *peer.PEXMessage {
+	current := s.torrent.pexPeers(c)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	pc := s.conn(c)
+	pm := new(peer.PEXMessage)
+
+	for addr, p := range current {
+		if len(pm.Added) == pexMaxPeers {
+			break
+		}
+		if _, ok := pc.sent[addr]; !ok {
+			pm.Added = append(pm.Added, p)
+			pc.sent[addr] = p
+		}
+	}
+
+	for addr, p := range pc.sent {
+		if len(pm.Dropped) == pexMaxPeers {
+			break
+		}
+		if _, ok := current[addr]; !ok {
+			pm.Dropped = append(pm.Dropped, p)
+			delete(pc.sent, addr)
+		}
+	}
+
+	if len(pm.Added) == 0 && len(pm.Dropped) == 0 {
+		return nil
+	}
+
+	return pm
+}
+
+// received adds the peers of a pex message to the pool. Messages sent more
+// often than the half of the interval are ignored.
+func (s *pexSource) received(c *peer.Conn, payload []byte) {
+	pm, err := peer.ParsePEXMessage(payload)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	s.mtx.Lock()
+	pc := s.conn(c)
+	now := time.Now()
+	flood := !pc.received.IsZero() && now.Sub(pc.received) < s.interval/2
+	if !flood {
+		pc.received = now
+	}
+	s.mtx.Unlock()
+
+	if flood {
+		return
+	}
+
+	added := pm.Added
+	if len(added) > pexMaxPeers {
+		added = added[:pexMaxPeers]
+	}
+	for _, p := range added {
+		s.torrent.peers.Add(&tracker.Peer{IP: p.IP, Port: p.Port})
+	}
+
+	if len(added) > 0 {
+		select {
+		case s.found <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *pexSource) forget(c *peer.Conn) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	delete(s.conns, c)
+}
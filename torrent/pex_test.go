@@ -0,0 +1,149 @@
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/yorirou/gotorrent/client/config"
+	"github.com/yorirou/gotorrent/peer"
+	"github.com/yorirou/gotorrent/storage"
+	"github.com/yorirou/gotorrent/tracker"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPEXPrivate(t *testing.T) {
+	mi := testMetainfo(4, map[string][]byte{"a": []byte("aaaa")}, "a")
+	mi.Info.Private = 1
+	tr := NewTorrent(mi, config.NewClientConfig())
+
+	if err := tr.EnablePEX(); err != ErrPrivate {
+		t.Errorf("got error %v, expected %v", err, ErrPrivate)
+	}
+	if tr.getPEX() != nil {
+		t.Error("pex is enabled for a private torrent")
+	}
+}
+
+func TestPEXMessages(t *testing.T) {
+	mi := testMetainfo(4, map[string][]byte{"a": []byte("aaaa")}, "a")
+	tr := NewTorrent(mi, config.NewClientConfig())
+	if err := tr.EnablePEX(); err != nil {
+		t.Fatal(err)
+	}
+	s := tr.getPEX()
+
+	c0, c1 := net.Pipe()
+	defer c0.Close()
+	defer c1.Close()
+	conn0 := peer.NewConn(c0, "-GT0000-000000000000", 1, tr)
+	conn1 := peer.NewConn(c1, "-GT0000-111111111111", 1, tr)
+
+	tr.conns[conn0] = true
+	tr.conns[conn1] = true
+	tr.dialed[conn1] = &tracker.Peer{IP: net.ParseIP("10.0.0.1"), Port: 6881}
+
+	pm := s.message(conn0)
+	if pm == nil || len(pm.Added) != 1 || pm.Added[0].Addr() != "10.0.0.1:6881" || pm.Added[0].Flags != peer.PEXOutgoing {
+		t.Fatalf("invalid first message: %+v", pm)
+	}
+
+	if pm := s.message(conn0); pm != nil {
+		t.Errorf("got %+v without changes, expected nothing", pm)
+	}
+
+	delete(tr.conns, conn1)
+	pm = s.message(conn0)
+	if pm == nil || len(pm.Added) != 0 || len(pm.Dropped) != 1 || pm.Dropped[0].Addr() != "10.0.0.1:6881" {
+		t.Errorf("invalid message after a disconnect: %+v", pm)
+	}
+}
+
+func TestPEXReceiveLimits(t *testing.T) {
+	mi := testMetainfo(4, map[string][]byte{"a": []byte("aaaa")}, "a")
+	tr := NewTorrent(mi, config.NewClientConfig())
+	if err := tr.EnablePEX(); err != nil {
+		t.Fatal(err)
+	}
+	s := tr.getPEX()
+
+	c0, c1 := net.Pipe()
+	defer c0.Close()
+	defer c1.Close()
+	conn := peer.NewConn(c0, "-GT0000-000000000000", 1, tr)
+
+	pm := new(peer.PEXMessage)
+	for i := 0; i < pexMaxPeers+10; i++ {
+		pm.Added = append(pm.Added, peer.PEXPeer{IP: net.IPv4(10, 0, byte(i>>8), byte(i)), Port: 6881})
+	}
+	b, err := pm.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.received(conn, b)
+	if n := len(tr.peers.GetPeers()); n != pexMaxPeers {
+		t.Errorf("got %d peers, expected %d", n, pexMaxPeers)
+	}
+
+	// The next message comes too early.
+	pm.Added = []peer.PEXPeer{{IP: net.IPv4(10, 1, 0, 1), Port: 6881}}
+	b, err = pm.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.received(conn, b)
+	if n := len(tr.peers.GetPeers()); n != pexMaxPeers {
+		t.Errorf("got %d peers after a flood, expected %d", n, pexMaxPeers)
+	}
+}
+
+func TestPEXExchange(t *testing.T) {
+	defer func(d time.Duration) { pexInterval = d }(pexInterval)
+	pexInterval = 50 * time.Millisecond
+
+	files := map[string][]byte{"a": bytes.Repeat([]byte("abcdefgh"), 5000)}
+	mi := testMetainfo(16384, files, "a")
+
+	seeder, ls := startTestSeeder(t, mi, files["a"], "127.0.0.1:0")
+	defer ls.Close()
+	defer seeder.Stop()
+	seederAddr := ls.Addr().(*net.TCPAddr)
+
+	// a is connected to the seeder, b only knows a.
+	a := NewTorrent(mi, config.NewClientConfig())
+	a.SetStorage(storage.NewMemoryStorage(&mi.Info))
+	if err := a.EnablePEX(); err != nil {
+		t.Fatal(err)
+	}
+	la := serveTestTorrent(t, a, "127.0.0.1:0")
+	defer la.Close()
+	defer a.Stop()
+	aAddr := la.Addr().(*net.TCPAddr)
+	a.clientConfig.Port = uint64(aAddr.Port)
+	a.peers.Add(&tracker.Peer{IP: seederAddr.IP, Port: uint16(seederAddr.Port)})
+	if err := a.Download(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewTorrent(mi, config.NewClientConfig())
+	b.SetStorage(storage.NewMemoryStorage(&mi.Info))
+	if err := b.EnablePEX(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop()
+	b.peers.Add(&tracker.Peer{IP: aAddr.IP, Port: uint16(aAddr.Port)})
+	go b.Download()
+
+	expected := fmt.Sprintf("127.0.0.1:%d", seederAddr.Port)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, p := range b.peers.GetPeers() {
+			if p.Addr() == expected {
+				return
+			}
+		}
+	}
+
+	t.Errorf("the seeder is not received through pex, got peers %v", b.peers.GetPeers())
+}
@@ -0,0 +1,104 @@
+package torrent
+
+import (
+	"github.com/yorirou/gotorrent/peer"
+	"github.com/yorirou/gotorrent/util"
+	"log"
+	"net"
+)
+
+func connIP(c *peer.Conn) string {
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return c.RemoteAddr().String()
+	}
+
+	return host
+}
+
+// Bitfield returns the set of pieces which passed the hash check.
+func (t *Torrent) Bitfield() *util.Bitfield {
+	return t.bitfield
+}
+
+// SetPieceFailedHandler registers a function which is called with the
+// addresses of the peers which sent blocks of a piece failing the hash check.
+func (t *Torrent) SetPieceFailedHandler(f func(index uint32, peers []string)) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.pieceFailedHandler = f
+}
+
+// Ban disconnects the peers with the given address and refuses connections
+// to them.
+func (t *Torrent) Ban(ip string) {
+	t.mtx.Lock()
+	t.banned[ip] = true
+	t.mtx.Unlock()
+
+	for _, c := range t.getConns() {
+		if connIP(c) == ip {
+			c.Close()
+		}
+	}
+}
+
+func (t *Torrent) Banned(ip string) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return t.banned[ip]
+}
+
+func (t *Torrent) pieceDone(index uint32, data []byte, contributors map[string]bool) {
+	if !t.metainfo.Info.VerifyPiece(index, data) {
+		t.pieceFailed(index, contributors)
+		return
+	}
+
+	if _, err := t.storage.WriteAt(data, index, 0); err != nil {
+		log.Print(err)
+		t.picker.PieceFailed(index)
+		return
+	}
+
+	t.setVerified(index)
+	if t.bitfield.Complete() {
+		t.announcer.Completed()
+	}
+
+	for _, c := range t.getConns() {
+		c.Send(peer.NewHave(index))
+		c.SetInterested(t.picker.Interesting(c))
+	}
+}
+
+func (t *Torrent) setVerified(index uint32) {
+	t.bitfield.Set(index)
+	t.picker.PieceVerified(index)
+	if t.bitfield.Complete() {
+		t.doneOnce.Do(func() {
+			close(t.done)
+		})
+	}
+}
+
+func (t *Torrent) pieceFailed(index uint32, contributors map[string]bool) {
+	t.picker.PieceFailed(index)
+
+	peers := make([]string, 0, len(contributors))
+	for ip := range contributors {
+		peers = append(peers, ip)
+	}
+
+	log.Printf("piece %d failed the hash check, contributors: %v", index, peers)
+
+	t.mtx.Lock()
+	f := t.pieceFailedHandler
+	t.mtx.Unlock()
+
+	if f != nil {
+		f(index, peers)
+	}
+}
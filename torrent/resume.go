@@ -0,0 +1,171 @@
+package torrent
+
+import (
+	"errors"
+	"github.com/yorirou/gotorrent/bencode"
+	"github.com/yorirou/gotorrent/storage"
+	"github.com/yorirou/gotorrent/tracker"
+	"github.com/yorirou/gotorrent/util"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// ResumeData is the saved progress of a torrent. The file sizes and
+// modification times tell which pieces have to be checked again on load.
+type ResumeData struct {
+	InfoHash   string
+	Bitfield   []byte
+	Files      []ResumeFile
+	Uploaded   uint64
+	Downloaded uint64
+	Peers      []string
+}
+
+type ResumeFile struct {
+	Path    string
+	Size    int64
+	ModTime int64
+}
+
+func (t *Torrent) SetResumeFile(path string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.resumeFile = path
+}
+
+func (t *Torrent) ResumeFile() string {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return t.resumeFile
+}
+
+func (t *Torrent) SaveResume(path string) error {
+	rd := new(ResumeData)
+	rd.InfoHash = t.metainfo.Info.Hash
+	rd.Bitfield = t.bitfield.Bytes()
+	rd.Uploaded = t.Uploaded()
+	rd.Downloaded = t.Downloaded()
+
+	if t.storage != nil {
+		if err := t.storage.Flush(); err != nil {
+			return err
+		}
+
+		if fs, ok := t.storage.(storage.FileStatter); ok {
+			for _, st := range fs.Stat() {
+				rd.Files = append(rd.Files, ResumeFile{st.Path, st.Size, st.ModTime})
+			}
+		}
+	}
+
+	for _, p := range t.peers.GetPeers() {
+		rd.Peers = append(rd.Peers, p.Addr())
+	}
+
+	b, err := bencode.Marshal(rd)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// LoadResume restores the progress saved by SaveResume. Pieces of files which
+// changed since then are checked against their hashes.
+func (t *Torrent) LoadResume(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	rd := new(ResumeData)
+	if err := bencode.Unmarshal(b, rd); err != nil {
+		return err
+	}
+
+	if rd.InfoHash != t.metainfo.Info.Hash {
+		return errors.New("resume data belongs to another torrent")
+	}
+
+	saved, err := util.NewBitfieldFromBytes(rd.Bitfield, t.metainfo.Info.NumPieces())
+	if err != nil {
+		return err
+	}
+
+	recheck := make(map[uint32]bool)
+	if fs, ok := t.storage.(storage.FileStatter); ok {
+		files := make(map[string]ResumeFile)
+		for _, f := range rd.Files {
+			files[f.Path] = f
+		}
+
+		for _, st := range fs.Stat() {
+			if f, ok := files[st.Path]; ok && f.Size == st.Size && f.ModTime == st.ModTime {
+				continue
+			}
+
+			for _, index := range t.filePieces(st) {
+				recheck[index] = true
+			}
+		}
+	}
+
+	for i := uint32(0); i < saved.Len(); i++ {
+		if recheck[i] {
+			if t.checkPiece(i) {
+				t.setVerified(i)
+			}
+		} else if saved.Has(i) {
+			t.setVerified(i)
+		}
+	}
+
+	t.AddToUploaded(rd.Uploaded)
+	t.AddToDownloaded(rd.Downloaded)
+
+	for _, addr := range rd.Peers {
+		p, err := tracker.ParsePeer(addr)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		t.peers.Add(p)
+	}
+
+	return nil
+}
+
+func (t *Torrent) filePieces(st storage.FileStat) []uint32 {
+	if st.Length == 0 {
+		return nil
+	}
+
+	pl := t.metainfo.Info.PieceLength
+	first := uint32(st.Offset / pl)
+	last := uint32((st.Offset + st.Length - 1) / pl)
+
+	pieces := make([]uint32, 0, last-first+1)
+	for i := first; i <= last; i++ {
+		pieces = append(pieces, i)
+	}
+
+	return pieces
+}
+
+func (t *Torrent) checkPiece(index uint32) bool {
+	buf := make([]byte, t.metainfo.Info.PieceSize(index))
+	if _, err := t.storage.ReadAt(buf, index, 0); err != nil {
+		return false
+	}
+
+	return t.metainfo.Info.VerifyPiece(index, buf)
+}
@@ -0,0 +1,113 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"github.com/yorirou/gotorrent/client/config"
+	"github.com/yorirou/gotorrent/metainfo"
+	"github.com/yorirou/gotorrent/storage"
+	"github.com/yorirou/gotorrent/tracker"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testMetainfo(pieceLength uint64, files map[string][]byte, order ...string) *metainfo.Metainfo {
+	mi := new(metainfo.Metainfo)
+	mi.Info.Hash = "12345678901234567890"
+	mi.Info.Name = "test"
+	mi.Info.PieceLength = pieceLength
+
+	data := make([]byte, 0)
+	for _, name := range order {
+		mi.Info.Files = append(mi.Info.Files, metainfo.File{Length: uint64(len(files[name])), Path: []string{name}})
+		data = append(data, files[name]...)
+	}
+
+	for i := uint64(0); i < uint64(len(data)); i += pieceLength {
+		end := i + pieceLength
+		if end > uint64(len(data)) {
+			end = uint64(len(data))
+		}
+		hash := sha1.Sum(data[i:end])
+		mi.Info.Pieces = append(mi.Info.Pieces, hash[:]...)
+	}
+
+	return mi
+}
+
+func newTestTorrent(t *testing.T, mi *metainfo.Metainfo, dir string) *Torrent {
+	s, err := storage.NewFileStorage(&mi.Info, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := NewTorrent(mi, config.NewClientConfig())
+	tr.SetStorage(s)
+
+	return tr
+}
+
+func TestResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotorrent-resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string][]byte{
+		"a": []byte("aaaaaaaa"),
+		"b": []byte("bbbbbbbb"),
+	}
+	mi := testMetainfo(4, files, "a", "b")
+
+	t0 := newTestTorrent(t, mi, dir)
+	for i, piece := range []string{"aaaa", "aaaa", "bbbb"} {
+		if _, err := t0.storage.WriteAt([]byte(piece), uint32(i), 0); err != nil {
+			t.Fatal(err)
+		}
+		t0.setVerified(uint32(i))
+	}
+	t0.AddToDownloaded(12)
+	t0.peers.Add(&tracker.Peer{IP: net.ParseIP("127.0.0.1"), Port: 6881})
+
+	resumefile := filepath.Join(dir, "test.resume")
+	if err := t0.SaveResume(resumefile); err != nil {
+		t.Fatal(err)
+	}
+	t0.storage.Close()
+
+	t1 := newTestTorrent(t, mi, dir)
+	if err := t1.LoadResume(resumefile); err != nil {
+		t.Fatal(err)
+	}
+
+	if t1.Completed() != 3 || !t1.Bitfield().Has(2) || t1.Bitfield().Has(3) {
+		t.Errorf("invalid bitfield after resume: %x", t1.Bitfield().Bytes())
+	}
+
+	if t1.Downloaded() != 12 {
+		t.Errorf("invalid downloaded value, got %d, expected 12", t1.Downloaded())
+	}
+
+	if peers := t1.peers.GetPeers(); len(peers) != 1 || peers[0].IP.String() != "127.0.0.1" || peers[0].Port != 6881 {
+		t.Errorf("invalid peers after resume: %v", peers)
+	}
+	t1.storage.Close()
+
+	// Corrupt the first file, only its pieces should be checked again.
+	if err := ioutil.WriteFile(filepath.Join(dir, "test", "a"), []byte("aaaaxxxx"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t2 := newTestTorrent(t, mi, dir)
+	defer t2.storage.Close()
+	if err := t2.LoadResume(resumefile); err != nil {
+		t.Fatal(err)
+	}
+
+	if !t2.Bitfield().Has(0) || t2.Bitfield().Has(1) || !t2.Bitfield().Has(2) {
+		t.Errorf("invalid bitfield after changing a file: %x", t2.Bitfield().Bytes())
+	}
+}
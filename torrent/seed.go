@@ -0,0 +1,93 @@
+package torrent
+
+import (
+	"errors"
+	"github.com/yorirou/gotorrent/choker"
+	"github.com/yorirou/gotorrent/peer"
+	"time"
+)
+
+const (
+	reconnectInterval = 5 * time.Minute
+)
+
+// Seed serves the pieces of the torrent to other peers until stop is
+// closed. It keeps the peer sources running and connects to the peers they
+// find.
+func (t *Torrent) Seed(stop <-chan struct{}) error {
+	if t.storage == nil {
+		return errors.New("no storage is set")
+	}
+
+	t.startChoker()
+	t.startSources()
+
+	ticker := time.NewTicker(reconnectInterval)
+	defer ticker.Stop()
+
+	for {
+		t.connectPeers()
+
+		select {
+		case <-stop:
+			return t.Stop()
+		case <-t.found:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *Torrent) ReadBlock(c *peer.Conn, b peer.Block) ([]byte, error) {
+	if !t.bitfield.Has(b.Index) {
+		return nil, errors.New("requested piece is not available")
+	}
+
+	// A block past the end of the piece would be read from the next pieces.
+	if uint64(b.Begin)+uint64(b.Length) > t.metainfo.Info.PieceSize(b.Index) {
+		return nil, errors.New("requested block is out of the piece")
+	}
+
+	data := make([]byte, b.Length)
+	if _, err := t.storage.ReadAt(data, b.Index, b.Begin); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (t *Torrent) PeerInterestChanged(c *peer.Conn) {
+	t.rechoke()
+}
+
+func (t *Torrent) chokerPeers() []choker.Peer {
+	conns := t.getConns()
+	peers := make([]choker.Peer, len(conns))
+	for i, c := range conns {
+		peers[i] = c
+	}
+
+	return peers
+}
+
+func (t *Torrent) rechoke() {
+	t.choker.Rechoke(t.chokerPeers(), t.bitfield.Complete())
+}
+
+// startChoker runs the choker until the torrent is stopped.
+func (t *Torrent) startChoker() {
+	t.chokerOnce.Do(func() {
+		go func() {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-t.stopped:
+					return
+				case <-ticker.C:
+					t.choker.Tick(t.chokerPeers(), t.bitfield.Complete())
+				}
+			}
+		}()
+	})
+}
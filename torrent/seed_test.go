@@ -0,0 +1,214 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"github.com/yorirou/gotorrent/client/config"
+	"github.com/yorirou/gotorrent/metainfo"
+	"github.com/yorirou/gotorrent/mse"
+	"github.com/yorirou/gotorrent/peer"
+	"github.com/yorirou/gotorrent/storage"
+	"github.com/yorirou/gotorrent/tracker"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDownloadFromSeeder(t *testing.T) {
+	testDownloadFromSeeder(t, "127.0.0.1:0")
+}
+
+func TestDownloadFromSeederIPv6(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 is not available: ", err)
+	}
+	l.Close()
+
+	testDownloadFromSeeder(t, "[::1]:0")
+}
+
+// startTestSeeder seeds data on laddr, the returned listener has to be
+// closed.
+func startTestSeeder(t *testing.T, mi *metainfo.Metainfo, data []byte, laddr string) (*Torrent, net.Listener) {
+	seeder := newTestSeeder(t, mi, data, config.NewClientConfig())
+	return seeder, serveTestTorrent(t, seeder, laddr)
+}
+
+func newTestSeeder(t *testing.T, mi *metainfo.Metainfo, data []byte, cc *config.ClientConfig) *Torrent {
+	seeder := NewTorrent(mi, cc)
+	seeder.SetStorage(storage.NewMemoryStorage(&mi.Info))
+	for i := uint32(0); i < mi.Info.NumPieces(); i++ {
+		offset := uint64(i) * mi.Info.PieceLength
+		seeder.storage.WriteAt(data[offset:offset+mi.Info.PieceSize(i)], i, 0)
+	}
+	if _, err := seeder.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	return seeder
+}
+
+// serveTestTorrent accepts the connections of the torrent on laddr, the
+// encrypted ones too unless the encryption is disabled.
+func serveTestTorrent(t *testing.T, tr *Torrent, laddr string) net.Listener {
+	l, err := net.Listen("tcp", laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				c, plaintext, err := mse.Sniff(conn)
+				if err == nil && !plaintext {
+					if tr.clientConfig.Encryption == config.EncryptionDisabled {
+						err = errors.New("encrypted connection refused")
+					} else {
+						c, _, err = mse.Accept(c, []string{tr.metainfo.Info.Hash}, tr.clientConfig.Encryption.Methods())
+					}
+				}
+				if err != nil {
+					conn.Close()
+					return
+				}
+
+				h, err := peer.ReadHandshake(c)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				peer.WriteHandshake(c, tr.Handshake())
+				tr.Accept(c, h)
+			}(conn)
+		}
+	}()
+
+	return l
+}
+
+func TestDownloadEncryption(t *testing.T) {
+	files := map[string][]byte{"a": bytes.Repeat([]byte("abcdefgh"), 5000)}
+	mi := testMetainfo(16384, files, "a")
+
+	for _, test := range []struct {
+		leecher, seeder config.Encryption
+		ok              bool
+	}{
+		{config.EncryptionRequire, config.EncryptionPrefer, true},
+		// Falls back to plaintext.
+		{config.EncryptionPrefer, config.EncryptionDisabled, true},
+		{config.EncryptionRequire, config.EncryptionDisabled, false},
+	} {
+		cc := config.NewClientConfig()
+		cc.Encryption = test.seeder
+		seeder := newTestSeeder(t, mi, files["a"], cc)
+		l := serveTestTorrent(t, seeder, "127.0.0.1:0")
+
+		cc = config.NewClientConfig()
+		cc.Encryption = test.leecher
+		leecher := NewTorrent(mi, cc)
+		leecher.SetStorage(storage.NewMemoryStorage(&mi.Info))
+		addr := l.Addr().(*net.TCPAddr)
+		leecher.peers.Add(&tracker.Peer{IP: addr.IP, Port: uint16(addr.Port)})
+
+		// Download waits for other peers when the handshake fails.
+		errc := make(chan error, 1)
+		go func() {
+			errc <- leecher.Download()
+		}()
+		var err error
+		select {
+		case err = <-errc:
+		case <-time.After(2 * time.Second):
+			leecher.Stop()
+			err = <-errc
+		}
+		if (err == nil) != test.ok {
+			t.Errorf("leecher %d, seeder %d: got error %v", test.leecher, test.seeder, err)
+		}
+
+		leecher.Stop()
+		seeder.Stop()
+		l.Close()
+	}
+}
+
+func TestReadBlockBounds(t *testing.T) {
+	files := map[string][]byte{"a": bytes.Repeat([]byte("abcdefgh"), 6000)}
+	mi := testMetainfo(32768, files, "a")
+	seeder := newTestSeeder(t, mi, files["a"], config.NewClientConfig())
+
+	for _, test := range []struct {
+		index, begin, length uint32
+		ok                   bool
+	}{
+		{0, 0, 16384, true},
+		{0, 16384, 16384, true},
+		{1, 0, 15232, true},
+		// Past the end of the piece, into the next one.
+		{0, 32768 - 10, 16384, false},
+		{1, 16384, 16384, false},
+		{0, 0xffffffff, 16384, false},
+		{0, 0, 16385, true},
+		{0, 0, 32768, true},
+		{2, 0, 16384, false},
+	} {
+		b := peer.Block{Index: test.index, Begin: test.begin, Length: test.length}
+		data, err := seeder.ReadBlock(nil, b)
+		if (err == nil) != test.ok {
+			t.Errorf("%v: got error %v", b, err)
+		}
+		if err == nil && uint32(len(data)) != b.Length {
+			t.Errorf("%v: got %d bytes, expected %d", b, len(data), b.Length)
+		}
+	}
+}
+
+func testDownloadFromSeeder(t *testing.T, laddr string) {
+	files := map[string][]byte{
+		"a": bytes.Repeat([]byte("abcdefgh"), 10000),
+		"b": bytes.Repeat([]byte("12345678"), 3000),
+	}
+	mi := testMetainfo(32768, files, "a", "b")
+	data := append(append([]byte{}, files["a"]...), files["b"]...)
+
+	seeder, l := startTestSeeder(t, mi, data, laddr)
+	defer l.Close()
+
+	leecher := NewTorrent(mi, config.NewClientConfig())
+	ls := storage.NewMemoryStorage(&mi.Info)
+	leecher.SetStorage(ls)
+
+	addr := l.Addr().(*net.TCPAddr)
+	leecher.peers.Add(&tracker.Peer{IP: addr.IP, Port: uint16(addr.Port)})
+
+	if err := leecher.Download(); err != nil {
+		t.Fatal(err)
+	}
+	defer leecher.Stop()
+	defer seeder.Stop()
+
+	downloaded := make([]byte, len(data))
+	for i := uint32(0); i < mi.Info.NumPieces(); i++ {
+		offset := uint64(i) * mi.Info.PieceLength
+		ls.ReadAt(downloaded[offset:offset+mi.Info.PieceSize(i)], i, 0)
+	}
+
+	if !bytes.Equal(downloaded, data) {
+		t.Error("downloaded data differs from the seeded data")
+	}
+
+	if leecher.Left() != 0 {
+		t.Errorf("invalid left value, got %d, expected 0", leecher.Left())
+	}
+
+	if leecher.Downloaded() != uint64(len(data)) {
+		t.Errorf("invalid downloaded value, got %d, expected %d", leecher.Downloaded(), len(data))
+	}
+}
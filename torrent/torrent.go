@@ -1,30 +1,110 @@
 package torrent
 
 import (
+	"github.com/yorirou/gotorrent/choker"
 	"github.com/yorirou/gotorrent/client/config"
+	"github.com/yorirou/gotorrent/dht"
 	"github.com/yorirou/gotorrent/metainfo"
+	"github.com/yorirou/gotorrent/peer"
+	"github.com/yorirou/gotorrent/picker"
+	"github.com/yorirou/gotorrent/storage"
 	"github.com/yorirou/gotorrent/tracker"
+	"github.com/yorirou/gotorrent/util"
+	"math/rand"
+	"sync"
+	"time"
 )
 
+// ConnLimiter limits the connections of the client, it is shared by the
+// torrents.
+type ConnLimiter interface {
+	// AcquireConn reserves a connection, it returns false if the limit is
+	// reached. It is called with the lock of the torrent held.
+	AcquireConn() bool
+	ReleaseConn()
+}
+
 type Torrent struct {
-	metainfo   *metainfo.Metainfo
-	uploaded   uint64
-	downloaded uint64
-	seeders    uint32
-	leechers   uint32
-	peers      *tracker.PeerPool
-	trackers   *tracker.TrackerClientCollection
+	metainfo     *metainfo.Metainfo
+	clientConfig *config.ClientConfig
+	uploaded     *util.Counter
+	downloaded   *util.Counter
+	peers        *tracker.PeerPool
+	announcer    *tracker.Announcer
+	dht          *dht.DHT
+	pex          *pexSource
+	storage      storage.Storage
+	picker       *picker.Picker
+	choker       *choker.Choker
+
+	bitfield *util.Bitfield
+
+	mtx                sync.Mutex
+	conns              map[*peer.Conn]bool
+	dialed             map[*peer.Conn]*tracker.Peer
+	dialing            map[string]bool
+	buffers            map[uint32][]byte
+	contributors       map[uint32]map[string]bool
+	banned             map[string]bool
+	pieceFailedHandler func(index uint32, peers []string)
+	connLimiter        ConnLimiter
+	resumeFile         string
+	sources            []PeerSource
+	sourcesOnce        sync.Once
+	found              chan struct{}
+	done               chan struct{}
+	doneOnce           sync.Once
+	stopped            chan struct{}
+	stopOnce           sync.Once
+	chokerOnce         sync.Once
 }
 
 func NewTorrent(mi *metainfo.Metainfo, cc *config.ClientConfig) *Torrent {
 	t := new(Torrent)
 	t.metainfo = mi
-	t.trackers = tracker.NewTrackerClientCollection(mi, cc)
+	t.clientConfig = cc
+	t.uploaded = util.NewCounter()
+	t.downloaded = util.NewCounter()
+	t.peers = tracker.NewPeerPool()
+	t.announcer = tracker.NewAnnouncer(tracker.NewTrackerClientCollection(mi, cc), t, t.peers)
+	t.sources = []PeerSource{trackerSource{t.announcer}}
+	t.found = make(chan struct{}, 1)
+	t.conns = make(map[*peer.Conn]bool)
+	t.dialed = make(map[*peer.Conn]*tracker.Peer)
+	t.dialing = make(map[string]bool)
+	t.buffers = make(map[uint32][]byte)
+	t.contributors = make(map[uint32]map[string]bool)
+	t.banned = make(map[string]bool)
+	t.bitfield = util.NewBitfield(mi.Info.NumPieces())
+	t.picker = picker.NewPicker(mi.Info.NumPieces(), mi.Info.PieceLength, mi.Info.TotalLength(),
+		picker.NewDefaultStrategy(rand.New(rand.NewSource(time.Now().UnixNano()))))
+	t.choker = choker.NewChoker(cc.UploadSlots, choker.RealClock, rand.New(rand.NewSource(time.Now().UnixNano())))
+	t.done = make(chan struct{})
+	t.stopped = make(chan struct{})
 	return t
 }
 
-func (t *Torrent) RequestPeers() {
-	t.seeders, t.leechers, t.peers = t.trackers.RequestPeers(t.downloaded, t.uploaded, t.Left())
+// Announce announces to the trackers without waiting for the next
+// scheduled announce.
+func (t *Torrent) Announce() {
+	t.announcer.Announce()
+}
+
+func (t *Torrent) TrackerStatus() tracker.AnnounceStatus {
+	return t.announcer.Status()
+}
+
+func (t *Torrent) SetStorage(s storage.Storage) {
+	t.storage = s
+}
+
+// SetConnLimiter makes the outgoing connections count against the limit of
+// the client.
+func (t *Torrent) SetConnLimiter(l ConnLimiter) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.connLimiter = l
 }
 
 func (t *Torrent) GetMetaInfo() *metainfo.Metainfo {
@@ -32,29 +112,36 @@ func (t *Torrent) GetMetaInfo() *metainfo.Metainfo {
 }
 
 func (t *Torrent) Left() uint64 {
-	return t.metainfo.Length - t.downloaded
+	left := t.metainfo.Info.TotalLength()
+	for i := uint32(0); i < t.bitfield.Len(); i++ {
+		if t.bitfield.Has(i) {
+			left -= t.metainfo.Info.PieceSize(i)
+		}
+	}
+
+	return left
 }
 
 func (t *Torrent) ResetUploaded() {
-	t.uploaded = 0
+	t.uploaded.Reset()
 }
 
 func (t *Torrent) ResetDownloaded() {
-	t.downloaded = 0
+	t.downloaded.Reset()
 }
 
 func (t *Torrent) AddToUploaded(bytes uint64) {
-	t.uploaded += bytes
+	t.uploaded.Add(bytes)
 }
 
 func (t *Torrent) AddToDownloaded(bytes uint64) {
-	t.downloaded += bytes
+	t.downloaded.Add(bytes)
 }
 
 func (t *Torrent) Uploaded() uint64 {
-	return t.uploaded
+	return t.uploaded.Value()
 }
 
 func (t *Torrent) Downloaded() uint64 {
-	return t.downloaded
+	return t.downloaded.Value()
 }
@@ -1 +1,180 @@
 package torrent
+
+import (
+	"bytes"
+	"github.com/yorirou/gotorrent/client/config"
+	"github.com/yorirou/gotorrent/peer"
+	"github.com/yorirou/gotorrent/storage"
+	"github.com/yorirou/gotorrent/tracker"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConcurrentBlocks delivers the last two blocks of a piece from two
+// connections at the same time, the piece must not fail.
+func TestConcurrentBlocks(t *testing.T) {
+	data := bytes.Repeat([]byte("abcdefgh"), 4096)
+	mi := testMetainfo(uint64(len(data)), map[string][]byte{"a": data}, "a")
+
+	for i := 0; i < 1000; i++ {
+		tr := NewTorrent(mi, config.NewClientConfig())
+		tr.SetStorage(storage.NewMemoryStorage(&mi.Info))
+
+		var mtx sync.Mutex
+		failed := false
+		tr.SetPieceFailedHandler(func(index uint32, peers []string) {
+			mtx.Lock()
+			failed = true
+			mtx.Unlock()
+		})
+
+		conns := make([]*peer.Conn, 2)
+		blocks := make([]peer.Block, 2)
+		for j := range conns {
+			c0, c1 := net.Pipe()
+			defer c0.Close()
+			defer c1.Close()
+
+			conns[j] = peer.NewConn(c0, string(rune('a'+j))+"-GT0000-00000000000", 1, tr)
+			conns[j].Bitfield().Set(0)
+			picked := tr.Blocks(conns[j], 1)
+			if len(picked) != 1 {
+				t.Fatalf("got %d blocks, expected 1", len(picked))
+			}
+			blocks[j] = picked[0]
+		}
+
+		var wg sync.WaitGroup
+		for j := range conns {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				b := blocks[j]
+				tr.BlockReceived(conns[j], b, data[b.Begin:b.Begin+b.Length])
+			}(j)
+		}
+		wg.Wait()
+
+		if failed || !tr.bitfield.Has(0) {
+			t.Fatalf("the piece is not verified in round %d", i)
+		}
+	}
+}
+
+type testLimiter struct {
+	free int
+	mtx  sync.Mutex
+}
+
+func (l *testLimiter) AcquireConn() bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.free == 0 {
+		return false
+	}
+	l.free--
+
+	return true
+}
+
+func (l *testLimiter) ReleaseConn() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.free++
+}
+
+func TestConnLimiter(t *testing.T) {
+	mi := testMetainfo(4, map[string][]byte{"a": []byte("abcd")}, "a")
+	tr := NewTorrent(mi, config.NewClientConfig())
+	tr.SetStorage(storage.NewMemoryStorage(&mi.Info))
+	defer tr.Stop()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	addr := l.Addr().(*net.TCPAddr)
+	tr.peers.Add(&tracker.Peer{IP: addr.IP, Port: uint16(addr.Port)})
+
+	// The client is full, the peer is not dialed.
+	limiter := &testLimiter{free: 0}
+	tr.SetConnLimiter(limiter)
+	tr.connectPeers()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+		t.Fatal("a peer is dialed over the limit of the client")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	limiter.ReleaseConn()
+	tr.connectPeers()
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("the peer is not dialed")
+	}
+
+	if limiter.AcquireConn() {
+		t.Error("the dialed connection is not counted")
+	}
+}
+
+// TestAvailability counts a piece once per peer, however often the peer
+// announces it.
+func TestAvailability(t *testing.T) {
+	mi := testMetainfo(4, map[string][]byte{"a": []byte("abcdefghijkl")}, "a")
+	tr := NewTorrent(mi, config.NewClientConfig())
+	tr.SetStorage(storage.NewMemoryStorage(&mi.Info))
+	defer tr.Stop()
+
+	c0, c1 := net.Pipe()
+	defer c1.Close()
+	go tr.Accept(c0, peer.NewHandshake(mi.Info.Hash, "-GT0000-000000000000"))
+	go func() {
+		for {
+			if _, err := peer.ReadMessage(c1, peer.DefaultMaxMessageLength); err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, m := range []*peer.Message{
+		peer.NewHave(0),
+		peer.NewHave(0),
+		peer.NewBitfield([]byte{0xc0}),
+		peer.NewHave(2),
+	} {
+		if err := peer.WriteMessage(c1, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []int{1, 1, 1}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline) && tr.picker.Availability(2) == 0; {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i, n := range expected {
+		if a := tr.picker.Availability(uint32(i)); a != n {
+			t.Errorf("got availability %d for piece %d, expected %d", a, i, n)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"github.com/yorirou/gotorrent/storage"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type Status int
+
+const (
+	Complete Status = iota
+	Missing
+	Corrupt
+)
+
+func (s Status) String() string {
+	switch s {
+	case Complete:
+		return "complete"
+	case Missing:
+		return "missing"
+	case Corrupt:
+		return "corrupt"
+	}
+
+	return "unknown"
+}
+
+type FileReport struct {
+	Path   string
+	Status Status
+}
+
+type VerifyReport struct {
+	Pieces []Status
+	Files  []FileReport
+}
+
+func (vr *VerifyReport) Count(s Status) int {
+	count := 0
+	for _, ps := range vr.Pieces {
+		if ps == s {
+			count++
+		}
+	}
+
+	return count
+}
+
+// Ranges lists the indexes of the pieces with the status, consecutive
+// indexes are joined into ranges, e.g. "0-3, 7".
+func (vr *VerifyReport) Ranges(s Status) string {
+	ranges := make([]string, 0)
+	for i := 0; i < len(vr.Pieces); i++ {
+		if vr.Pieces[i] != s {
+			continue
+		}
+
+		start := i
+		for i+1 < len(vr.Pieces) && vr.Pieces[i+1] == s {
+			i++
+		}
+
+		if start == i {
+			ranges = append(ranges, strconv.Itoa(i))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", start, i))
+		}
+	}
+
+	return strings.Join(ranges, ", ")
+}
+
+// Verify checks every piece in the storage against its hash, using a worker
+// per CPU, and updates the set of completed pieces accordingly.
+func (t *Torrent) Verify() (*VerifyReport, error) {
+	if t.storage == nil {
+		return nil, errors.New("no storage is set")
+	}
+
+	numPieces := t.metainfo.Info.NumPieces()
+	vr := new(VerifyReport)
+	vr.Pieces = make([]Status, numPieces)
+
+	jobs := make(chan uint32, numPieces)
+	for i := uint32(0); i < numPieces; i++ {
+		jobs <- i
+	}
+	close(jobs)
+
+	var wg sync.WaitGroup
+	workers := runtime.NumCPU()
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				vr.Pieces[index] = t.verifyPiece(index)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, ps := range vr.Pieces {
+		if ps == Complete {
+			t.setVerified(uint32(i))
+		} else {
+			t.bitfield.Clear(uint32(i))
+			t.picker.PieceMissing(uint32(i))
+		}
+	}
+
+	if fs, ok := t.storage.(storage.FileStatter); ok {
+		for _, st := range fs.Stat() {
+			vr.Files = append(vr.Files, FileReport{st.Path, t.fileStatus(st, vr.Pieces)})
+		}
+	}
+
+	return vr, nil
+}
+
+func (t *Torrent) verifyPiece(index uint32) Status {
+	buf := make([]byte, t.metainfo.Info.PieceSize(index))
+	if _, err := t.storage.ReadAt(buf, index, 0); err != nil {
+		return Missing
+	}
+
+	if !t.metainfo.Info.VerifyPiece(index, buf) {
+		return Corrupt
+	}
+
+	return Complete
+}
+
+func (t *Torrent) fileStatus(st storage.FileStat, pieces []Status) Status {
+	if st.Size < 0 {
+		return Missing
+	}
+
+	complete, missing := 0, 0
+	filePieces := t.filePieces(st)
+	for _, index := range filePieces {
+		switch pieces[index] {
+		case Complete:
+			complete++
+		case Missing:
+			missing++
+		}
+	}
+
+	switch {
+	case complete == len(filePieces):
+		return Complete
+	case missing == len(filePieces):
+		return Missing
+	}
+
+	return Corrupt
+}
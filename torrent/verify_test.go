@@ -0,0 +1,107 @@
+package torrent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotorrent-verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string][]byte{
+		"a": []byte("aaaaaaaa"),
+		"b": []byte("bbbbbbbb"),
+		"c": []byte("cc"),
+	}
+	mi := testMetainfo(4, files, "a", "b", "c")
+
+	os.MkdirAll(filepath.Join(dir, "test"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "test", "a"), files["a"], 0644)
+	ioutil.WriteFile(filepath.Join(dir, "test", "b"), []byte("bbbbxxxx"), 0644)
+
+	tr := newTestTorrent(t, mi, dir)
+	defer tr.storage.Close()
+
+	vr, err := tr.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Status{Complete, Complete, Complete, Corrupt, Missing}
+	for i, s := range expected {
+		if vr.Pieces[i] != s {
+			t.Errorf("invalid status of piece %d, got %s, expected %s", i, vr.Pieces[i], s)
+		}
+	}
+
+	expectedFiles := map[string]Status{"a": Complete, "b": Corrupt, "c": Missing}
+	for _, f := range vr.Files {
+		if s := expectedFiles[filepath.Base(f.Path)]; f.Status != s {
+			t.Errorf("invalid status of file %s, got %s, expected %s", f.Path, f.Status, s)
+		}
+	}
+
+	if tr.Completed() != 3 {
+		t.Errorf("invalid number of completed pieces, got %d, expected 3", tr.Completed())
+	}
+
+	if tr.Left() != 6 {
+		t.Errorf("invalid left value, got %d, expected 6", tr.Left())
+	}
+}
+
+func TestVerifyEmptyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotorrent-verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string][]byte{"a": []byte("aaaa"), "empty": {}}
+	mi := testMetainfo(4, files, "a", "empty")
+
+	tr := newTestTorrent(t, mi, dir)
+	defer tr.storage.Close()
+
+	if _, err := tr.storage.WriteAt(files["a"], 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	vr, err := tr.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range vr.Files {
+		if f.Status != Complete {
+			t.Errorf("invalid status of file %s, got %s, expected %s", f.Path, f.Status, Complete)
+		}
+	}
+}
+
+func TestVerifyReportRanges(t *testing.T) {
+	vr := &VerifyReport{Pieces: []Status{Missing, Missing, Complete, Corrupt, Missing, Complete, Missing, Missing, Missing}}
+
+	for _, test := range []struct {
+		status   Status
+		expected string
+	}{
+		{Missing, "0-1, 4, 6-8"},
+		{Corrupt, "3"},
+		{Complete, "2, 5"},
+	} {
+		if r := vr.Ranges(test.status); r != test.expected {
+			t.Errorf("got %s pieces %q, expected %q", test.status, r, test.expected)
+		}
+	}
+
+	if r := (&VerifyReport{Pieces: []Status{Complete}}).Ranges(Corrupt); r != "" {
+		t.Errorf("got %q, expected no pieces", r)
+	}
+}
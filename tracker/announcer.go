@@ -0,0 +1,279 @@
+package tracker
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultInterval  = 30 * time.Minute
+	maxRetryInterval = 30 * time.Minute
+	stopTimeout      = 10 * time.Second
+)
+
+// intervalUnit is the unit of the intervals in the tracker responses.
+var intervalUnit = time.Second
+
+// retryInterval is the delay after the first failed announce; it doubles
+// with every consecutive failure.
+var retryInterval = 15 * time.Second
+
+type Event int
+
+const (
+	EventNone Event = iota
+	EventStarted
+	EventCompleted
+	EventStopped
+)
+
+func (e Event) String() string {
+	switch e {
+	case EventStarted:
+		return "started"
+	case EventCompleted:
+		return "completed"
+	case EventStopped:
+		return "stopped"
+	}
+
+	return ""
+}
+
+// Stats is the source of the transfer statistics sent to the trackers.
+type Stats interface {
+	Downloaded() uint64
+	Uploaded() uint64
+	Left() uint64
+}
+
+// AnnounceStatus is the outcome of the last announce.
+type AnnounceStatus struct {
+	LastAnnounce time.Time
+	NextAnnounce time.Time
+	Interval     time.Duration
+	MinInterval  time.Duration
+	Seeders      uint32
+	Leechers     uint32
+	Failures     int
+	Err          error
+	Warning      string
+}
+
+// Announcer announces a torrent to its trackers periodically, and adds the
+// peers it gets to a peer pool.
+type Announcer struct {
+	trackers  *TrackerClientCollection
+	stats     Stats
+	peers     *PeerPool
+	announced chan struct{}
+	force     chan struct{}
+	stop      chan struct{}
+	finished  chan struct{}
+	startOnce sync.Once
+	stopOnce  sync.Once
+
+	mtx              sync.Mutex
+	status           AnnounceStatus
+	running          bool
+	started          bool
+	completedPending bool
+}
+
+func NewAnnouncer(trackers *TrackerClientCollection, stats Stats, peers *PeerPool) *Announcer {
+	a := new(Announcer)
+	a.trackers = trackers
+	a.stats = stats
+	a.peers = peers
+	a.announced = make(chan struct{}, 1)
+	a.force = make(chan struct{}, 1)
+	a.stop = make(chan struct{})
+	a.finished = make(chan struct{})
+	return a
+}
+
+// Start sends the started event and keeps announcing in the background
+// until Stop is called. Start does not wait for the first announce.
+func (a *Announcer) Start() {
+	a.startOnce.Do(func() {
+		if len(a.trackers.tiers) == 0 {
+			close(a.finished)
+			return
+		}
+
+		a.mtx.Lock()
+		a.running = true
+		a.mtx.Unlock()
+
+		go a.run(0)
+	})
+}
+
+// Stop sends the stopped event if the started event was sent, and ends the
+// announcer.
+func (a *Announcer) Stop() {
+	a.stopOnce.Do(func() {
+		close(a.stop)
+	})
+
+	a.mtx.Lock()
+	running := a.running
+	a.mtx.Unlock()
+
+	if !running {
+		return
+	}
+
+	select {
+	case <-a.finished:
+	case <-time.After(stopTimeout):
+		log.Print("stopped event is not sent in time")
+	}
+}
+
+// Completed sends the completed event as soon as the trackers allow it.
+func (a *Announcer) Completed() {
+	a.mtx.Lock()
+	a.completedPending = true
+	a.mtx.Unlock()
+
+	a.Announce()
+}
+
+// Announce forces an announce without waiting for the interval. The
+// minimum interval of the tracker is still honoured.
+func (a *Announcer) Announce() {
+	select {
+	case a.force <- struct{}{}:
+	default:
+	}
+}
+
+// Announced is signalled after each successful announce.
+func (a *Announcer) Announced() <-chan struct{} {
+	return a.announced
+}
+
+func (a *Announcer) Status() AnnounceStatus {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	return a.status
+}
+
+func (a *Announcer) run(delay time.Duration) {
+	defer close(a.finished)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-a.stop:
+			a.mtx.Lock()
+			started := a.started
+			a.mtx.Unlock()
+
+			if started {
+				a.announce(EventStopped)
+			}
+			return
+		case <-timer.C:
+			resetTimer(timer, a.announce(a.nextEvent()))
+		case <-a.force:
+			a.mtx.Lock()
+			earliest := a.status.LastAnnounce.Add(a.status.MinInterval)
+			failing := a.status.Failures > 0
+			a.mtx.Unlock()
+
+			if wait := earliest.Sub(time.Now()); wait > 0 && !failing {
+				resetTimer(timer, wait)
+			} else {
+				resetTimer(timer, 0)
+			}
+		}
+	}
+}
+
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
+
+func (a *Announcer) nextEvent() Event {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if !a.started {
+		return EventStarted
+	}
+	if a.completedPending {
+		return EventCompleted
+	}
+
+	return EventNone
+}
+
+// announce sends one announce and returns the delay until the next one.
+func (a *Announcer) announce(event Event) time.Duration {
+	r, err := a.trackers.Announce(event, a.stats.Downloaded(), a.stats.Uploaded(), a.stats.Left())
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	now := time.Now()
+	a.status.Err = err
+
+	if err != nil {
+		log.Print("announce failed: ", err)
+
+		delay := retryInterval << uint(a.status.Failures)
+		if delay > maxRetryInterval || delay <= 0 {
+			delay = maxRetryInterval
+		}
+		a.status.Failures++
+		a.status.NextAnnounce = now.Add(delay)
+
+		return delay
+	}
+
+	switch event {
+	case EventStarted:
+		a.started = true
+	case EventCompleted:
+		a.completedPending = false
+	}
+
+	a.status.LastAnnounce = now
+	a.status.Failures = 0
+	a.status.Seeders = r.Seeders()
+	a.status.Leechers = r.Leechers()
+	a.status.Warning = r.WarningMessage
+	a.status.Interval = time.Duration(r.Interval) * intervalUnit
+	a.status.MinInterval = time.Duration(r.MinInterval) * intervalUnit
+	if a.status.Interval <= 0 {
+		a.status.Interval = DefaultInterval
+	}
+	a.status.NextAnnounce = now.Add(a.status.Interval)
+
+	if r.WarningMessage != "" {
+		log.Print("tracker warning: ", r.WarningMessage)
+	}
+
+	for _, p := range r.Peers {
+		a.peers.Add(p)
+	}
+
+	select {
+	case a.announced <- struct{}{}:
+	default:
+	}
+
+	return a.status.Interval
+}
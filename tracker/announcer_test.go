@@ -0,0 +1,154 @@
+package tracker
+
+import (
+	"github.com/yorirou/gotorrent/client/config"
+	"github.com/yorirou/gotorrent/metainfo"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testStats struct{}
+
+func (ts testStats) Downloaded() uint64 { return 0 }
+func (ts testStats) Uploaded() uint64   { return 0 }
+func (ts testStats) Left() uint64       { return 100 }
+
+func newTestAnnouncer(url string) *Announcer {
+	mi := new(metainfo.Metainfo)
+	mi.Announce = url
+
+	return NewAnnouncer(NewTrackerClientCollection(mi, config.NewClientConfig()), testStats{}, NewPeerPool())
+}
+
+func waitForEvents(tt *httpTestTracker, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && len(tt.Events()) < n {
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func waitForEvent(tt *httpTestTracker, event string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, e := range tt.Events() {
+			if e == event {
+				return
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitForStatus waits until the first announce is done.
+func waitForStatus(a *Announcer) AnnounceStatus {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if st := a.Status(); !st.NextAnnounce.IsZero() {
+			return st
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	return a.Status()
+}
+
+func TestAnnouncerEvents(t *testing.T) {
+	defer func(d time.Duration) { intervalUnit = d }(intervalUnit)
+	intervalUnit = 20 * time.Millisecond
+
+	tt := newHTTPTestTracker(false)
+	defer tt.Close()
+	tt.SetResponse(false, "d8:completei1e10:incompletei2e8:intervali1e5:peers6:\x0a\x00\x00\x01\x1a\xe1e")
+
+	a := newTestAnnouncer(tt.URL)
+	a.Start()
+
+	if st := waitForStatus(a); st.Err != nil || st.Seeders != 1 || st.Leechers != 2 {
+		t.Errorf("invalid status after the first announce: %+v", st)
+	}
+	if len(a.peers.GetPeers()) != 1 {
+		t.Errorf("got %d peers, expected %d", len(a.peers.GetPeers()), 1)
+	}
+
+	// re-announces on the interval
+	waitForEvents(tt, 3)
+
+	a.Completed()
+	waitForEvent(tt, "completed")
+
+	a.Stop()
+	events := tt.Events()
+
+	if len(events) < 4 {
+		t.Fatalf("got %d announces, expected at least %d", len(events), 4)
+	}
+	if events[0] != "started" {
+		t.Errorf("got first event %q, expected %q", events[0], "started")
+	}
+	if events[len(events)-1] != "stopped" {
+		t.Errorf("got last event %q, expected %q", events[len(events)-1], "stopped")
+	}
+
+	completed := 0
+	for _, e := range events[1 : len(events)-1] {
+		switch e {
+		case "completed":
+			completed++
+		case "":
+		default:
+			t.Errorf("unexpected event %q", e)
+		}
+	}
+	if completed != 1 {
+		t.Errorf("got %d completed events, expected %d", completed, 1)
+	}
+}
+
+func TestAnnouncerBackoff(t *testing.T) {
+	defer func(d time.Duration) { retryInterval = d }(retryInterval)
+	retryInterval = 10 * time.Millisecond
+
+	tt := newHTTPTestTracker(false)
+	defer tt.Close()
+	tt.SetResponse(false, "d14:failure reason12:unregisterede")
+
+	a := newTestAnnouncer(tt.URL)
+	a.Start()
+
+	st := waitForStatus(a)
+	if st.Err == nil || !strings.Contains(st.Err.Error(), "unregistered") {
+		t.Errorf("got error %v, expected the failure reason", st.Err)
+	}
+	if st.Failures < 1 {
+		t.Errorf("got %d failures, expected at least %d", st.Failures, 1)
+	}
+
+	// 10ms, 20ms, 40ms
+	waitForEvents(tt, 4)
+	tt.SetResponse(false, testResponse)
+	a.Announce()
+	waitForEvents(tt, 5)
+	a.Stop()
+
+	events := tt.Events()
+	for i, e := range events[:len(events)-1] {
+		if e != "started" {
+			t.Errorf("got event %q for announce %d, expected %q", e, i, "started")
+		}
+	}
+	if events[len(events)-1] != "stopped" {
+		t.Errorf("got last event %q, expected %q", events[len(events)-1], "stopped")
+	}
+
+	if st := a.Status(); st.Failures != 0 || st.Err != nil || st.Interval != 1800*time.Second {
+		t.Errorf("invalid status after a successful announce: %+v", st)
+	}
+}
+
+func TestAnnouncerWithoutTrackers(t *testing.T) {
+	a := newTestAnnouncer("")
+	a.Start()
+	a.Announce()
+	a.Stop()
+}
@@ -1,18 +1,48 @@
 package tracker
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"strconv"
 	"sync"
 )
 
 type Peer struct {
 	PeerID string
-	IP     string
+	IP     net.IP
 	Port   uint16
 }
 
+// ParsePeer parses a "host:port" address, where host is an IPv4 or an IPv6
+// address.
+func ParsePeer(addr string) (*Peer, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errors.New("invalid ip address: " + host)
+	}
+
+	portnum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Peer{IP: ip, Port: uint16(portnum)}, nil
+}
+
+// Addr returns the address of the peer in the "host:port" form, IPv6
+// addresses are enclosed in brackets.
+func (p *Peer) Addr() string {
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
+}
+
 func (p *Peer) Hash() string {
-	return fmt.Sprintf("tracker.Peer:%s:%d", p.IP, p.Port)
+	return "tracker.Peer:" + p.Addr()
 }
 
 func (p *Peer) String() string {
@@ -0,0 +1,42 @@
+package tracker
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParsePeer(t *testing.T) {
+	addrs := []string{"10.0.0.1:6881", "[2001:db8::1]:6881"}
+
+	for _, addr := range addrs {
+		p, err := ParsePeer(addr)
+		if err != nil {
+			t.Errorf("%s: %s", addr, err)
+			continue
+		}
+		if p.Addr() != addr {
+			t.Errorf("got %s, expected %s", p.Addr(), addr)
+		}
+	}
+
+	for _, addr := range []string{"10.0.0.1", "example.com:6881", "10.0.0.1:70000"} {
+		if _, err := ParsePeer(addr); err == nil {
+			t.Errorf("%s: expected an error", addr)
+		}
+	}
+}
+
+func TestPeerHash(t *testing.T) {
+	// With a plain "ip:port" format these two would collide.
+	a := &Peer{IP: net.ParseIP("2001:db8::1:2"), Port: 3}
+	b := &Peer{IP: net.ParseIP("2001:db8::1"), Port: 23}
+	if a.Hash() == b.Hash() {
+		t.Errorf("different peers have the same hash: %s", a.Hash())
+	}
+
+	c := &Peer{IP: net.ParseIP("10.0.0.1").To4(), Port: 1}
+	d := &Peer{IP: net.ParseIP("10.0.0.1"), Port: 1}
+	if c.Hash() != d.Hash() {
+		t.Errorf("the same peer has different hashes: %s, %s", c.Hash(), d.Hash())
+	}
+}
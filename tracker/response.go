@@ -2,33 +2,97 @@ package tracker
 
 import (
 	"encoding/binary"
-	"fmt"
+	"errors"
 	"github.com/yorirou/gotorrent/bencode"
 	"log"
+	"net"
 )
 
+// ParseResponse parses an announce response. The peer list can be in the
+// compact or in the dictionary format, the format is detected by the type
+// of the peers value. A failure reason is returned in the response, with
+// no error.
 func ParseResponse(resp []byte) (*Response, error) {
-	compact := new(CompactResponse)
-	if err := bencode.Unmarshal(resp, compact); err != nil {
-		log.Print(err)
-		dictcompact := new(Response)
-		if errd := bencode.Unmarshal(resp, dictcompact); err != nil {
-			return nil, errd
+	var v interface{}
+	if err := bencode.Unmarshal(resp, &v); err != nil {
+		return nil, err
+	}
+
+	d, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("the response is not a dictionary")
+	}
+
+	base := ResponseBase{
+		FailureReason:  dictString(d, "failure reason"),
+		WarningMessage: dictString(d, "warning message"),
+		Interval:       uint64(dictInt(d, "interval")),
+		MinInterval:    uint64(dictInt(d, "min interval")),
+		TrackerID:      dictString(d, "tracker id"),
+		Complete:       uint32(dictInt(d, "complete")),
+		Incomplete:     uint32(dictInt(d, "incomplete")),
+	}
+
+	if base.FailureReason != "" {
+		return &Response{ResponseBase: base}, nil
+	}
+
+	switch peers := d["peers"].(type) {
+	case nil, string:
+		compact := new(CompactResponse)
+		compact.ResponseBase = base
+		compact.Peers = []byte(dictString(d, "peers"))
+		compact.Peers6 = []byte(dictString(d, "peers6"))
+		return compact.Convert(), nil
+	case []interface{}:
+		dict := new(DictResponse)
+		dict.ResponseBase = base
+		for _, item := range peers {
+			pd, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, errors.New("invalid entry in the peer list")
+			}
+
+			port := dictInt(pd, "port")
+			if port <= 0 || port > 65535 {
+				log.Print("invalid peer port: ", port)
+				continue
+			}
+
+			dict.Peers = append(dict.Peers, &DictPeer{
+				PeerID: dictString(pd, "peer id"),
+				IP:     dictString(pd, "ip"),
+				Port:   uint16(port),
+			})
 		}
-		return dictcompact, nil
+
+		r := dict.Convert()
+		// peers6 is always compact
+		r.Peers = append(r.Peers, decodePeers([]byte(dictString(d, "peers6")), net.IPv6len)...)
+		return r, nil
 	}
 
-	return compact.Convert(), nil
+	return nil, errors.New("invalid type of the peer list")
+}
+
+func dictString(d map[string]interface{}, key string) string {
+	s, _ := d[key].(string)
+	return s
+}
+
+func dictInt(d map[string]interface{}, key string) int64 {
+	i, _ := d[key].(int64)
+	return i
 }
 
 type ResponseBase struct {
-	FailureReason  string
-	WarningMessage string
-	Interval       uint64
-	MinInterval    uint64
-	TrackerID      string
-	Complete       uint32
-	Incomplete     uint32
+	FailureReason  string `bencode:"failure reason,omitempty"`
+	WarningMessage string `bencode:"warning message,omitempty"`
+	Interval       uint64 `bencode:"interval"`
+	MinInterval    uint64 `bencode:"min interval,omitempty"`
+	TrackerID      string `bencode:"tracker id,omitempty"`
+	Complete       uint32 `bencode:"complete"`
+	Incomplete     uint32 `bencode:"incomplete"`
 }
 
 func (rb *ResponseBase) GetInterval(min bool) uint64 {
@@ -49,36 +113,74 @@ func (rb *ResponseBase) Leechers() uint32 {
 
 type CompactResponse struct {
 	ResponseBase
-	Peers []byte
-	Peers6 []byte
+	Peers  []byte `bencode:"peers"`
+	Peers6 []byte `bencode:"peers6,omitempty"`
 }
 
 func (cr *CompactResponse) Convert() *Response {
 	dr := new(Response)
 	dr.ResponseBase = cr.ResponseBase
 
-	peerdata := []byte(cr.Peers)
+	dr.Peers = append(decodePeers(cr.Peers, net.IPv4len), decodePeers(cr.Peers6, net.IPv6len)...)
 
-	if len(peerdata)%6 != 0 {
-		log.Print("peer data is not divisible with 6")
-	}
+	return dr
+}
 
-	peernum := len(peerdata) / 6
-	dr.Peers = make([]*Peer, peernum)
-	for i := 0; i < peernum; i++ {
-		p := new(Peer)
+// DictPeer is an entry of the peer list in the dictionary format.
+type DictPeer struct {
+	PeerID string `bencode:"peer id,omitempty"`
+	IP     string `bencode:"ip"`
+	Port   uint16 `bencode:"port"`
+}
 
-		p.PeerID = ""
-		p.IP = fmt.Sprintf("%d.%d.%d.%d", peerdata[i*6+0], peerdata[i*6+1], peerdata[i*6+2], peerdata[i*6+3])
-		p.Port = binary.BigEndian.Uint16(peerdata[i*6+4 : i*6+6])
+type DictResponse struct {
+	ResponseBase
+	Peers []*DictPeer `bencode:"peers"`
+}
 
-		dr.Peers[i] = p
+// Convert drops the peers whose address is not an IP address.
+func (dr *DictResponse) Convert() *Response {
+	r := new(Response)
+	r.ResponseBase = dr.ResponseBase
+
+	r.Peers = make([]*Peer, 0, len(dr.Peers))
+	for _, dp := range dr.Peers {
+		ip := net.ParseIP(dp.IP)
+		if ip == nil {
+			log.Print("invalid peer ip: ", dp.IP)
+			continue
+		}
+
+		r.Peers = append(r.Peers, &Peer{PeerID: dp.PeerID, IP: ip, Port: dp.Port})
 	}
 
-	return dr
+	return r
 }
 
 type Response struct {
 	ResponseBase
 	Peers []*Peer
 }
+
+// decodePeers decodes a compact peer list, where each entry is an address of
+// iplen bytes followed by a 2 byte port.
+func decodePeers(peerdata []byte, iplen int) []*Peer {
+	size := iplen + 2
+	if len(peerdata)%size != 0 {
+		log.Printf("peer data is not divisible with %d", size)
+	}
+
+	peernum := len(peerdata) / size
+	peers := make([]*Peer, peernum)
+	for i := 0; i < peernum; i++ {
+		entry := peerdata[i*size : (i+1)*size]
+
+		p := new(Peer)
+		p.IP = net.IP(append([]byte{}, entry[:iplen]...))
+		p.Port = binary.BigEndian.Uint16(entry[iplen:])
+
+		peers[i] = p
+	}
+
+	return peers
+}
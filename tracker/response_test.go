@@ -0,0 +1,121 @@
+package tracker
+
+import (
+	"testing"
+)
+
+func TestParseCompactResponse6(t *testing.T) {
+	b := "d8:intervali1800e5:peers6:\x0a\x00\x00\x01\x1a\xe16:peers618:" +
+		"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe2e"
+
+	r, err := ParseResponse([]byte(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.Peers) != 2 {
+		t.Fatalf("got %d peers, expected %d", len(r.Peers), 2)
+	}
+	if r.Peers[0].Addr() != "10.0.0.1:6881" {
+		t.Errorf("got %s, expected %s", r.Peers[0].Addr(), "10.0.0.1:6881")
+	}
+	if r.Peers[1].Addr() != "[2001:db8::1]:6882" {
+		t.Errorf("got %s, expected %s", r.Peers[1].Addr(), "[2001:db8::1]:6882")
+	}
+}
+
+func TestParseCompactResponse(t *testing.T) {
+	b := "d8:completei3e10:incompletei4e8:intervali1800e12:min intervali60e5:peers12:" +
+		"\x0a\x00\x00\x01\x1a\xe1\x0a\x00\x00\x02\x1a\xe210:tracker id3:abc11:external ip4:\x01\x02\x03\x04e"
+
+	r, err := ParseResponse([]byte(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Seeders() != 3 || r.Leechers() != 4 || r.Interval != 1800 || r.MinInterval != 60 || r.TrackerID != "abc" {
+		t.Errorf("invalid response: %+v", r.ResponseBase)
+	}
+	if len(r.Peers) != 2 || r.Peers[1].Addr() != "10.0.0.2:6882" {
+		t.Errorf("invalid peer list: %v", r.Peers)
+	}
+}
+
+func TestParseDictResponse(t *testing.T) {
+	b := "d8:intervali900e5:peersl" +
+		"d2:ip8:10.0.0.17:peer id20:aaaaaaaaaaaaaaaaaaaa4:porti6881ee" +
+		"d2:ip11:2001:db8::24:porti6882ee" +
+		"d2:ip11:example.com4:porti6883ee" +
+		"d2:ip8:10.0.0.34:porti0ee" +
+		"ee"
+
+	r, err := ParseResponse([]byte(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Interval != 900 {
+		t.Errorf("got interval %d, expected %d", r.Interval, 900)
+	}
+	if len(r.Peers) != 2 {
+		t.Fatalf("got %d peers, expected %d", len(r.Peers), 2)
+	}
+	if r.Peers[0].Addr() != "10.0.0.1:6881" || r.Peers[0].PeerID != "aaaaaaaaaaaaaaaaaaaa" {
+		t.Errorf("invalid peer: %s", r.Peers[0])
+	}
+	if r.Peers[1].Addr() != "[2001:db8::2]:6882" {
+		t.Errorf("invalid peer: %s", r.Peers[1])
+	}
+}
+
+func TestParseDictResponseWithPeers6(t *testing.T) {
+	b := "d8:intervali900e5:peersld2:ip8:10.0.0.14:porti6881eee6:peers618:" +
+		"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe2e"
+
+	r, err := ParseResponse([]byte(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.Peers) != 2 || r.Peers[1].Addr() != "[2001:db8::1]:6882" {
+		t.Errorf("invalid peer list: %v", r.Peers)
+	}
+}
+
+func TestParseFailureResponse(t *testing.T) {
+	r, err := ParseResponse([]byte("d14:failure reason17:torrent not founde"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.FailureReason != "torrent not found" {
+		t.Errorf("got failure reason %q, expected %q", r.FailureReason, "torrent not found")
+	}
+}
+
+func TestParseWarningResponse(t *testing.T) {
+	r, err := ParseResponse([]byte("d8:intervali900e5:peers0:15:warning message4:slowe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.WarningMessage != "slow" {
+		t.Errorf("got warning %q, expected %q", r.WarningMessage, "slow")
+	}
+}
+
+func TestParseInvalidResponse(t *testing.T) {
+	responses := []string{
+		"",
+		"le",
+		"d5:peersi1ee",
+		"d5:peersli1eee",
+		"<html>",
+	}
+
+	for _, b := range responses {
+		if _, err := ParseResponse([]byte(b)); err == nil {
+			t.Errorf("%q: expected an error", b)
+		}
+	}
+}
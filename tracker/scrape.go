@@ -0,0 +1,153 @@
+package tracker
+
+import (
+	"errors"
+	"github.com/yorirou/gotorrent/bencode"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+)
+
+var ErrScrapeNotSupported = errors.New("the tracker does not support scraping")
+
+// ScrapeFile holds the statistics of one torrent in a scrape response.
+type ScrapeFile struct {
+	Complete   uint32 `bencode:"complete"`
+	Downloaded uint32 `bencode:"downloaded"`
+	Incomplete uint32 `bencode:"incomplete"`
+	Name       string `bencode:"name,omitempty"`
+}
+
+type ScrapeResponse struct {
+	FailureReason string                 `bencode:"failure reason,omitempty"`
+	Files         map[string]*ScrapeFile `bencode:"files"`
+	Flags         map[string]uint64      `bencode:"flags,omitempty"`
+}
+
+// ScrapeURL derives the scrape url of an HTTP tracker from its announce
+// url, by replacing "announce" with "scrape" at the beginning of the last
+// path element. The url of an UDP tracker is returned as it is.
+func ScrapeURL(announce string) (string, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return "", err
+	}
+
+	if u.Scheme == "udp" {
+		return announce, nil
+	}
+
+	dir, file := path.Split(u.Path)
+	if !strings.HasPrefix(file, "announce") {
+		return "", ErrScrapeNotSupported
+	}
+	u.Path = dir + "scrape" + strings.TrimPrefix(file, "announce")
+
+	return u.String(), nil
+}
+
+// Scrape requests the statistics of the given torrents from a tracker. The
+// result is keyed by the info hash.
+func Scrape(announce string, infohashes []string) (map[string]*ScrapeFile, error) {
+	return newTrackerClient(announce, nil).scrape(infohashes)
+}
+
+// Scrape requests the statistics of the torrent from the first tracker
+// which answers.
+func (tc *TrackerClientCollection) Scrape() (*ScrapeFile, error) {
+	err := errors.New("no trackers")
+
+	for t := range tc.tiers {
+		for _, c := range tc.tier(t) {
+			var files map[string]*ScrapeFile
+			files, err = c.scrape([]string{tc.infohash})
+			if err != nil {
+				continue
+			}
+
+			if f, ok := files[tc.infohash]; ok {
+				return f, nil
+			}
+			err = errors.New("the torrent is missing from the scrape response")
+		}
+	}
+
+	return nil, err
+}
+
+func (tc *trackerClient) scrape(infohashes []string) (map[string]*ScrapeFile, error) {
+	u, err := url.Parse(tc.url)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "udp":
+		files := make(map[string]*ScrapeFile)
+		for len(infohashes) > 0 {
+			n := len(infohashes)
+			if n > udpMaxScrapeHashes {
+				n = udpMaxScrapeHashes
+			}
+
+			batch, err := tc.scrapeUDP(u, infohashes[:n])
+			if err != nil {
+				return nil, err
+			}
+			for ih, f := range batch {
+				files[ih] = f
+			}
+
+			infohashes = infohashes[n:]
+		}
+		return files, nil
+	case "http", "https":
+		return tc.scrapeHTTP(infohashes)
+	}
+
+	return nil, errors.New("unsupported tracker protocol: " + u.Scheme)
+}
+
+func (tc *trackerClient) scrapeHTTP(infohashes []string) (map[string]*ScrapeFile, error) {
+	scrapeurl, err := ScrapeURL(tc.url)
+	if err != nil {
+		return nil, err
+	}
+
+	q := url.Values{}
+	for _, ih := range infohashes {
+		q.Add("info_hash", ih)
+	}
+
+	separator := "?"
+	if strings.Contains(scrapeurl, "?") {
+		separator = "&"
+	}
+
+	resp, err := httpClient.Get(scrapeurl + separator + q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	sr := new(ScrapeResponse)
+	if err := bencode.Unmarshal(b, sr); err != nil {
+		return nil, err
+	}
+
+	if sr.FailureReason != "" {
+		return nil, errors.New("tracker failure: " + sr.FailureReason)
+	}
+
+	if sr.Files == nil {
+		sr.Files = make(map[string]*ScrapeFile)
+	}
+
+	return sr.Files, nil
+}
@@ -0,0 +1,127 @@
+package tracker
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestScrapeURL(t *testing.T) {
+	urls := map[string]string{
+		"http://example.com/announce":             "http://example.com/scrape",
+		"http://example.com/x/announce":           "http://example.com/x/scrape",
+		"http://example.com/announce.php":         "http://example.com/scrape.php",
+		"http://example.com/announce?passkey=abc": "http://example.com/scrape?passkey=abc",
+		"udp://example.com:80":                    "udp://example.com:80",
+	}
+
+	for announce, expected := range urls {
+		scrape, err := ScrapeURL(announce)
+		if err != nil {
+			t.Errorf("%s: %s", announce, err)
+			continue
+		}
+		if scrape != expected {
+			t.Errorf("got %s, expected %s", scrape, expected)
+		}
+	}
+
+	for _, announce := range []string{"http://example.com/a", "http://example.com/announce/x", "http://example.com/x_announce"} {
+		if _, err := ScrapeURL(announce); err != ErrScrapeNotSupported {
+			t.Errorf("%s: got %v, expected %v", announce, err, ErrScrapeNotSupported)
+		}
+	}
+}
+
+func TestScrapeHTTP(t *testing.T) {
+	var query []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" {
+			http.NotFound(w, r)
+			return
+		}
+		query = r.URL.Query()["info_hash"]
+		w.Write([]byte("d5:filesd" +
+			"20:aaaaaaaaaaaaaaaaaaaad8:completei5e10:downloadedi50e10:incompletei10e4:name1:ae" +
+			"20:bbbbbbbbbbbbbbbbbbbbd8:completei1e10:downloadedi2e10:incompletei3ee" +
+			"ee"))
+	}))
+	defer s.Close()
+
+	hashes := []string{"aaaaaaaaaaaaaaaaaaaa", "bbbbbbbbbbbbbbbbbbbb"}
+	files, err := Scrape(s.URL+"/announce", hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(query)
+	if strings.Join(query, ",") != strings.Join(hashes, ",") {
+		t.Errorf("got info hashes %v, expected %v", query, hashes)
+	}
+
+	if len(files) != 2 {
+		t.Fatalf("got %d files, expected %d", len(files), 2)
+	}
+	a := files[hashes[0]]
+	if a.Complete != 5 || a.Downloaded != 50 || a.Incomplete != 10 || a.Name != "a" {
+		t.Errorf("invalid scrape result: %+v", a)
+	}
+	b := files[hashes[1]]
+	if b.Complete != 1 || b.Downloaded != 2 || b.Incomplete != 3 {
+		t.Errorf("invalid scrape result: %+v", b)
+	}
+}
+
+func TestScrapeFailure(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d14:failure reason8:disablede"))
+	}))
+	defer s.Close()
+
+	if _, err := Scrape(s.URL+"/announce", []string{"aaaaaaaaaaaaaaaaaaaa"}); err == nil || !strings.Contains(err.Error(), "disabled") {
+		t.Errorf("got %v, expected the failure reason", err)
+	}
+}
+
+func TestScrapeUDPBatches(t *testing.T) {
+	s := newUDPTestServer(t, 0)
+	defer s.Close()
+
+	hashes := make([]string, udpMaxScrapeHashes+6)
+	for i := range hashes {
+		hashes[i] = fmt.Sprintf("%020d", i)
+	}
+
+	files, err := Scrape(s.url(), hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != len(hashes) {
+		t.Errorf("got %d files, expected %d", len(files), len(hashes))
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	// one connect and two scrapes
+	if s.requests != 3 {
+		t.Errorf("got %d requests, expected %d", s.requests, 3)
+	}
+}
+
+func TestCollectionScrape(t *testing.T) {
+	s := newUDPTestServer(t, 0)
+	defer s.Close()
+
+	f, err := newTestCollection(s.url()).Scrape()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Complete != 5 || f.Incomplete != 7 {
+		t.Errorf("got %d/%d, expected %d/%d", f.Complete, f.Incomplete, 5, 7)
+	}
+}
@@ -0,0 +1,359 @@
+package server
+
+import (
+	"encoding/binary"
+	"github.com/yorirou/gotorrent/bencode"
+	"github.com/yorirou/gotorrent/tracker"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultInterval    = 30 * time.Minute
+	DefaultMinInterval = 5 * time.Minute
+	DefaultNumWant     = 50
+	MaxNumWant         = 200
+	// sweepInterval is how often every swarm is expired, also the ones which
+	// are not announced or scraped any more.
+	sweepInterval = time.Minute
+)
+
+// Server is an HTTP tracker. It serves announce requests on the paths
+// ending with "announce" and scrape requests on the paths ending with
+// "scrape".
+type Server struct {
+	Interval    time.Duration
+	MinInterval time.Duration
+	// Peers which have not announced for this long are dropped.
+	Expiry time.Duration
+
+	now       func() time.Time
+	mtx       sync.Mutex
+	swarms    map[string]*swarm
+	lastSweep time.Time
+	// downloaded counts the completed events of a torrent, it is kept when
+	// the swarm is deleted.
+	downloaded map[string]uint32
+	allowed    map[string]bool
+	rand       *rand.Rand
+}
+
+type swarm struct {
+	peers map[string]*peer
+}
+
+type peer struct {
+	id   string
+	ips  []net.IP
+	port uint16
+	left uint64
+	seen time.Time
+}
+
+type failure struct {
+	FailureReason string `bencode:"failure reason"`
+}
+
+func NewServer() *Server {
+	s := new(Server)
+	s.Interval = DefaultInterval
+	s.MinInterval = DefaultMinInterval
+	s.Expiry = 2 * DefaultInterval
+	s.now = time.Now
+	s.swarms = make(map[string]*swarm)
+	s.downloaded = make(map[string]uint32)
+	s.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	return s
+}
+
+// Allow adds an info hash to the allowlist. Once the allowlist is not
+// empty, the other torrents are rejected.
+func (s *Server) Allow(infohash string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.allowed == nil {
+		s.allowed = make(map[string]bool)
+	}
+	s.allowed[infohash] = true
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch path.Base(r.URL.Path) {
+	case "announce":
+		s.announce(w, r)
+	case "scrape":
+		s.scrape(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) announce(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	infohash := q.Get("info_hash")
+	peerID := q.Get("peer_id")
+	if len(infohash) != 20 || len(peerID) != 20 {
+		writeFailure(w, "invalid info_hash or peer_id")
+		return
+	}
+
+	port, err := strconv.ParseUint(q.Get("port"), 10, 16)
+	if err != nil {
+		writeFailure(w, "invalid port")
+		return
+	}
+
+	left, err := strconv.ParseUint(q.Get("left"), 10, 64)
+	if err != nil {
+		writeFailure(w, "invalid left")
+		return
+	}
+
+	numwant := DefaultNumWant
+	if n, err := strconv.Atoi(q.Get("numwant")); err == nil && n >= 0 {
+		numwant = n
+	}
+	if numwant > MaxNumWant {
+		numwant = MaxNumWant
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		writeFailure(w, "invalid remote address")
+		return
+	}
+	ips := []net.IP{net.ParseIP(host)}
+
+	// BEP 7: the peer can tell its address of the other family.
+	if ip := net.ParseIP(q.Get("ipv4")); ip != nil && ip.To4() != nil && !ip.Equal(ips[0]) {
+		ips = append(ips, ip)
+	}
+	if ip := net.ParseIP(q.Get("ipv6")); ip != nil && ip.To4() == nil && !ip.Equal(ips[0]) {
+		ips = append(ips, ip)
+	}
+
+	s.mtx.Lock()
+	if s.allowed != nil && !s.allowed[infohash] {
+		s.mtx.Unlock()
+		writeFailure(w, "unregistered torrent")
+		return
+	}
+
+	s.sweep()
+	sw := s.getSwarm(infohash)
+	key := peerKey(peerID, ips[0])
+
+	switch q.Get("event") {
+	case "stopped":
+		delete(sw.peers, key)
+	case "completed":
+		s.downloaded[infohash]++
+		fallthrough
+	default:
+		sw.peers[key] = &peer{peerID, ips, uint16(port), left, s.now()}
+	}
+	// After the update, so the swarm is deleted when its last peer stops.
+	s.expire(infohash)
+
+	complete, incomplete := sw.count()
+	peers := s.pick(sw, key, numwant)
+	s.mtx.Unlock()
+
+	base := tracker.ResponseBase{
+		Interval:    uint64(s.Interval / time.Second),
+		MinInterval: uint64(s.MinInterval / time.Second),
+		Complete:    complete,
+		Incomplete:  incomplete,
+	}
+
+	if q.Get("compact") == "1" {
+		resp := new(tracker.CompactResponse)
+		resp.ResponseBase = base
+		resp.Peers, resp.Peers6 = compactPeers(peers)
+		write(w, resp)
+		return
+	}
+
+	resp := new(tracker.DictResponse)
+	resp.ResponseBase = base
+	resp.Peers = make([]*tracker.DictPeer, 0, len(peers))
+	for _, p := range peers {
+		for _, ip := range p.ips {
+			dp := &tracker.DictPeer{IP: ip.String(), Port: p.port}
+			if q.Get("no_peer_id") != "1" {
+				dp.PeerID = p.id
+			}
+			resp.Peers = append(resp.Peers, dp)
+		}
+	}
+	write(w, resp)
+}
+
+func (s *Server) scrape(w http.ResponseWriter, r *http.Request) {
+	infohashes := r.URL.Query()["info_hash"]
+
+	s.mtx.Lock()
+	s.sweep()
+	if len(infohashes) == 0 {
+		for infohash := range s.swarms {
+			infohashes = append(infohashes, infohash)
+		}
+		for infohash := range s.downloaded {
+			if _, ok := s.swarms[infohash]; !ok {
+				infohashes = append(infohashes, infohash)
+			}
+		}
+	}
+
+	resp := new(tracker.ScrapeResponse)
+	resp.Files = make(map[string]*tracker.ScrapeFile)
+	for _, infohash := range infohashes {
+		s.expire(infohash)
+		sw, ok := s.swarms[infohash]
+		downloaded, completed := s.downloaded[infohash]
+		if !ok && !completed {
+			continue
+		}
+
+		f := new(tracker.ScrapeFile)
+		if ok {
+			f.Complete, f.Incomplete = sw.count()
+		}
+		f.Downloaded = downloaded
+		resp.Files[infohash] = f
+	}
+	s.mtx.Unlock()
+
+	write(w, resp)
+}
+
+// getSwarm returns the swarm of a torrent. The caller must hold s.mtx.
+func (s *Server) getSwarm(infohash string) *swarm {
+	sw, ok := s.swarms[infohash]
+	if !ok {
+		sw = new(swarm)
+		sw.peers = make(map[string]*peer)
+		s.swarms[infohash] = sw
+	}
+
+	return sw
+}
+
+// expire drops the peers of a swarm which have not announced in time, and
+// the swarm itself once it is empty. The caller must hold s.mtx.
+func (s *Server) expire(infohash string) {
+	sw, ok := s.swarms[infohash]
+	if !ok {
+		return
+	}
+
+	deadline := s.now().Add(-s.Expiry)
+	for key, p := range sw.peers {
+		if p.seen.Before(deadline) {
+			delete(sw.peers, key)
+		}
+	}
+
+	if len(sw.peers) == 0 {
+		delete(s.swarms, infohash)
+	}
+}
+
+// sweep expires every swarm, at most once per sweepInterval. The caller must
+// hold s.mtx.
+func (s *Server) sweep() {
+	now := s.now()
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+
+	for infohash := range s.swarms {
+		s.expire(infohash)
+	}
+}
+
+// peerKey identifies a peer in a swarm. The address is part of it, so a peer
+// id announced from another host does not replace or stop the peer.
+func peerKey(id string, ip net.IP) string {
+	return id + string(ip.To16())
+}
+
+// pick selects at most n random peers of the swarm, except the one with the
+// given key. The caller must hold s.mtx.
+func (s *Server) pick(sw *swarm, except string, n int) []*peer {
+	candidates := make([]*peer, 0, len(sw.peers))
+	for key, p := range sw.peers {
+		if key != except {
+			candidates = append(candidates, p)
+		}
+	}
+
+	perm := s.rand.Perm(len(candidates))
+
+	if n > len(candidates) {
+		n = len(candidates)
+	}
+
+	peers := make([]*peer, n)
+	for i := range peers {
+		peers[i] = candidates[perm[i]]
+	}
+
+	return peers
+}
+
+func (sw *swarm) count() (complete, incomplete uint32) {
+	for _, p := range sw.peers {
+		if p.left == 0 {
+			complete++
+		} else {
+			incomplete++
+		}
+	}
+
+	return
+}
+
+// compactPeers encodes the IPv4 and the IPv6 peers in the compact format.
+func compactPeers(peers []*peer) (peers4, peers6 []byte) {
+	peers4 = make([]byte, 0)
+	for _, p := range peers {
+		port := make([]byte, 2)
+		binary.BigEndian.PutUint16(port, p.port)
+
+		for _, ip := range p.ips {
+			if ip4 := ip.To4(); ip4 != nil {
+				peers4 = append(append(peers4, ip4...), port...)
+			} else {
+				peers6 = append(append(peers6, ip.To16()...), port...)
+			}
+		}
+	}
+
+	return
+}
+
+func write(w http.ResponseWriter, v interface{}) {
+	b, err := bencode.Marshal(v)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(b)
+}
+
+func writeFailure(w http.ResponseWriter, reason string) {
+	write(w, &failure{reason})
+}
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"github.com/yorirou/gotorrent/client/config"
+	"github.com/yorirou/gotorrent/metainfo"
+	"github.com/yorirou/gotorrent/tracker"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testInfoHash = "01234567890123456789"
+
+func newTestCollection(announce string, port uint64) *tracker.TrackerClientCollection {
+	mi := new(metainfo.Metainfo)
+	mi.Announce = announce
+	mi.Info.Hash = testInfoHash
+
+	cc := config.NewClientConfig()
+	cc.Port = port
+
+	return tracker.NewTrackerClientCollection(mi, cc)
+}
+
+func TestAnnounce(t *testing.T) {
+	s := NewServer()
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+
+	seeder := newTestCollection(hs.URL+"/announce", 6881)
+	leecher := newTestCollection(hs.URL+"/announce", 6882)
+
+	r, err := seeder.Announce(tracker.EventStarted, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Peers) != 0 {
+		t.Errorf("got %d peers, expected %d", len(r.Peers), 0)
+	}
+	if r.Interval != uint64(DefaultInterval/time.Second) {
+		t.Errorf("got interval %d, expected %d", r.Interval, uint64(DefaultInterval/time.Second))
+	}
+
+	r, err = leecher.Announce(tracker.EventStarted, 0, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Peers) != 1 {
+		t.Fatalf("got %d peers, expected %d", len(r.Peers), 1)
+	}
+	if p := r.Peers[0]; p.IP.String() != "127.0.0.1" || p.Port != 6881 {
+		t.Errorf("got peer %s, expected 127.0.0.1:6881", p)
+	}
+	if r.Seeders() != 1 || r.Leechers() != 1 {
+		t.Errorf("got %d seeders and %d leechers, expected 1 and 1", r.Seeders(), r.Leechers())
+	}
+
+	if _, err := leecher.Announce(tracker.EventCompleted, 100, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := seeder.Announce(tracker.EventStopped, 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := leecher.Scrape()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Complete != 1 || f.Incomplete != 0 || f.Downloaded != 1 {
+		t.Errorf("got %d/%d/%d, expected 1/0/1", f.Complete, f.Incomplete, f.Downloaded)
+	}
+}
+
+func TestNonCompactAnnounce(t *testing.T) {
+	s := NewServer()
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+
+	if _, err := newTestCollection(hs.URL+"/announce", 6881).Announce(tracker.EventStarted, 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	q := url.Values{}
+	q.Add("info_hash", testInfoHash)
+	q.Add("peer_id", "abcdefghijabcdefghij")
+	q.Add("port", "6882")
+	q.Add("left", "10")
+	q.Add("compact", "0")
+
+	resp, err := http.Get(hs.URL + "/announce?" + q.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(b), "7:peer id20:") {
+		t.Errorf("the response is not in the dictionary format: %q", b)
+	}
+
+	r, err := tracker.ParseResponse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Peers) != 1 || r.Peers[0].Port != 6881 {
+		t.Errorf("invalid peer list: %v", r.Peers)
+	}
+}
+
+func TestIPv6Param(t *testing.T) {
+	s := NewServer()
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+
+	mi := new(metainfo.Metainfo)
+	mi.Announce = hs.URL + "/announce"
+	mi.Info.Hash = testInfoHash
+	cc := config.NewClientConfig()
+	cc.Port = 6881
+	cc.IPv6 = net.ParseIP("2001:db8::1")
+	tcc := tracker.NewTrackerClientCollection(mi, cc)
+
+	if _, err := tcc.Announce(tracker.EventStarted, 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := newTestCollection(hs.URL+"/announce", 6882).Announce(tracker.EventStarted, 0, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addrs := make([]string, len(r.Peers))
+	for i, p := range r.Peers {
+		addrs[i] = p.Addr()
+	}
+	if strings.Join(addrs, " ") != "127.0.0.1:6881 [2001:db8::1]:6881" {
+		t.Errorf("got %v, expected both addresses of the peer", addrs)
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	s := NewServer()
+	s.Allow("aaaaaaaaaaaaaaaaaaaa")
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+
+	_, err := newTestCollection(hs.URL+"/announce", 6881).Announce(tracker.EventStarted, 0, 0, 0)
+	if err == nil || !strings.Contains(err.Error(), "unregistered torrent") {
+		t.Errorf("got %v, expected an unregistered torrent failure", err)
+	}
+
+	s.Allow(testInfoHash)
+	if _, err := newTestCollection(hs.URL+"/announce", 6881).Announce(tracker.EventStarted, 0, 0, 0); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	now := time.Now()
+
+	s := NewServer()
+	s.now = func() time.Time { return now }
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+
+	if _, err := newTestCollection(hs.URL+"/announce", 6881).Announce(tracker.EventStarted, 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(s.Expiry + time.Second)
+
+	files, err := tracker.Scrape(hs.URL+"/announce", []string{testInfoHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := files[testInfoHash]; f != nil {
+		t.Errorf("the expired peer is still counted: %+v", f)
+	}
+	if len(s.swarms) != 0 {
+		t.Errorf("got %d swarms, expected the empty swarm to be deleted", len(s.swarms))
+	}
+}
+
+func TestStoppedSwarm(t *testing.T) {
+	s := NewServer()
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+
+	c := newTestCollection(hs.URL+"/announce", 6881)
+	if _, err := c.Announce(tracker.EventStarted, 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Announce(tracker.EventStopped, 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.swarms) != 0 {
+		t.Errorf("got %d swarms, expected the empty swarm to be deleted", len(s.swarms))
+	}
+}
+
+// serveAnnounce passes an announce from the host to the server directly.
+func serveAnnounce(t *testing.T, s *Server, infohash, host, event string) {
+	q := url.Values{}
+	q.Set("info_hash", infohash)
+	q.Set("peer_id", "-GT0000-000000000000")
+	q.Set("port", "6881")
+	q.Set("left", "0")
+	q.Set("event", event)
+
+	r, err := http.NewRequest("GET", "/announce?"+q.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RemoteAddr = host + ":1234"
+	s.ServeHTTP(httptest.NewRecorder(), r)
+}
+
+func TestPeerIDFromAnotherHost(t *testing.T) {
+	s := NewServer()
+
+	serveAnnounce(t, s, testInfoHash, "10.0.0.1", "started")
+	serveAnnounce(t, s, testInfoHash, "10.0.0.2", "started")
+	serveAnnounce(t, s, testInfoHash, "10.0.0.2", "stopped")
+
+	sw := s.swarms[testInfoHash]
+	if sw == nil || len(sw.peers) != 1 {
+		t.Fatal("the peer is stopped from another host")
+	}
+	for _, p := range sw.peers {
+		if !p.ips[0].Equal(net.ParseIP("10.0.0.1")) {
+			t.Errorf("got peer address %s, expected 10.0.0.1", p.ips[0])
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	now := time.Now()
+
+	s := NewServer()
+	s.now = func() time.Time { return now }
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+
+	serveAnnounce(t, s, testInfoHash, "10.0.0.1", "completed")
+	serveAnnounce(t, s, "aaaaaaaaaaaaaaaaaaaa", "10.0.0.1", "started")
+
+	// Another torrent is announced after the peers of the first two expired.
+	now = now.Add(s.Expiry + time.Second)
+	serveAnnounce(t, s, "bbbbbbbbbbbbbbbbbbbb", "10.0.0.1", "started")
+
+	if len(s.swarms) != 1 {
+		t.Errorf("got %d swarms, expected the expired swarms to be deleted", len(s.swarms))
+	}
+
+	files, err := tracker.Scrape(hs.URL+"/announce", []string{testInfoHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := files[testInfoHash]; f == nil || f.Downloaded != 1 || f.Complete != 0 {
+		t.Errorf("got %+v, expected 1 download without peers", f)
+	}
+}
@@ -1,39 +1,45 @@
 package tracker
 
 import (
+	"errors"
 	"fmt"
 	"github.com/yorirou/gotorrent/client/config"
 	"github.com/yorirou/gotorrent/metainfo"
-	"github.com/yorirou/gotorrent/util"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"sync"
 	"time"
 )
 
+// httpClient bounds the HTTP announces and scrapes in time, an unresponsive
+// tracker would block the announcer otherwise.
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
 type TrackerClientCollection struct {
-	clients      []*trackerClient
+	tiers        [][]*trackerClient
 	infohash     string
 	clientConfig *config.ClientConfig
+	mtx          sync.Mutex
 }
 
 func NewTrackerClientCollection(mi *metainfo.Metainfo, cc *config.ClientConfig) *TrackerClientCollection {
 	tcc := new(TrackerClientCollection)
 	tcc.infohash = mi.Info.Hash
-	tcc.clients = tcc.createClients(mi)
+	tcc.tiers = tcc.createClients(mi)
 	tcc.clientConfig = cc
 
 	return tcc
 }
 
 type trackerClient struct {
-	url         string
-	timeout     time.Duration
-	lastRequest time.Time
-	collection  *TrackerClientCollection
-	trackerID   string
+	url        string
+	collection *TrackerClientCollection
+	trackerID  string
+	udp        *udpTracker
+	mtx        sync.Mutex
 }
 
 func newTrackerClient(url string, tcc *TrackerClientCollection) *trackerClient {
@@ -43,53 +49,138 @@ func newTrackerClient(url string, tcc *TrackerClientCollection) *trackerClient {
 	return tc
 }
 
-func (tc *TrackerClientCollection) createClients(mi *metainfo.Metainfo) []*trackerClient {
-	clients := make([]*trackerClient, 0)
-
-	if ann := mi.Announce; ann != "" {
-		clients = append(clients, newTrackerClient(ann, tc))
+// createClients builds the tiers of the announce-list (BEP 12). The
+// trackers are shuffled within their tier. The announce key is only used
+// when there is no announce-list.
+func (tc *TrackerClientCollection) createClients(mi *metainfo.Metainfo) [][]*trackerClient {
+	tiers := make([][]*trackerClient, 0)
+
+	for _, urls := range mi.AnnounceList {
+		tier := make([]*trackerClient, 0, len(urls))
+		for _, i := range rand.Perm(len(urls)) {
+			tier = append(tier, newTrackerClient(urls[i], tc))
+		}
+		if len(tier) > 0 {
+			tiers = append(tiers, tier)
+		}
 	}
 
-	for _, annurl := range mi.AnnounceList {
-		clients = append(clients, newTrackerClient(annurl, tc))
+	if ann := mi.Announce; len(tiers) == 0 && ann != "" {
+		tiers = append(tiers, []*trackerClient{newTrackerClient(ann, tc)})
 	}
 
-	return clients
+	return tiers
 }
 
+// RequestPeers announces to the trackers without an event.
 func (tc *TrackerClientCollection) RequestPeers(downloaded, uploaded, left uint64) (seedernum uint32, leechernum uint32, peers *PeerPool) {
-	var wg sync.WaitGroup
-
-	wg.Add(len(tc.clients))
-	seeders := util.NewCounter()
-	leechers := util.NewCounter()
 	peers = NewPeerPool()
 
-	for _, c := range tc.clients {
-		go func() {
-			c.announce(tc.infohash, downloaded, uploaded, left, seeders, leechers, peers)
-			wg.Done()
-		}()
+	r, err := tc.Announce(EventNone, downloaded, uploaded, left)
+	if err != nil {
+		log.Print(err)
+		return
 	}
 
-	wg.Wait()
-	seedernum = uint32(seeders.Value())
-	leechernum = uint32(leechers.Value())
+	for _, p := range r.Peers {
+		peers.Add(p)
+	}
 
-	return
+	return r.Seeders(), r.Leechers(), peers
 }
 
-func (tc *trackerClient) announce(infohash string, downloaded, uploaded, left uint64, seeders *util.Counter, leechers *util.Counter, peerPool *PeerPool) {
-	if time.Since(tc.lastRequest) < tc.timeout {
-		return
+// Announce announces to the trackers tier by tier. The first tracker which
+// answers is moved to the front of its tier, and the following trackers and
+// tiers are skipped. If every tracker fails, the last error is returned.
+func (tc *TrackerClientCollection) Announce(event Event, downloaded, uploaded, left uint64) (*Response, error) {
+	err := errors.New("no trackers")
+
+	for i := range tc.tiers {
+		var r *Response
+		if r, err = tc.announceTier(i, event, downloaded, uploaded, left); err == nil {
+			return r, nil
+		}
+	}
+
+	return nil, err
+}
+
+func (tc *TrackerClientCollection) announceTier(t int, event Event, downloaded, uploaded, left uint64) (*Response, error) {
+	var err error
+	for _, c := range tc.tier(t) {
+		var r *Response
+		r, err = c.announce(tc.infohash, event, downloaded, uploaded, left)
+		if err != nil {
+			log.Print(c.url, ": ", err)
+			continue
+		}
+
+		tc.promote(t, c)
+
+		return r, nil
 	}
 
+	return nil, err
+}
+
+// tier returns a copy of a tier, so the lock is not held during the
+// requests to its trackers.
+func (tc *TrackerClientCollection) tier(t int) []*trackerClient {
+	tc.mtx.Lock()
+	defer tc.mtx.Unlock()
+
+	return append([]*trackerClient{}, tc.tiers[t]...)
+}
+
+// promote moves a tracker to the front of its tier.
+func (tc *TrackerClientCollection) promote(t int, c *trackerClient) {
+	tc.mtx.Lock()
+	defer tc.mtx.Unlock()
+
+	tier := tc.tiers[t]
+	for i := range tier {
+		if tier[i] == c {
+			copy(tier[1:i+1], tier[0:i])
+			tier[0] = c
+			return
+		}
+	}
+}
+
+func (tc *trackerClient) announce(infohash string, event Event, downloaded, uploaded, left uint64) (*Response, error) {
 	u, err := url.Parse(tc.url)
 	if err != nil {
-		log.Print(err)
-		return
+		return nil, err
 	}
 
+	var r *Response
+	switch u.Scheme {
+	case "udp":
+		r, err = tc.announceUDP(u, infohash, event, downloaded, uploaded, left)
+	case "http", "https":
+		r, err = tc.announceHTTP(u, infohash, event, downloaded, uploaded, left)
+	default:
+		err = errors.New("unsupported tracker protocol: " + u.Scheme)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if r.FailureReason != "" {
+		return nil, errors.New("tracker failure: " + r.FailureReason)
+	}
+
+	if r.TrackerID != "" {
+		tc.mtx.Lock()
+		tc.trackerID = r.TrackerID
+		tc.mtx.Unlock()
+	}
+
+	return r, nil
+}
+
+func (tc *trackerClient) announceHTTP(u *url.URL, infohash string, event Event, downloaded, uploaded, left uint64) (*Response, error) {
 	f := func(n uint64) string {
 		return fmt.Sprintf("%d", n)
 	}
@@ -103,34 +194,37 @@ func (tc *trackerClient) announce(infohash string, downloaded, uploaded, left ui
 	q.Add("downloaded", f(downloaded))
 	q.Add("left", f(left))
 	q.Add("compact", "1")
+	if event != EventNone {
+		q.Add("event", event.String())
+	}
+	if ip := tc.collection.clientConfig.IPv4; ip != nil {
+		q.Add("ipv4", ip.String())
+	}
+	if ip := tc.collection.clientConfig.IPv6; ip != nil {
+		q.Add("ipv6", ip.String())
+	}
+	tc.mtx.Lock()
 	if tc.trackerID != "" {
-		u.Query().Add("trackerid", tc.trackerID)
+		q.Add("trackerid", tc.trackerID)
 	}
+	tc.mtx.Unlock()
 
-	fullurl := u.String() + "?" + q.Encode()
-
-	resp, err := http.Get(fullurl)
-	if err != nil {
-		log.Print(err)
-		return
+	separator := "?"
+	if u.RawQuery != "" {
+		separator = "&"
 	}
+	fullurl := u.String() + separator + q.Encode()
 
-	b, errr := ioutil.ReadAll(resp.Body)
-	if errr != nil {
-		log.Print(err)
-		return
+	resp, err := httpClient.Get(fullurl)
+	if err != nil {
+		return nil, err
 	}
+	defer resp.Body.Close()
 
-	r, errp := ParseResponse(b)
-
-	if errp != nil {
-		log.Print(errp)
-		return
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
 	}
 
-	seeders.Add(uint64(r.Seeders()))
-	leechers.Add(uint64(r.Leechers()))
-	for _, p := range r.Peers {
-		peerPool.Add(p)
-	}
+	return ParseResponse(b)
 }
@@ -1 +1,165 @@
 package tracker
+
+import (
+	"github.com/yorirou/gotorrent/client/config"
+	"github.com/yorirou/gotorrent/metainfo"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testResponse = "d8:completei1e10:incompletei2e8:intervali1800e5:peers6:\x0a\x00\x00\x01\x1a\xe1e"
+
+type httpTestTracker struct {
+	*httptest.Server
+	fail     bool
+	response string
+	requests int
+	events   []string
+	mtx      sync.Mutex
+}
+
+func newHTTPTestTracker(fail bool) *httpTestTracker {
+	tt := new(httpTestTracker)
+	tt.fail = fail
+	tt.response = testResponse
+	tt.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tt.mtx.Lock()
+		defer tt.mtx.Unlock()
+
+		tt.requests++
+		tt.events = append(tt.events, r.URL.Query().Get("event"))
+
+		if tt.fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(tt.response))
+	}))
+
+	return tt
+}
+
+func (tt *httpTestTracker) Requests() int {
+	tt.mtx.Lock()
+	defer tt.mtx.Unlock()
+
+	return tt.requests
+}
+
+func (tt *httpTestTracker) Events() []string {
+	tt.mtx.Lock()
+	defer tt.mtx.Unlock()
+
+	return append([]string{}, tt.events...)
+}
+
+func (tt *httpTestTracker) SetResponse(fail bool, response string) {
+	tt.mtx.Lock()
+	defer tt.mtx.Unlock()
+
+	tt.fail = fail
+	tt.response = response
+}
+
+func TestTiers(t *testing.T) {
+	bad := newHTTPTestTracker(true)
+	defer bad.Close()
+	good := newHTTPTestTracker(false)
+	defer good.Close()
+	backup := newHTTPTestTracker(false)
+	defer backup.Close()
+
+	mi := new(metainfo.Metainfo)
+	mi.Announce = backup.URL
+	mi.AnnounceList = [][]string{{bad.URL, good.URL}, {backup.URL}}
+	tcc := NewTrackerClientCollection(mi, config.NewClientConfig())
+
+	if len(tcc.tiers) != 2 {
+		t.Fatalf("got %d tiers, expected %d", len(tcc.tiers), 2)
+	}
+
+	for i := 0; i < 2; i++ {
+		seeders, leechers, peers := tcc.RequestPeers(0, 0, 100)
+		if seeders != 1 || leechers != 2 || len(peers.GetPeers()) != 1 {
+			t.Errorf("got %d seeders, %d leechers, %d peers, expected 1, 2, 1", seeders, leechers, len(peers.GetPeers()))
+		}
+	}
+
+	if tcc.tiers[0][0].url != good.URL {
+		t.Errorf("got %s at the front of the tier, expected %s", tcc.tiers[0][0].url, good.URL)
+	}
+	if good.Requests() != 2 {
+		t.Errorf("got %d requests, expected %d", good.Requests(), 2)
+	}
+	// The failing tracker is tried at most once, before the working one
+	// is promoted.
+	if bad.Requests() > 1 {
+		t.Errorf("got %d requests, expected at most %d", bad.Requests(), 1)
+	}
+	if backup.Requests() != 0 {
+		t.Errorf("got %d requests to the next tier, expected %d", backup.Requests(), 0)
+	}
+
+	good.SetResponse(true, "")
+	if seeders, _, _ := tcc.RequestPeers(0, 0, 100); seeders != 1 {
+		t.Errorf("got %d seeders, expected %d", seeders, 1)
+	}
+	if backup.Requests() != 1 {
+		t.Errorf("got %d requests to the next tier, expected %d", backup.Requests(), 1)
+	}
+}
+
+func TestAnnounceWithoutList(t *testing.T) {
+	mi := new(metainfo.Metainfo)
+	mi.Announce = "http://tracker.example.com/announce"
+	tcc := NewTrackerClientCollection(mi, config.NewClientConfig())
+
+	if len(tcc.tiers) != 1 || len(tcc.tiers[0]) != 1 || tcc.tiers[0][0].url != mi.Announce {
+		t.Errorf("the announce url is not used as the only tier")
+	}
+}
+
+// TestConcurrentAnnounces checks that a slow tracker does not hold the
+// collection for the other announces.
+func TestConcurrentAnnounces(t *testing.T) {
+	arrived := make(chan struct{}, 2)
+	release := make(chan struct{})
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+		w.Write([]byte(testResponse))
+	}))
+	defer hs.Close()
+	var releaseOnce sync.Once
+	defer releaseOnce.Do(func() { close(release) })
+
+	mi := new(metainfo.Metainfo)
+	mi.Announce = hs.URL
+	tc := NewTrackerClientCollection(mi, config.NewClientConfig())
+
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := tc.Announce(EventNone, 0, 0, 0)
+			done <- err
+		}()
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-arrived:
+		case <-time.After(5 * time.Second):
+			t.Fatal("an announce waits for the other one")
+		}
+	}
+	releaseOnce.Do(func() { close(release) })
+
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package tracker
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// UDP tracker protocol, BEP 15.
+
+const (
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	udpConnectionIDLifetime = time.Minute
+	udpMaxRetries           = 8
+	udpMaxPacketSize        = 65507
+)
+
+var udpEvents = map[Event]uint32{
+	EventNone:      0,
+	EventCompleted: 1,
+	EventStarted:   2,
+	EventStopped:   3,
+}
+
+// udpTimeout is the base of the retransmission timeout: the n-th attempt
+// waits udpTimeout * 2^n.
+var udpTimeout = 15 * time.Second
+
+// udpMaxDuration caps a request with its retransmissions, the full backoff
+// of BEP 15 would take about two hours.
+var udpMaxDuration = 30 * time.Second
+
+type udpTracker struct {
+	addr         string
+	connectionID uint64
+	connectedAt  time.Time
+	mtx          sync.Mutex
+}
+
+func newUDPTracker(addr string) *udpTracker {
+	ut := new(udpTracker)
+	ut.addr = addr
+	return ut
+}
+
+func (tc *trackerClient) getUDPTracker(u *url.URL) *udpTracker {
+	tc.mtx.Lock()
+	defer tc.mtx.Unlock()
+
+	if tc.udp == nil {
+		tc.udp = newUDPTracker(u.Host)
+	}
+
+	return tc.udp
+}
+
+func transactionID() (uint32, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint32(b), nil
+}
+
+// roundTrip sends a request and waits for the matching response,
+// retransmitting with an exponential backoff. If the connection id has
+// expired, a connect request is sent first. The two share the attempts, n
+// never exceeds udpMaxRetries.
+func (ut *udpTracker) roundTrip(conn *net.UDPConn, action uint32, body []byte) ([]byte, error) {
+	buf := make([]byte, udpMaxPacketSize)
+	deadline := time.Now().Add(udpMaxDuration)
+
+	for n := uint(0); n <= udpMaxRetries && time.Now().Before(deadline); {
+		reqAction, reqBody := action, body
+		connectionID, ok := ut.getConnectionID()
+		if !ok {
+			reqAction, reqBody = udpActionConnect, nil
+			connectionID = udpProtocolID
+		}
+
+		tid, err := transactionID()
+		if err != nil {
+			return nil, err
+		}
+
+		req := make([]byte, 16+len(reqBody))
+		binary.BigEndian.PutUint64(req[0:8], connectionID)
+		binary.BigEndian.PutUint32(req[8:12], reqAction)
+		binary.BigEndian.PutUint32(req[12:16], tid)
+		copy(req[16:], reqBody)
+
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+
+		timeout := time.Now().Add(udpTimeout * (1 << n))
+		if timeout.After(deadline) {
+			timeout = deadline
+		}
+		conn.SetReadDeadline(timeout)
+		resp, err := readUDPResponse(conn, buf, reqAction, tid)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			n++
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if reqAction != udpActionConnect {
+			return resp, nil
+		}
+
+		if len(resp) < 8 {
+			return nil, errors.New("connect response is too short")
+		}
+		ut.setConnectionID(binary.BigEndian.Uint64(resp[0:8]))
+	}
+
+	return nil, errors.New("tracker timed out")
+}
+
+// readUDPResponse reads until the response of the transaction arrives.
+func readUDPResponse(conn *net.UDPConn, buf []byte, action, tid uint32) ([]byte, error) {
+	for {
+		read, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		if read < 8 || binary.BigEndian.Uint32(buf[4:8]) != tid {
+			continue
+		}
+
+		respAction := binary.BigEndian.Uint32(buf[0:4])
+		if respAction == udpActionError {
+			return nil, errors.New(string(buf[8:read]))
+		}
+		if respAction != action {
+			return nil, errors.New("invalid action in the tracker response")
+		}
+
+		resp := make([]byte, read-8)
+		copy(resp, buf[8:read])
+		return resp, nil
+	}
+}
+
+// getConnectionID returns the connection id, unless it has expired.
+func (ut *udpTracker) getConnectionID() (uint64, bool) {
+	ut.mtx.Lock()
+	defer ut.mtx.Unlock()
+
+	return ut.connectionID, time.Since(ut.connectedAt) < udpConnectionIDLifetime
+}
+
+func (ut *udpTracker) setConnectionID(id uint64) {
+	ut.mtx.Lock()
+	defer ut.mtx.Unlock()
+
+	ut.connectionID = id
+	ut.connectedAt = time.Now()
+}
+
+func (ut *udpTracker) dial() (*net.UDPConn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", ut.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return net.DialUDP("udp", nil, raddr)
+}
+
+func (tc *trackerClient) announceUDP(u *url.URL, infohash string, event Event, downloaded, uploaded, left uint64) (*Response, error) {
+	ut := tc.getUDPTracker(u)
+
+	conn, err := ut.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	key, err := transactionID()
+	if err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, 82)
+	copy(body[0:20], infohash)
+	copy(body[20:40], tc.collection.clientConfig.PeerID)
+	binary.BigEndian.PutUint64(body[40:48], downloaded)
+	binary.BigEndian.PutUint64(body[48:56], left)
+	binary.BigEndian.PutUint64(body[56:64], uploaded)
+	binary.BigEndian.PutUint32(body[64:68], udpEvents[event])
+	// ip (68:72) is left zero
+	binary.BigEndian.PutUint32(body[72:76], key)
+	binary.BigEndian.PutUint32(body[76:80], 0xffffffff)
+	binary.BigEndian.PutUint16(body[80:82], uint16(tc.collection.clientConfig.Port))
+
+	resp, err := ut.roundTrip(conn, udpActionAnnounce, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp) < 12 {
+		return nil, errors.New("announce response is too short")
+	}
+
+	r := new(Response)
+	r.Interval = uint64(binary.BigEndian.Uint32(resp[0:4]))
+	r.Incomplete = binary.BigEndian.Uint32(resp[4:8])
+	r.Complete = binary.BigEndian.Uint32(resp[8:12])
+
+	// The peer list has the address family of the tracker.
+	if raddr, ok := conn.RemoteAddr().(*net.UDPAddr); ok && raddr.IP.To4() == nil {
+		r.Peers = decodePeers(resp[12:], net.IPv6len)
+	} else {
+		r.Peers = decodePeers(resp[12:], net.IPv4len)
+	}
+
+	return r, nil
+}
+
+// udpMaxScrapeHashes is the number of info hashes which fit in a single
+// scrape request.
+const udpMaxScrapeHashes = 74
+
+func (tc *trackerClient) scrapeUDP(u *url.URL, infohashes []string) (map[string]*ScrapeFile, error) {
+	if len(infohashes) > udpMaxScrapeHashes {
+		return nil, errors.New("too many info hashes in a scrape request")
+	}
+
+	ut := tc.getUDPTracker(u)
+
+	conn, err := ut.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	body := make([]byte, 20*len(infohashes))
+	for i, ih := range infohashes {
+		copy(body[i*20:(i+1)*20], ih)
+	}
+
+	resp, err := ut.roundTrip(conn, udpActionScrape, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp) < 12*len(infohashes) {
+		return nil, errors.New("scrape response is too short")
+	}
+
+	files := make(map[string]*ScrapeFile)
+	for i, ih := range infohashes {
+		entry := resp[i*12 : (i+1)*12]
+
+		f := new(ScrapeFile)
+		f.Complete = binary.BigEndian.Uint32(entry[0:4])
+		f.Downloaded = binary.BigEndian.Uint32(entry[4:8])
+		f.Incomplete = binary.BigEndian.Uint32(entry[8:12])
+
+		files[ih] = f
+	}
+
+	return files, nil
+}
@@ -0,0 +1,251 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"github.com/yorirou/gotorrent/client/config"
+	"github.com/yorirou/gotorrent/metainfo"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testConnectionID = 0x1122334455667788
+
+// udpTestServer is a minimal UDP tracker.
+type udpTestServer struct {
+	conn     *net.UDPConn
+	drop     int
+	connects int
+	requests int
+	peers    []byte
+	mtx      sync.Mutex
+}
+
+func newUDPTestServer(t *testing.T, drop int) *udpTestServer {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := new(udpTestServer)
+	s.conn = conn
+	s.drop = drop
+	s.peers = []byte{10, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0x1a, 0xe2}
+	go s.serve()
+
+	return s
+}
+
+func (s *udpTestServer) url() string {
+	return "udp://" + s.conn.LocalAddr().String() + "/announce"
+}
+
+func (s *udpTestServer) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n < 16 {
+			continue
+		}
+
+		s.mtx.Lock()
+		s.requests++
+		if s.drop > 0 {
+			s.drop--
+			s.mtx.Unlock()
+			continue
+		}
+
+		connectionID := binary.BigEndian.Uint64(buf[0:8])
+		action := binary.BigEndian.Uint32(buf[8:12])
+		resp := make([]byte, 8)
+		binary.BigEndian.PutUint32(resp[0:4], action)
+		copy(resp[4:8], buf[12:16])
+
+		switch {
+		case action == udpActionConnect && connectionID == udpProtocolID:
+			s.connects++
+			id := make([]byte, 8)
+			binary.BigEndian.PutUint64(id, testConnectionID)
+			resp = append(resp, id...)
+		case connectionID != testConnectionID:
+			binary.BigEndian.PutUint32(resp[0:4], udpActionError)
+			resp = append(resp, "invalid connection id"...)
+		case action == udpActionAnnounce:
+			stats := make([]byte, 12)
+			binary.BigEndian.PutUint32(stats[0:4], 1800)
+			binary.BigEndian.PutUint32(stats[4:8], 2)
+			binary.BigEndian.PutUint32(stats[8:12], 3)
+			resp = append(resp, stats...)
+			resp = append(resp, s.peers...)
+		case action == udpActionScrape:
+			for i := 16; i+20 <= n; i += 20 {
+				stats := make([]byte, 12)
+				binary.BigEndian.PutUint32(stats[0:4], 5)
+				binary.BigEndian.PutUint32(stats[4:8], uint32(i))
+				binary.BigEndian.PutUint32(stats[8:12], 7)
+				resp = append(resp, stats...)
+			}
+		}
+		s.mtx.Unlock()
+
+		s.conn.WriteToUDP(resp, addr)
+	}
+}
+
+func (s *udpTestServer) Close() {
+	s.conn.Close()
+}
+
+func newTestCollection(announce string) *TrackerClientCollection {
+	mi := new(metainfo.Metainfo)
+	mi.Announce = announce
+	mi.Info.Hash = "01234567890123456789"
+
+	cc := config.NewClientConfig()
+	cc.Port = 6881
+
+	return NewTrackerClientCollection(mi, cc)
+}
+
+func TestUDPAnnounce(t *testing.T) {
+	s := newUDPTestServer(t, 0)
+	defer s.Close()
+
+	tcc := newTestCollection(s.url())
+	seeders, leechers, peers := tcc.RequestPeers(0, 0, 100)
+
+	if seeders != 3 {
+		t.Errorf("got %d seeders, expected %d", seeders, 3)
+	}
+	if leechers != 2 {
+		t.Errorf("got %d leechers, expected %d", leechers, 2)
+	}
+
+	ps := peers.GetPeers()
+	if len(ps) != 2 {
+		t.Fatalf("got %d peers, expected %d", len(ps), 2)
+	}
+	for _, p := range ps {
+		if p.IP.String() != "10.0.0.1" && p.IP.String() != "10.0.0.2" {
+			t.Errorf("unexpected peer %s", p)
+		}
+	}
+
+	// The connection id is reused for the next request.
+	tc := tcc.tiers[0][0]
+	u, _ := url.Parse(tc.url)
+	if _, err := tc.announceUDP(u, tcc.infohash, EventNone, 0, 0, 100); err != nil {
+		t.Fatal(err)
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.connects != 1 {
+		t.Errorf("got %d connects, expected %d", s.connects, 1)
+	}
+}
+
+func TestUDPRetransmit(t *testing.T) {
+	defer func(d time.Duration) { udpTimeout = d }(udpTimeout)
+	udpTimeout = 20 * time.Millisecond
+
+	s := newUDPTestServer(t, 2)
+	defer s.Close()
+
+	tc := newTestCollection(s.url()).tiers[0][0]
+	u, _ := url.Parse(tc.url)
+	r, err := tc.announceUDP(u, tc.collection.infohash, EventNone, 0, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Interval != 1800 {
+		t.Errorf("got interval %d, expected %d", r.Interval, 1800)
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.requests != 4 {
+		t.Errorf("got %d requests, expected %d", s.requests, 4)
+	}
+}
+
+func TestUDPTimeout(t *testing.T) {
+	defer func(d time.Duration) { udpTimeout = d }(udpTimeout)
+	udpTimeout = time.Millisecond
+
+	s := newUDPTestServer(t, udpMaxRetries+1)
+	defer s.Close()
+
+	tc := newTestCollection(s.url()).tiers[0][0]
+	u, _ := url.Parse(tc.url)
+	if _, err := tc.announceUDP(u, tc.collection.infohash, EventNone, 0, 0, 100); err == nil {
+		t.Error("expected a timeout")
+	}
+}
+
+func TestUDPMaxDuration(t *testing.T) {
+	defer func(d time.Duration) { udpTimeout = d }(udpTimeout)
+	defer func(d time.Duration) { udpMaxDuration = d }(udpMaxDuration)
+	udpTimeout = 50 * time.Millisecond
+	udpMaxDuration = 200 * time.Millisecond
+
+	// The tracker never answers, the full backoff would take 25 seconds.
+	s := newUDPTestServer(t, 1<<30)
+	defer s.Close()
+
+	tc := newTestCollection(s.url()).tiers[0][0]
+	u, _ := url.Parse(tc.url)
+	start := time.Now()
+	if _, err := tc.announceUDP(u, tc.collection.infohash, EventNone, 0, 0, 100); err == nil {
+		t.Error("expected a timeout")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("the request took %s, expected at most %s", d, udpMaxDuration)
+	}
+}
+
+func TestUDPScrape(t *testing.T) {
+	s := newUDPTestServer(t, 0)
+	defer s.Close()
+
+	tc := newTestCollection(s.url()).tiers[0][0]
+	u, _ := url.Parse(tc.url)
+	hashes := []string{"aaaaaaaaaaaaaaaaaaaa", "bbbbbbbbbbbbbbbbbbbb"}
+	files, err := tc.scrapeUDP(u, hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, h := range hashes {
+		f := files[h]
+		if f == nil {
+			t.Fatalf("missing scrape result for %q", h)
+		}
+		if f.Complete != 5 || f.Incomplete != 7 {
+			t.Errorf("got %d/%d, expected %d/%d", f.Complete, f.Incomplete, 5, 7)
+		}
+		if expected := uint32(16 + i*20); f.Downloaded != expected {
+			t.Errorf("got %d downloaded, expected %d", f.Downloaded, expected)
+		}
+	}
+}
+
+func TestDecodePeers6(t *testing.T) {
+	data := make([]byte, 18)
+	copy(data, net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(data[16:], 6881)
+
+	peers := decodePeers(data, net.IPv6len)
+	if len(peers) != 1 {
+		t.Fatalf("got %d peers, expected %d", len(peers), 1)
+	}
+	if peers[0].IP.String() != "2001:db8::1" || peers[0].Port != 6881 {
+		t.Errorf("got %s, expected 2001:db8::1 port 6881", peers[0])
+	}
+}
@@ -0,0 +1,55 @@
+package util
+
+import (
+	"net"
+)
+
+var privateNets = []string{
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+	"fc00::/7",
+}
+
+// IsPublic reports whether an address can be reached from other networks.
+func IsPublic(ip net.IP) bool {
+	if !ip.IsGlobalUnicast() {
+		return false
+	}
+
+	for _, cidr := range privateNets {
+		_, n, _ := net.ParseCIDR(cidr)
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// PublicAddrs returns the first public IPv4 and IPv6 addresses of the
+// network interfaces, nil if there is none of the family.
+func PublicAddrs() (ipv4, ipv6 net.IP) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, nil
+	}
+
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || !IsPublic(ipnet.IP) {
+			continue
+		}
+
+		if ip4 := ipnet.IP.To4(); ip4 != nil {
+			if ipv4 == nil {
+				ipv4 = ip4
+			}
+		} else if ipv6 == nil {
+			ipv6 = ipnet.IP
+		}
+	}
+
+	return
+}
@@ -0,0 +1,26 @@
+package util
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsPublic(t *testing.T) {
+	addrs := map[string]bool{
+		"8.8.8.8":     true,
+		"2001:db8::1": true,
+		"10.1.2.3":    false,
+		"172.20.0.1":  false,
+		"192.168.1.1": false,
+		"127.0.0.1":   false,
+		"::1":         false,
+		"fd00::1":     false,
+		"fe80::1":     false,
+	}
+
+	for addr, expected := range addrs {
+		if got := IsPublic(net.ParseIP(addr)); got != expected {
+			t.Errorf("%s: got %v, expected %v", addr, got, expected)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package util
+
+import (
+	"errors"
+	"sync"
+)
+
+// Bitfield is a set of piece indexes using the bit layout of the bitfield
+// message: the high bit of the first byte is piece 0.
+type Bitfield struct {
+	bits   []byte
+	length uint32
+	count  uint32
+	mtx    sync.RWMutex
+}
+
+func NewBitfield(length uint32) *Bitfield {
+	bf := new(Bitfield)
+	bf.bits = make([]byte, (length+7)/8)
+	bf.length = length
+	return bf
+}
+
+func NewBitfieldFromBytes(b []byte, length uint32) (*Bitfield, error) {
+	bf := NewBitfield(length)
+	if err := bf.SetBytes(b); err != nil {
+		return nil, err
+	}
+
+	return bf, nil
+}
+
+func (bf *Bitfield) SetBytes(b []byte) error {
+	if len(b) != len(bf.bits) {
+		return errors.New("invalid bitfield length")
+	}
+
+	if rem := bf.length % 8; rem != 0 && b[len(b)-1]&(0xff>>rem) != 0 {
+		return errors.New("spare bits are set in the bitfield")
+	}
+
+	bf.mtx.Lock()
+	defer bf.mtx.Unlock()
+
+	copy(bf.bits, b)
+	bf.count = 0
+	for i := uint32(0); i < bf.length; i++ {
+		if bf.has(i) {
+			bf.count++
+		}
+	}
+
+	return nil
+}
+
+func (bf *Bitfield) Len() uint32 {
+	return bf.length
+}
+
+func (bf *Bitfield) has(index uint32) bool {
+	return bf.bits[index/8]&(0x80>>(index%8)) != 0
+}
+
+func (bf *Bitfield) Has(index uint32) bool {
+	bf.mtx.RLock()
+	defer bf.mtx.RUnlock()
+
+	return index < bf.length && bf.has(index)
+}
+
+func (bf *Bitfield) Set(index uint32) {
+	bf.mtx.Lock()
+	defer bf.mtx.Unlock()
+
+	if index < bf.length && !bf.has(index) {
+		bf.bits[index/8] |= 0x80 >> (index % 8)
+		bf.count++
+	}
+}
+
+func (bf *Bitfield) Clear(index uint32) {
+	bf.mtx.Lock()
+	defer bf.mtx.Unlock()
+
+	if index < bf.length && bf.has(index) {
+		bf.bits[index/8] &^= 0x80 >> (index % 8)
+		bf.count--
+	}
+}
+
+func (bf *Bitfield) Count() uint32 {
+	bf.mtx.RLock()
+	defer bf.mtx.RUnlock()
+
+	return bf.count
+}
+
+func (bf *Bitfield) Complete() bool {
+	return bf.Count() == bf.length
+}
+
+// Bytes returns a copy of the bitfield in wire format.
+func (bf *Bitfield) Bytes() []byte {
+	bf.mtx.RLock()
+	defer bf.mtx.RUnlock()
+
+	b := make([]byte, len(bf.bits))
+	copy(b, bf.bits)
+
+	return b
+}
@@ -0,0 +1,49 @@
+package util
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBitfield(t *testing.T) {
+	bf := NewBitfield(10)
+	bf.Set(0)
+	bf.Set(9)
+	bf.Set(9)
+
+	if !bf.Has(0) || !bf.Has(9) || bf.Has(1) || bf.Has(10) {
+		t.Error("invalid bits in bitfield")
+	}
+
+	if bf.Count() != 2 {
+		t.Errorf("invalid count, got %d, expected 2", bf.Count())
+	}
+
+	if b := bf.Bytes(); !bytes.Equal(b, []byte{0x80, 0x40}) {
+		t.Errorf("invalid bytes, got %x, expected 8040", b)
+	}
+
+	bf.Clear(0)
+	if bf.Has(0) || bf.Count() != 1 {
+		t.Error("bit is not cleared")
+	}
+}
+
+func TestBitfieldFromBytes(t *testing.T) {
+	bf, err := NewBitfieldFromBytes([]byte{0xff, 0xc0}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bf.Complete() {
+		t.Errorf("bitfield is not complete, count is %d", bf.Count())
+	}
+
+	if _, err := NewBitfieldFromBytes([]byte{0xff, 0xe0}, 10); err == nil {
+		t.Error("spare bits are accepted")
+	}
+
+	if _, err := NewBitfieldFromBytes([]byte{0xff}, 10); err == nil {
+		t.Error("short bitfield is accepted")
+	}
+}